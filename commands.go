@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vc2402/gomes/resolve"
+	"github.com/vc2402/gomes/store"
+	"github.com/vc2402/utils"
+
+	log "github.com/cihub/seelog"
+)
+
+// storedTypes are values of all the types kept in the store
+var storedTypes = []interface{}{resolve.Player{}, resolve.Room{}}
+
+var errStoreUnavailable = errors.New("store is unavailable")
+
+// runCommand executes the command given in the command line instead of starting the server;
+// returns false if there is no command
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	var err error
+	switch args[0] {
+	case "export":
+		err = withStore(func(db *store.Store) error { return exportStore(db, fileArg(args)) })
+	case "import":
+		err = withStore(func(db *store.Store) error { return importStore(db, fileArg(args)) })
+	case "inspect":
+		err = inspectStore(args[1:])
+	case "reencrypt":
+		err = withStore(reencryptStore)
+	default:
+		log.Errorf("unknown command: %s", args[0])
+		log.Flush()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Errorf("%s: %v", args[0], err)
+		log.Flush()
+		os.Exit(1)
+	}
+	log.Flush()
+	return true
+}
+
+// fileArg returns the file name argument of the command; "-" means stdin or stdout
+func fileArg(args []string) string {
+	if len(args) > 1 {
+		return args[1]
+	}
+	return "-"
+}
+
+func withStore(fn func(db *store.Store) error) error {
+	db := initStore()
+	if db == nil {
+		return errStoreUnavailable
+	}
+	defer db.Stop()
+	return fn(db)
+}
+
+// exportStore writes all the records of the store to the file as NDJSON
+func exportStore(db *store.Store, file string) error {
+	var w io.Writer = os.Stdout
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	count, err := db.Export(w)
+	if err == nil {
+		log.Infof("export: %d records were exported", count)
+	}
+	return err
+}
+
+// importStore loads records exported with exportStore to the store
+func importStore(db *store.Store, file string) error {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	count, err := db.Import(r, storedTypes...)
+	if err != nil {
+		return err
+	}
+	log.Infof("import: %d records were imported", count)
+	// the dump may be made by older version with records of older schema
+	migrated, err := db.Migrate(storedTypes...)
+	if err == nil && migrated {
+		for _, t := range storedTypes {
+			if err = db.RebuildIndexes(t); err != nil {
+				break
+			}
+		}
+	}
+	return err
+}
+
+// reencryptStore rewrites encrypted fields with the current key (the first one of store.encryption.keys)
+func reencryptStore(db *store.Store) error {
+	count, err := db.Reencrypt(storedTypes...)
+	if err == nil {
+		log.Infof("reencrypt: %d records were re-encrypted", count)
+	}
+	return err
+}
+
+// inspectStore works on the bolt file directly, so it may be used while the store is broken:
+//
+//	inspect buckets            - lists buckets with number of entries
+//	inspect dump <type> [key]  - prints the record with the key or all the records of the type
+//	inspect verify             - checks indexes against records
+//	inspect repair             - checks indexes and fixes them (the server should be stopped)
+func inspectStore(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: inspect buckets|dump <type> [key]|verify|repair")
+	}
+	file := store.BoltFile(utils.GetProperty("store.dbName", "gomesdb"))
+	ins, err := store.OpenInspector(file, args[0] != "repair", storedTypes...)
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+	switch args[0] {
+	case "buckets":
+		buckets, err := ins.Buckets()
+		if err != nil {
+			return err
+		}
+		for _, b := range buckets {
+			fmt.Printf("%s\t%d\n", b.Name, b.Count)
+		}
+	case "dump":
+		if len(args) < 2 {
+			return errors.New("usage: inspect dump <type> [key]")
+		}
+		key := ""
+		if len(args) > 2 {
+			key = args[2]
+		}
+		return ins.Dump(args[1], key, func(key string, d []byte) error {
+			_, err := fmt.Printf("%s\t%s\n", key, d)
+			return err
+		})
+	case "verify", "repair":
+		problems, err := ins.Verify(args[0] == "repair")
+		if err != nil {
+			return err
+		}
+		for _, p := range problems {
+			state := ""
+			if p.Repaired {
+				state = "\trepaired"
+			}
+			fmt.Printf("%s\t%s\t%q\t%s%s\n", p.Kind, p.Index, p.IndexKey, p.Key, state)
+		}
+		log.Infof("inspect: %d problems were found", len(problems))
+	default:
+		return errors.New("unknown inspect command: " + args[0])
+	}
+	return nil
+}
@@ -13,14 +13,17 @@ import (
 	"github.com/vc2402/gomes/resolve"
 )
 
+// Member is the state of the room member in the game; members are referred by their ids (resolve.RoomMember.ID)
 type Member struct {
 	// *resolve.RoomMember
-	idx        int32
+	id         int32
 	profession string
 	isSpy      bool
-	next       int32
-	vote       int
-	active     bool
+	// next is the member asked by this one
+	next int32
+	// vote is the member this one voted for (-1 if not voted yet)
+	vote   int32
+	active bool
 }
 
 type question struct {
@@ -55,6 +58,7 @@ const (
 	cActionVote          = "Vote"
 	cActionGuess         = "Guess"
 	cSolvedResult        = "FIGURED-OUT"
+	cSpyLeftResult       = "SPY-LEFT"
 	cGuessedResult       = "GUESSED"
 	cStateCollecting     = "COLLECTING"
 	cStateActive         = "ACTIVE"
@@ -87,8 +91,8 @@ func (g *ProfessionsGame) Play(ctx context.Context, act *resolve.Action) *resolv
 			switch act.Name {
 			case cActionStartGame:
 				log.Debugf("Play: setting state PREPARING")
-				for idx := range g.members {
-					g.room.Players[idx].SetStatus(cStatePreparing)
+				for _, p := range g.room.Players {
+					p.SetStatus(cStatePreparing)
 				}
 				g.phase = cPhaseProfessions
 				g.room.SetState(ctx, cStatePreparing)
@@ -97,21 +101,21 @@ func (g *ProfessionsGame) Play(ctx context.Context, act *resolve.Action) *resolv
 				if len(act.Bits) > 0 {
 					prof := act.Bits[0].Value
 					m.profession = prof
-					g.room.Players[m.idx].SetStatus(cStateComplete)
+					g.roomMember(m.id).SetStatus(cStateComplete)
 					r.ActionStatus = "ok"
 					g.promote(ctx)
 				}
 			case cActionAsk:
 				if len(act.Bits) > 0 {
 					quest := act.Bits[0].Value
-					q := &question{asking: m.idx, question: quest, replying: m.next}
+					q := &question{asking: m.id, question: quest, replying: m.next}
 					g.question = q
-					g.room.Players[m.idx].SetStatus(cStateWaiting)
-					g.room.Players[m.next].SetStatus(cStateReplying)
+					g.roomMember(m.id).SetStatus(cStateWaiting)
+					g.roomMember(m.next).SetStatus(cStateReplying)
 					g.phase = cStateReplying
 					r.ActionStatus = "ok"
 					g.room.AddHistory(&resolve.KVPair{
-						Key: g.room.Players[m.idx].Player.Name + " > " + g.room.Players[m.next].Player.Name,
+						Key: g.memberName(m.id) + " > " + g.memberName(m.next),
 						Val: quest})
 					g.room.NotifyOnChange(ctx)
 				} else {
@@ -123,12 +127,12 @@ func (g *ProfessionsGame) Play(ctx context.Context, act *resolve.Action) *resolv
 					answ := act.Bits[0].Value
 					q := g.question
 					q.response = answ
-					g.room.Players[m.idx].SetStatus(cStateAsking)
+					g.roomMember(m.id).SetStatus(cStateAsking)
 					g.phase = cStateAsking
 					r.ActionStatus = "ok"
 
 					g.room.AddHistory(&resolve.KVPair{
-						Key: g.room.Players[q.asking].Player.Name + " < " + g.room.Players[m.idx].Player.Name,
+						Key: g.memberName(q.asking) + " < " + g.memberName(m.id),
 						Val: answ})
 					g.promote(ctx)
 					g.room.NotifyOnChange(ctx)
@@ -137,11 +141,17 @@ func (g *ProfessionsGame) Play(ctx context.Context, act *resolve.Action) *resolv
 				}
 			case cActionVote:
 				if len(act.Bits) > 0 {
-					if idx, err := strconv.Atoi(act.Bits[0].Value); err != nil || idx >= len(g.members) || idx < 0 || !g.members[idx].active {
+					// the vote is the index of the member in room's players
+					idx, err := strconv.Atoi(act.Bits[0].Value)
+					var voted *Member
+					if err == nil && idx >= 0 && idx < len(g.room.Players) {
+						voted = g.member(g.room.Players[idx].ID)
+					}
+					if voted == nil || !voted.active {
 						r.ActionStatus = "incorrect"
 						log.Warnf("Vote: invalid index: %s", act.Bits[0].Value)
 					} else {
-						m.vote = idx
+						m.vote = voted.id
 						g.votesCount++
 						g.promote(ctx)
 					}
@@ -185,7 +195,7 @@ func (g *ProfessionsGame) Params(ctx context.Context) []*resolve.KVPair {
 				ret = append(ret, &resolve.KVPair{Key: "isSpy", Val: "true"})
 			}
 			if g.room.Phase(ctx) != cPhaseVoting && g.sentAway != -1 {
-				ret = append(ret, &resolve.KVPair{Key: "exile", Val: g.room.Players[g.sentAway].Player.Name})
+				ret = append(ret, &resolve.KVPair{Key: "exile", Val: g.memberName(g.sentAway)})
 			}
 			if g.guessedProfession != "" {
 				ret = append(ret, &resolve.KVPair{Key: "guess", Val: g.guessedProfession})
@@ -208,24 +218,138 @@ func (g *ProfessionsGame) NewMember(ctx context.Context, rm *resolve.RoomMember)
 	profMux.Lock()
 	defer profMux.Unlock()
 	log.Tracef("NewMember: %v", *rm)
-	m := &Member{profession: "", isSpy: false, idx: rm.Index}
+	m := &Member{profession: "", isSpy: false, id: rm.ID}
 	g.members = append(g.members, m)
-	m.next = 0
-	count := len(g.room.Players)
-	if count > 0 {
-		g.members[count-1].next = int32(count)
-	}
+	g.link(false)
 	log.Tracef("NewMember: adding member with id %s %v", rm.Player.ID, *m)
 	rm.SetStatus("NEW")
 }
 
+// MemberLeft removes the member from the game and repairs the order of turns; the game is finished
+// if the spy left or there are too few active members
+func (g *ProfessionsGame) MemberLeft(ctx context.Context, rm *resolve.RoomMember) {
+	profMux.Lock()
+	defer profMux.Unlock()
+	log.Tracef("MemberLeft: %v", *rm)
+	m := g.member(rm.ID)
+	if m == nil {
+		return
+	}
+	for i, p := range g.members {
+		if p == m {
+			g.members = append(g.members[:i:i], g.members[i+1:]...)
+			break
+		}
+	}
+	switch g.room.State {
+	case cStateCollecting:
+		g.link(false)
+	case cStatePreparing:
+		g.link(false)
+		if len(g.members) < 2 {
+			g.room.SetState(ctx, cStateCollecting)
+			g.phase = "NEW"
+			for _, p := range g.members {
+				p.profession = ""
+			}
+			for _, p := range g.room.Players {
+				p.SetStatus("NEW")
+			}
+		} else {
+			g.promote(ctx)
+		}
+	case cStateActive:
+		if !m.active {
+			// the exiled member left
+			return
+		}
+		g.membersCount--
+		if m.isSpy {
+			g.room.SetState(ctx, cStateFinished)
+			g.phase = cSpyLeftResult
+			return
+		}
+		if g.membersCount < 3 {
+			g.room.SetState(ctx, cStateFinished)
+			g.phase = cGuessedResult
+			return
+		}
+		g.link(true)
+		switch g.phase {
+		case cStateAsking:
+			// the next member asks instead of the one who left
+			if rm.Status == cStateAsking {
+				g.roomMember(m.next).SetStatus(cStateAsking)
+			}
+		case cStateReplying:
+			if g.question.replying == m.id {
+				// the question goes to the next member
+				g.question.replying = m.next
+				g.roomMember(m.next).SetStatus(cStateReplying)
+			} else if g.question.asking == m.id {
+				// there is nobody to answer to; the replying member asks instead
+				g.phase = cStateAsking
+				g.roomMember(g.question.replying).SetStatus(cStateAsking)
+			}
+		case cPhaseVoting:
+			if m.vote != -1 {
+				g.votesCount--
+			}
+			for _, p := range g.members {
+				if p.active && p.vote == m.id {
+					p.vote = -1
+					g.votesCount--
+				}
+			}
+			g.promote(ctx)
+		}
+	}
+}
+
 func (g *ProfessionsGame) getMember(ctx context.Context) *Member {
 	rm, ok := ctx.Value(resolve.CROOMMEMBER).(*resolve.RoomMember)
 	// log.Tracef("getMember: %v (%v)", rm, ok)
 	if !ok {
 		return nil
 	}
-	return g.members[rm.Index]
+	return g.member(rm.ID)
+}
+
+// member returns the member with the id or nil if there is no such member
+func (g *ProfessionsGame) member(id int32) *Member {
+	for _, m := range g.members {
+		if m.id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// roomMember returns the room member with the id; members who left the room are replaced with a stub
+func (g *ProfessionsGame) roomMember(id int32) *resolve.RoomMember {
+	if rm := g.room.Member(id); rm != nil {
+		return rm
+	}
+	return &resolve.RoomMember{ID: id, Player: &resolve.Player{}}
+}
+
+// memberName returns the name of the player of the member with the id
+func (g *ProfessionsGame) memberName(id int32) string {
+	return g.roomMember(id).Player.Name
+}
+
+// link makes members (only active ones if activeOnly) ask each other in the order they joined the room
+// with the last one asking the first; ids grow in this order, so the round is over when the question goes to the lesser id
+func (g *ProfessionsGame) link(activeOnly bool) {
+	var linked []*Member
+	for _, m := range g.members {
+		if !activeOnly || m.active {
+			linked = append(linked, m)
+		}
+	}
+	for i, m := range linked {
+		m.next = linked[(i+1)%len(linked)].id
+	}
 }
 
 func (g *ProfessionsGame) getActions(ctx context.Context, m *Member) []string {
@@ -244,9 +368,9 @@ func (g *ProfessionsGame) getActions(ctx context.Context, m *Member) []string {
 			}
 		case cStateActive:
 			if m.active {
-				if g.room.Players[m.idx].Status == cStateAsking {
+				if g.roomMember(m.id).Status == cStateAsking {
 					ret = append(ret, cActionAsk)
-				} else if g.room.Players[m.idx].Status == cStateReplying {
+				} else if g.roomMember(m.id).Status == cStateReplying {
 					ret = append(ret, cActionAnswer)
 				} else if g.room.Phase(ctx) == cPhaseVoting && m.vote == -1 {
 					ret = append(ret, cActionVote)
@@ -273,7 +397,7 @@ func (g *ProfessionsGame) promote(ctx context.Context) {
 				return
 			}
 		}
-		limit := int32(len(g.room.Players))
+		limit := int32(len(g.members))
 		idx := rand.Int31n(limit)
 		g.profession = g.members[idx].profession
 		log.Tracef("promote PREPARING: selected profession is %s[%d]", g.profession, idx)
@@ -289,75 +413,69 @@ func (g *ProfessionsGame) promote(ctx context.Context) {
 		g.membersCount = len(g.members)
 		for i, m := range g.members {
 			if i == 0 {
-				g.room.Players[idx].SetStatus(cStateAsking)
+				g.roomMember(m.id).SetStatus(cStateAsking)
 			} else {
-				g.room.Players[idx].SetStatus(cStateWaiting)
+				g.roomMember(m.id).SetStatus(cStateWaiting)
 			}
 			m.active = true
 		}
+		g.link(true)
 		// g,members[0].RoomMember.SetStatus()
 		g.room.SetState(ctx, cStateActive)
 	case cStateActive:
 		log.Debugf("promote: ACTIVE; phase: %s question is: %+v", g.phase, *g.question)
 		if g.phase == cStateAsking && g.question.replying < g.question.asking {
 			g.phase = cPhaseVoting
-			for idx, m := range g.members {
+			for _, m := range g.members {
 				if m.active {
-					g.room.Players[idx].SetStatus(cPhaseVoting)
+					g.roomMember(m.id).SetStatus(cPhaseVoting)
 					m.vote = -1
 				}
 			}
 			g.votesCount = 0
 			g.room.NotifyOnChange(ctx)
 		} else if g.phase == cPhaseVoting && g.votesCount == g.membersCount {
-			votes := make([]int, len(g.members))
+			votes := map[int32]int{}
 			max := 0
-			maxIdx := -1
-			for i, p := range g.members {
+			var exiled *Member
+			for _, p := range g.members {
 				if p.active {
 					g.addVoteToHistory(p, p.vote)
 					votes[p.vote]++
 					if votes[p.vote] > max {
 						max = votes[p.vote]
-						maxIdx = i
+						exiled = g.member(p.vote)
 					}
 				}
 			}
-			g.members[maxIdx].active = false
+			exiled.active = false
 			g.membersCount--
-			g.sentAway = int32(maxIdx)
-			if g.members[maxIdx].isSpy {
+			g.sentAway = exiled.id
+			if exiled.isSpy {
 				g.room.SetState(ctx, cStateFinished)
 				g.phase = cSolvedResult
 			} else if g.membersCount < 3 {
 				g.room.SetState(ctx, cStateFinished)
 				g.phase = cGuessedResult
 			} else {
-				g.room.AddHistory(&resolve.KVPair{Key: "!", Val: g.room.Players[maxIdx].Player.Name})
+				g.room.AddHistory(&resolve.KVPair{Key: "!", Val: g.memberName(exiled.id)})
 				g.room.NextRound()
 				g.phase = cStateAsking
 				g.votesCount = 0
-				prev := -1
-				first := -1
-				for i, p := range g.members {
+				first := true
+				for _, p := range g.members {
 					if p.active {
-						if first == -1 {
-							first = i
-							g.room.Players[i].SetStatus(cStateAsking)
+						if first {
+							first = false
+							g.roomMember(p.id).SetStatus(cStateAsking)
 						} else {
-							g.room.Players[i].SetStatus(cStateWaiting)
-							p.next = int32(prev)
+							g.roomMember(p.id).SetStatus(cStateWaiting)
 						}
-						prev = i
 					}
 				}
-				if prev != -1 {
-					g.members[prev].next = int32(first)
-					log.Debugf("promote: members loop was renewed")
-				} else {
-					log.Errorf("promote: can not loop members!")
-				}
-				g.members[maxIdx].next = -1
+				g.link(true)
+				exiled.next = -1
+				log.Debugf("promote: members loop was renewed")
 			}
 			g.room.NotifyOnChange(ctx)
 		}
@@ -366,15 +484,15 @@ func (g *ProfessionsGame) promote(ctx context.Context) {
 
 }
 
-func (g *ProfessionsGame) addVoteToHistory(m *Member, idx int) {
-	g.room.AddHistory(&resolve.KVPair{Key: g.room.Players[m.idx].Player.Name + " #", Val: g.room.Players[idx].Player.Name})
+func (g *ProfessionsGame) addVoteToHistory(m *Member, id int32) {
+	g.room.AddHistory(&resolve.KVPair{Key: g.memberName(m.id) + " #", Val: g.memberName(id)})
 }
 
 func (g *ProfessionsGame) SaveState() interface{} {
 	members := make([]map[string]interface{}, len(g.members), len(g.members))
 	for i, mb := range g.members {
 		mem := map[string]interface{}{
-			"idx": mb.idx, "profession": mb.profession, "isSpy": mb.isSpy,
+			"id": mb.id, "profession": mb.profession, "isSpy": mb.isSpy,
 			"next": mb.next, "active": mb.active, "vote": mb.vote,
 		}
 		members[i] = mem
@@ -387,7 +505,7 @@ func (g *ProfessionsGame) SaveState() interface{} {
 	if g.question != nil {
 		ret["asking"] = g.asking
 		ret["replying"] = g.replying
-		ret["question"] = g.question
+		ret["question"] = g.question.question
 		ret["response"] = g.response
 	}
 
@@ -414,20 +532,24 @@ func (g *ProfessionsGame) LoadState(saved interface{}) error {
 		}
 
 		mems := in["members"].([]interface{})
-		g.members = make([]*Member, len(mems), len(mems))
-		log.Tracef("LoadState: loading members; len: %d", len(g.members))
+		g.members = make([]*Member, 0, len(mems))
+		log.Tracef("LoadState: loading members; len: %d", len(mems))
 		for _, memb := range mems {
 			mb := memb.(map[string]interface{})
-			idx := int(mb["idx"].(float64))
-			log.Tracef("LoadState: next member: %d: %+v", idx, mb)
-			g.members[idx] = &Member{
-				idx:        int32(mb["idx"].(float64)),
+			// states saved before members had ids have their indexes instead (they are the same)
+			id, ok := mb["id"].(float64)
+			if !ok {
+				id = mb["idx"].(float64)
+			}
+			log.Tracef("LoadState: next member: %v: %+v", id, mb)
+			g.members = append(g.members, &Member{
+				id:         int32(id),
 				profession: mb["profession"].(string),
 				active:     mb["active"].(bool),
 				next:       int32(mb["next"].(float64)),
 				isSpy:      mb["isSpy"].(bool),
-				vote:       int(mb["vote"].(float64)),
-			}
+				vote:       int32(mb["vote"].(float64)),
+			})
 		}
 		log.Tracef("LoadState: exiting")
 		return nil
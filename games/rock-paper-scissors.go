@@ -13,6 +13,7 @@ import (
 
 type RPSMember struct {
 	// *resolve.RoomMember
+	id        int32
 	selection string
 	winner    bool
 }
@@ -37,7 +38,7 @@ const (
 
 func (g *RPSGame) Play(ctx context.Context, act *resolve.Action) *resolve.ActionResult {
 	r := &resolve.ActionResult{ActionStatus: "invalid"}
-	m, idx := g.getMember(ctx)
+	m, rm := g.getMember(ctx)
 	if m != nil {
 		log.Tracef("Play: action %s for %v", act.Name, *m)
 		actions := g.getActions(m)
@@ -57,7 +58,7 @@ func (g *RPSGame) Play(ctx context.Context, act *resolve.Action) *resolve.Action
 					case cRock, cPaper, cScissors:
 						m.selection = sel
 						r.ActionStatus = "ok"
-						g.room.Players[idx].SetStatus("COMPLETE")
+						rm.SetStatus("COMPLETE")
 						g.phase = cActionSelect
 						g.promote(ctx)
 					default:
@@ -118,20 +119,40 @@ func (g *RPSGame) Actions(ctx context.Context) []string {
 
 func (g *RPSGame) NewMember(ctx context.Context, rm *resolve.RoomMember) {
 	log.Tracef("NewMember: %v", *rm)
-	m := &RPSMember{selection: ""}
+	m := &RPSMember{id: rm.ID, selection: ""}
 	g.members = append(g.members, m)
 	log.Tracef("NewMember: adding member with id %s %v", rm.Player.ID, *m)
 	rm.SetStatus("NEW")
 	g.promote(ctx)
 }
 
-func (g *RPSGame) getMember(ctx context.Context) (*RPSMember, int32) {
-	m, ok := ctx.Value(resolve.CROOMMEMBER).(*resolve.RoomMember)
+// MemberLeft removes the member; the one remaining in the active game wins
+func (g *RPSGame) MemberLeft(ctx context.Context, rm *resolve.RoomMember) {
+	log.Tracef("MemberLeft: %v", *rm)
+	for i, m := range g.members {
+		if m.id == rm.ID {
+			g.members = append(g.members[:i:i], g.members[i+1:]...)
+			break
+		}
+	}
+	if g.room.State == "ACTIVE" && len(g.members) == 1 {
+		g.members[0].winner = true
+		g.room.SetState(ctx, "FINISHED")
+	}
+}
+
+func (g *RPSGame) getMember(ctx context.Context) (*RPSMember, *resolve.RoomMember) {
+	rm, ok := ctx.Value(resolve.CROOMMEMBER).(*resolve.RoomMember)
 	log.Tracef("getMember: %v", ok)
 	if !ok {
-		return nil, -1
+		return nil, nil
+	}
+	for _, m := range g.members {
+		if m.id == rm.ID {
+			return m, rm
+		}
 	}
-	return g.members[m.Index], m.Index
+	return nil, nil
 }
 
 func (g *RPSGame) getActions(m *RPSMember) []string {
@@ -194,7 +215,7 @@ func (g *RPSGame) promote(ctx context.Context) {
 func (g *RPSGame) SaveState() interface{} {
 	members := make([]map[string]interface{}, len(g.members), len(g.members))
 	for i, mb := range g.members {
-		mem := map[string]interface{}{"idx": i, "selection": mb.selection, "winner": mb.winner}
+		mem := map[string]interface{}{"idx": i, "id": mb.id, "selection": mb.selection, "winner": mb.winner}
 		members[i] = mem
 	}
 	ret := map[string]interface{}{"phase": g.phase, "members": members}
@@ -213,7 +234,13 @@ func (g *RPSGame) LoadState(saved interface{}) error {
 			mb := memb.(map[string]interface{})
 			idx := int(mb["idx"].(float64))
 			log.Tracef("LoadState: next member: %d: %+v", idx, mb)
+			// states saved before members had ids have their indexes instead
+			id := int32(idx)
+			if v, ok := mb["id"].(float64); ok {
+				id = int32(v)
+			}
 			g.members[idx] = &RPSMember{ //RoomMember: g.room.Players[idx],
+				id:        id,
 				selection: mb["selection"].(string),
 				winner:    mb["winner"].(bool),
 			}
@@ -2,6 +2,7 @@ package resolve
 
 import (
 	"context"
+	"errors"
 
 	log "github.com/cihub/seelog"
 	"github.com/kataras/iris"
@@ -36,18 +37,27 @@ func ProcessAdmin(ctx iris.Context, cont context.Context) {
 	log.Tracef("admin request: %+v", body)
 	switch body.Method {
 	case "listUsers":
-		filter := store.Filter{Limit: 100}
+		filter := store.Filter{Limit: 100, SortBy: "Name", Desc: true}
 		if params["startsWith"] != nil {
-			filter.Field = "Login"
-			filter.Mask = params["startsWith"].(string)
-			filter.Flags = store.FFSeek
+			prefix := params["startsWith"].(string)
+			filter.Or = []store.Filter{
+				{Field: "Login", Mask: prefix, Flags: store.FFSeek},
+				{Field: "Email", Mask: prefix, Flags: store.FFSeek},
+			}
+		}
+		if after, ok := params["after"].(string); ok {
+			filter.After = after
 		}
-		players, err := listPlayers(filter)
+		page, err := listPlayers(filter)
 		if err != nil {
 			createErrorResponse(ctx, -201, "problem while listing users", 500)
 			return
 		}
-		ctx.JSON(map[string]interface{}{"status": "ok", "code": 0, "description": "users", "users": players})
+		res := map[string]interface{}{"status": "ok", "code": 0, "description": "users", "users": page.Items}
+		if page.HasNext {
+			res["next"] = page.Cursors[len(page.Cursors)-1]
+		}
+		ctx.JSON(res)
 	case "createUser":
 		login, lok := params["login"].(string)
 		name, nok := params["name"].(string)
@@ -91,7 +101,15 @@ func ProcessAdmin(ctx iris.Context, cont context.Context) {
 		oldRoles := pl.Roles
 		pl.Roles = roles
 		log.Tracef("setting roles for %s(%s): %+v", pl.Name, pl.ID, roles)
-		pl.save()
+		if err := pl.save(); err != nil {
+			if err == store.ErrConflict {
+				forgetPlayer(id)
+				createErrorResponse(ctx, -207, "user was changed concurrently; try again", 409)
+			} else {
+				createErrorResponse(ctx, -500, "internal server error", 500)
+			}
+			return
+		}
 		ctx.JSON(map[string]interface{}{"status": "ok", "code": 0, "description": "updated", "oldRoles": oldRoles})
 	case "deleteUser":
 		id, iok := params["userId"].(string)
@@ -105,6 +123,98 @@ func ProcessAdmin(ctx iris.Context, cont context.Context) {
 			return
 		}
 		ctx.JSON(map[string]interface{}{"status": "ok", "code": 0, "description": "deleted", "user": *pl})
+	case "backup":
+		file, err := getStorage().BackupNow()
+		if err != nil {
+			log.Warnf("backup: %v", err)
+			createErrorResponse(ctx, -208, "problem while making backup", 500)
+			return
+		}
+		ctx.JSON(map[string]interface{}{"status": "ok", "code": 0, "description": "backup created", "file": file})
+	case "listDeleted":
+		filter := store.Filter{Limit: 100}
+		if after, ok := params["after"].(string); ok {
+			filter.After = after
+		}
+		var page *store.Page
+		var err error
+		kind, _ := params["type"].(string)
+		switch kind {
+		case "", "users":
+			kind = "users"
+			_, page, err = playerRepo().FindDeleted(filter)
+		case "rooms":
+			_, page, err = roomRepo().FindDeleted(filter)
+		default:
+			createErrorResponse(ctx, -209, "type should be users or rooms", 400)
+			return
+		}
+		if err != nil {
+			log.Warnf("listDeleted: %v", err)
+			createErrorResponse(ctx, -210, "problem while listing deleted items", 500)
+			return
+		}
+		res := map[string]interface{}{"status": "ok", "code": 0, "description": kind, kind: page.Items}
+		if page.HasNext {
+			res["next"] = page.Cursors[len(page.Cursors)-1]
+		}
+		ctx.JSON(res)
+	case "restore":
+		id, iok := params["id"].(string)
+		if !iok {
+			createErrorResponse(ctx, -203, "id should be set", 400)
+			return
+		}
+		var err error
+		switch params["type"] {
+		case nil, "users":
+			err = restorePlayer(id)
+		case "rooms":
+			err = restoreRoom(id)
+		default:
+			createErrorResponse(ctx, -209, "type should be users or rooms", 400)
+			return
+		}
+		if errors.Is(err, store.ErrNotFound) {
+			createErrorResponse(ctx, -211, "deleted item not found", 404)
+			return
+		}
+		if err != nil {
+			log.Warnf("restore: %v", err)
+			createErrorResponse(ctx, -500, "internal server error", 500)
+			return
+		}
+		ctx.JSON(map[string]interface{}{"status": "ok", "code": 0, "description": "restored", "id": id})
+	case "search":
+		query, qok := params["query"].(string)
+		if !qok || query == "" {
+			createErrorResponse(ctx, -212, "query should be set", 400)
+			return
+		}
+		limit := 20
+		if l, ok := params["limit"].(float64); ok && l > 0 {
+			limit = int(l)
+		}
+		var items interface{}
+		var scores []float64
+		var err error
+		kind, _ := params["type"].(string)
+		switch kind {
+		case "", "users":
+			kind = "users"
+			items, scores, err = playerRepo().Search(query, limit)
+		case "rooms":
+			items, scores, err = roomRepo().Search(query, limit)
+		default:
+			createErrorResponse(ctx, -209, "type should be users or rooms", 400)
+			return
+		}
+		if err != nil {
+			log.Warnf("search: %v", err)
+			createErrorResponse(ctx, -213, "problem while searching", 500)
+			return
+		}
+		ctx.JSON(map[string]interface{}{"status": "ok", "code": 0, "description": kind, kind: items, "scores": scores})
 	}
 
 	// ctx.StatusCode(200)
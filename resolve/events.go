@@ -0,0 +1,190 @@
+package resolve
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// Types of RoomEvent
+const (
+	RETPlayerJoined    = "PLAYER_JOINED"
+	RETPlayerLeft      = "PLAYER_LEFT"
+	RETPlayerKicked    = "PLAYER_KICKED"
+	RETStateChanged    = "STATE_CHANGED"
+	RETActionPlayed    = "ACTION_PLAYED"
+	RETHistoryAppended = "HISTORY_APPENDED"
+	// RETChanged is published when the game changed the room some other way
+	RETChanged = "CHANGED"
+	// RETRemoved is published when the room is deleted or expired
+	RETRemoved = "REMOVED"
+)
+
+// cROOMEVENT is the context key of the event subscriptions are executed for
+const cROOMEVENT = "RoomEvent"
+
+// cRoomEventsBuffer is the size of subscriber's channel; events are dropped for subscribers that don't keep up
+const cRoomEventsBuffer = 64
+
+// cRoomEventsBacklog is the number of the last events of the room kept to be resent to resuming subscribers
+const cRoomEventsBacklog = 256
+
+// RoomEvent is the change of the room delivered to subscribers of the room
+type RoomEvent struct {
+	// Seq is the number of the event in the sequence of the room's events; it is set by publish
+	Seq    uint64 `json:"seq"`
+	Type   string `json:"type"`
+	RoomID string `json:"roomId"`
+	Round  int32  `json:"round"`
+	State  string `json:"state,omitempty"`
+	// Player is the player who joined (left) the room or played the action
+	Player *Player `json:"player,omitempty"`
+	// Name is the name of the action or the key of the history entry
+	Name string `json:"name,omitempty"`
+	// Value is the value of the history entry
+	Value string `json:"value,omitempty"`
+}
+
+// roomBus delivers events of rooms to their subscribers
+type roomBus struct {
+	mux sync.RWMutex
+	// subs are subscribers by room id; subscribers of all the rooms are kept under empty id
+	subs map[string]map[chan *RoomEvent]bool
+	// seq is the number of the last event of the room
+	seq map[string]uint64
+	// backlog keeps the last events of the room
+	backlog map[string][]*RoomEvent
+	// epoch is the time the bus was created at; sequences of rooms are restarted with it
+	epoch int64
+}
+
+var roomEvents = newRoomBus()
+
+func newRoomBus() *roomBus {
+	return &roomBus{
+		subs:    map[string]map[chan *RoomEvent]bool{},
+		seq:     map[string]uint64{},
+		backlog: map[string][]*RoomEvent{},
+		epoch:   time.Now().UnixNano(),
+	}
+}
+
+// eventID returns the id of the event given to clients: the epoch of the bus and the seq of the event,
+// so ids given before the server restart are not mistaken for ids of new events
+func (b *roomBus) eventID(ev *RoomEvent) string {
+	return strconv.FormatInt(b.epoch, 10) + "-" + strconv.FormatUint(ev.Seq, 10)
+}
+
+// parseEventID returns the epoch and the seq of the event id returned by eventID;
+// the epoch of plain numbers (ids given by older versions) is 0
+func parseEventID(id string) (epoch int64, seq uint64, err error) {
+	if idx := strings.Index(id, "-"); idx != -1 {
+		if epoch, err = strconv.ParseInt(id[:idx], 10, 64); err != nil {
+			return 0, 0, errors.New("invalid event id: " + id)
+		}
+		id = id[idx+1:]
+	}
+	if seq, err = strconv.ParseUint(id, 10, 64); err != nil {
+		return 0, 0, errors.New("invalid event id: " + id)
+	}
+	return epoch, seq, nil
+}
+
+// subscribe returns the channel events of the room (of all the rooms if roomID is empty) are sent to
+// and the func that unsubscribes and closes the channel
+func (b *roomBus) subscribe(roomID string) (<-chan *RoomEvent, func()) {
+	ch, cancel, _ := b.resume(roomID, b.epoch, 0)
+	return ch, cancel
+}
+
+// resume subscribes to events of the room like subscribe and also returns events of the room published
+// after the one numbered after in the epoch; if some of them are not kept in the backlog any more
+// (or the epoch is not the one of the bus as the sequence was restarted with the server)
+// RETChanged event numbered as the last one is returned instead, so the subscriber reloads the room
+func (b *roomBus) resume(roomID string, epoch int64, after uint64) (<-chan *RoomEvent, func(), []*RoomEvent) {
+	ch := make(chan *RoomEvent, cRoomEventsBuffer)
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	missed := []*RoomEvent{}
+	if last := b.seq[roomID]; after > 0 && (after != last || epoch != b.epoch) {
+		backlog := b.backlog[roomID]
+		if epoch != b.epoch || after > last || len(backlog) == 0 || backlog[0].Seq > after+1 {
+			missed = append(missed, &RoomEvent{Seq: last, Type: RETChanged, RoomID: roomID})
+		} else {
+			for _, ev := range backlog {
+				if ev.Seq > after {
+					missed = append(missed, ev)
+				}
+			}
+		}
+	}
+	if b.subs[roomID] == nil {
+		b.subs[roomID] = map[chan *RoomEvent]bool{}
+	}
+	b.subs[roomID][ch] = true
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mux.Lock()
+			defer b.mux.Unlock()
+			delete(b.subs[roomID], ch)
+			if len(b.subs[roomID]) == 0 {
+				delete(b.subs, roomID)
+			}
+			close(ch)
+		})
+	}
+	return ch, cancel, missed
+}
+
+// publish numbers ev and sends it to subscribers of its room and of all the rooms without blocking;
+// the backlog of the room is dropped when the room is removed
+func (b *roomBus) publish(ev *RoomEvent) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.seq[ev.RoomID]++
+	ev.Seq = b.seq[ev.RoomID]
+	log.Tracef("publish: %s event %d of room %s", ev.Type, ev.Seq, ev.RoomID)
+	if ev.Type == RETRemoved {
+		delete(b.backlog, ev.RoomID)
+	} else {
+		backlog := append(b.backlog[ev.RoomID], ev)
+		if len(backlog) > cRoomEventsBacklog {
+			backlog = backlog[len(backlog)-cRoomEventsBacklog:]
+		}
+		b.backlog[ev.RoomID] = backlog
+	}
+	for _, id := range []string{ev.RoomID, ""} {
+		for ch := range b.subs[id] {
+			select {
+			case ch <- ev:
+			default:
+				log.Warnf("publish: subscriber of room %s is full; %s event is dropped", id, ev.Type)
+			}
+		}
+	}
+}
+
+// subscriberGets tells if ev should be sent to the subscriber of the player of ctx and if it is the last event
+// the subscriber gets: the player who left the room or was kicked gets the event and no more ones
+// unless the room is still visible to him (as to the owner or admin)
+func subscriberGets(ctx context.Context, ev *RoomEvent) (deliver bool, last bool) {
+	if ev.Type == RETRemoved {
+		return true, true
+	}
+	room, err := getRoom(ctx, ev.RoomID)
+	if err != nil {
+		return false, true
+	}
+	if room.visibleTo(ctx) {
+		return true, false
+	}
+	playerID, _ := ctx.Value(cSESSION_ID).(string)
+	gone := ev.Type == RETPlayerLeft || ev.Type == RETPlayerKicked
+	return gone && ev.Player != nil && ev.Player.ID == playerID, true
+}
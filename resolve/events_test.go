@@ -0,0 +1,114 @@
+package resolve
+
+import (
+	"testing"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+func TestSubscriberGets(t *testing.T) {
+	setupStorage(t)
+	room := newTestRoom(t, "o", "a", "b")
+	newPlayer("name-x", "x", "login-x")
+	if _, err := leaveRoom(session("a"), room.ID); err != nil {
+		t.Fatal(err)
+	}
+	left := &RoomEvent{Type: RETPlayerLeft, RoomID: room.ID, Player: &Player{ID: "a"}}
+	tests := []struct {
+		name          string
+		player        string
+		ev            *RoomEvent
+		deliver, last bool
+	}{
+		{"player who left", "a", left, true, true},
+		{"member", "b", left, true, false},
+		{"owner", "o", left, true, false},
+		{"stranger", "x", left, false, true},
+		{"player who left gets no more events", "a", &RoomEvent{Type: RETStateChanged, RoomID: room.ID}, false, true},
+		{"removed room", "b", &RoomEvent{Type: RETRemoved, RoomID: room.ID}, true, true},
+	}
+	for _, tt := range tests {
+		if deliver, last := subscriberGets(session(tt.player), tt.ev); deliver != tt.deliver || last != tt.last {
+			t.Errorf("%s: deliver %v, last %v", tt.name, deliver, last)
+		}
+	}
+}
+
+func TestResumeEvents(t *testing.T) {
+	b := newRoomBus()
+	for i := 0; i < 3; i++ {
+		b.publish(&RoomEvent{Type: RETStateChanged, RoomID: "r"})
+	}
+	epoch, seq, err := parseEventID(b.eventID(&RoomEvent{Seq: 1}))
+	if err != nil || epoch != b.epoch || seq != 1 {
+		t.Fatalf("event id is parsed as %d, %d: %v", epoch, seq, err)
+	}
+	_, cancel, missed := b.resume("r", epoch, seq)
+	cancel()
+	if len(missed) != 2 || missed[0].Seq != 2 || missed[1].Seq != 3 {
+		t.Errorf("missed events %+v", missed)
+	}
+	// the id given before the restart of the server
+	_, cancel, missed = b.resume("r", epoch-1, seq)
+	cancel()
+	if len(missed) != 1 || missed[0].Type != RETChanged || missed[0].Seq != 3 {
+		t.Errorf("events missed in the other epoch %+v", missed)
+	}
+	if _, _, err = parseEventID("x-1"); err == nil {
+		t.Error("invalid event id is parsed")
+	}
+}
+
+func TestSubscriptionRoom(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		operation string
+		want      string
+	}{
+		{"inline", `subscription { roomUpdates(id: "r1") { type } }`, nil, "", "r1"},
+		{"variable", `subscription s($room: String!) { roomUpdates(id: $room) { type } }`, map[string]interface{}{"room": "r2"}, "", "r2"},
+		{"operation", `subscription a { roomUpdates(id: "r1") { type } } subscription b { roomUpdates(id: "r3") { type } }`, nil, "b", "r3"},
+		{"other field", `subscription { other(id: "r1") }`, nil, "", ""},
+	}
+	for _, tt := range tests {
+		doc, err := parser.Parse(parser.ParseParams{Source: tt.query})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		sub := &graphqlws.Subscription{Query: tt.query, Variables: tt.variables, OperationName: tt.operation, Document: doc}
+		if got := subscriptionRoom(sub); got != tt.want {
+			t.Errorf("%s: room %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRoomEvents(t *testing.T) {
+	setupStorage(t)
+	room := newTestRoom(t, "o")
+	events, cancel := roomEvents.subscribe(room.ID)
+	defer cancel()
+	all, cancelAll := roomEvents.subscribe("")
+	defer cancelAll()
+	if _, err := joinRoom(session("a"), room.ID, "name-a"); err == nil {
+		t.Fatal("player who doesn't exist joined the room")
+	}
+	newPlayer("name-a", "a", "login-a")
+	if _, err := joinRoom(session("a"), room.ID, "name-a"); err != nil {
+		t.Fatal(err)
+	}
+	ev := <-events
+	if ev.Type != RETPlayerJoined || ev.RoomID != room.ID || ev.Player == nil || ev.Player.ID != "a" || ev.Seq != 1 {
+		t.Errorf("joining is published as %+v", ev)
+	}
+	if got := <-all; got != ev {
+		t.Errorf("subscriber of all the rooms got %+v", got)
+	}
+	// the room without changes of its own gets RETChanged
+	room.NotifyOnChange(session("o"))
+	if ev = <-events; ev.Type != RETChanged || ev.Seq != 2 {
+		t.Errorf("notification is published as %+v", ev)
+	}
+}
@@ -0,0 +1,137 @@
+package resolve
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/vc2402/gomes/store"
+
+	log "github.com/cihub/seelog"
+)
+
+// RoomExpiry configures removal of stale rooms by the sweeper
+type RoomExpiry struct {
+	// Finished is the period of inactivity FINISHED rooms are removed after; 0 means they are kept
+	Finished time.Duration
+	// Abandoned is the period of inactivity COLLECTING rooms are removed after; 0 means they are kept
+	Abandoned time.Duration
+	// Archive makes the sweeper move rooms to the archive instead of deleting them
+	Archive bool
+	// Interval is the period the sweeper runs with
+	Interval time.Duration
+}
+
+// StartRoomSweeper runs sweepRooms every cfg.Interval until the returned func is called
+func StartRoomSweeper(cfg RoomExpiry) (stop func()) {
+	done := make(chan struct{})
+	if cfg.Interval <= 0 || cfg.Finished <= 0 && cfg.Abandoned <= 0 {
+		return func() {}
+	}
+	log.Infof("StartRoomSweeper: stale rooms are checked every %v", cfg.Interval)
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				sweepRooms(cfg)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// sweepRooms removes rooms which are out of their TTL from the store and the cache and notifies subscribers
+func sweepRooms(cfg RoomExpiry) {
+	storage := getStorage()
+	if storage == nil {
+		return
+	}
+	ttls := map[string]time.Duration{"FINISHED": cfg.Finished, "COLLECTING": cfg.Abandoned}
+	for state, ttl := range ttls {
+		if ttl <= 0 {
+			continue
+		}
+		expired, err := storage.Expire([]*Room{}, store.Expiry{
+			Field:   "Activity",
+			TTL:     ttl,
+			Filter:  store.Filter{Field: "State", Mask: state},
+			Archive: cfg.Archive,
+		})
+		if err != nil {
+			log.Warnf("sweepRooms: problem while expiring %s rooms: %v", state, err)
+			continue
+		}
+		for _, room := range expired.([]*Room) {
+			log.Debugf("sweepRooms: room %s (%s) has expired", room.ID, state)
+			if !cfg.Archive {
+				dropHistory(room.ID)
+			}
+			// subscribers are holding the cached instance if it exists
+			roomsLock.Lock()
+			removed, ok := rooms[room.ID]
+			delete(rooms, room.ID)
+			roomsLock.Unlock()
+			if !ok {
+				removed = room
+			}
+			removed.event(&RoomEvent{Type: RETRemoved})
+			removed.NotifyOnChange(context.Background())
+		}
+	}
+}
+
+// StartPurgeJob removes players and rooms which were soft deleted more than retention ago every interval
+// until the returned func is called
+func StartPurgeJob(retention time.Duration, interval time.Duration) (stop func()) {
+	if interval <= 0 || retention <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	log.Infof("StartPurgeJob: deleted items are purged every %v after %v", interval, retention)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				purgeDeleted(retention)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func purgeDeleted(retention time.Duration) {
+	storage := getStorage()
+	if storage == nil {
+		return
+	}
+	for _, buffer := range []interface{}{[]*Player{}, []*Room{}} {
+		purged, err := storage.PurgeDeleted(buffer, retention)
+		if err != nil {
+			log.Warnf("purgeDeleted: %v", err)
+			continue
+		}
+		if n := reflect.ValueOf(purged).Len(); n > 0 {
+			log.Debugf("purgeDeleted: %d items of %T were purged", n, buffer)
+		}
+		if rooms, ok := purged.([]*Room); ok {
+			for _, room := range rooms {
+				dropHistory(room.ID)
+			}
+		}
+	}
+}
+
+// dropHistory removes the journal of the room's history when the room is removed for good
+func dropHistory(id string) {
+	if err := getStorage().DropJournal(cHistoryJournal, id); err != nil {
+		log.Warnf("dropHistory: problem while removing history of room %s: %v", id, err)
+	}
+}
@@ -0,0 +1,41 @@
+package resolve
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/vc2402/gomes/store"
+)
+
+func TestSweepRooms(t *testing.T) {
+	setupStorage(t)
+	stale, fresh := newTestRoom(t, "o"), newTestRoom(t, "o")
+	rec, err := roomRepo().Get(stale.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Activity = time.Now().Add(-2 * time.Hour).Unix()
+	if err = roomRepo().Put(stale.ID, rec); err != nil {
+		t.Fatal(err)
+	}
+	events, cancel := roomEvents.subscribe(stale.ID)
+	defer cancel()
+
+	sweepRooms(RoomExpiry{Abandoned: time.Hour, Finished: time.Minute})
+	if ev := <-events; ev.Type != RETRemoved {
+		t.Errorf("removal is published as %+v", ev)
+	}
+	if _, err = roomRepo().Get(stale.ID); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("stale room is read with %v", err)
+	}
+	roomsLock.RLock()
+	_, cached := rooms[stale.ID]
+	roomsLock.RUnlock()
+	if cached {
+		t.Error("stale room is cached")
+	}
+	if _, err = getRoom(session("o"), fresh.ID); err != nil {
+		t.Errorf("fresh room is removed: %v", err)
+	}
+}
@@ -13,6 +13,8 @@ type GameImpl interface {
 	Phase(context.Context) string
 	Actions(context.Context) []string
 	NewMember(context.Context, *RoomMember)
+	// MemberLeft is invoked when the member left the room or was kicked; the member is removed from room's Players already
+	MemberLeft(context.Context, *RoomMember)
 
 	SaveState() interface{}
 	LoadState(interface{}) error
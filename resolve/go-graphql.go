@@ -11,6 +11,7 @@ import (
 	"github.com/kataras/iris"
 
 	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
 )
 
 type GomesScheme struct {
@@ -18,7 +19,6 @@ type GomesScheme struct {
 	subscriptionManager graphqlws.SubscriptionManager
 	WSHandler           http.Handler
 	storage             *store.Store
-	updateChannel       chan string
 }
 
 type Client struct {
@@ -30,10 +30,36 @@ var Schema *GomesScheme
 
 var TokenHMACSecret = []byte("hJlasdf;jk60sadf96GgasfghfgHGfyfgOoSDflkjh^asdf87Gkhgasdfl")
 
+// pageFilter creates store filter from pagination arguments
+func pageFilter(args map[string]interface{}) store.Filter {
+	filter := store.Filter{}
+	if first, ok := args["first"].(int); ok {
+		filter.Limit = first
+	}
+	if after, ok := args["after"].(string); ok {
+		filter.After = after
+	}
+	if sortBy, ok := args["sortBy"].(string); ok {
+		filter.SortBy = sortBy
+	}
+	if desc, ok := args["desc"].(bool); ok {
+		filter.Desc = desc
+	}
+	return filter
+}
+
 func getStorage() *store.Store {
 	return Schema.storage
 }
 
+func playerRepo() *store.Repo[*Player] {
+	return store.NewRepo[*Player](getStorage())
+}
+
+func roomRepo() *store.Repo[*Room] {
+	return store.NewRepo[*Room](getStorage())
+}
+
 func InitGraphQL(stor *store.Store) *GomesScheme {
 	// Schema
 	var gameType = graphql.NewObject(
@@ -124,6 +150,14 @@ func InitGraphQL(stor *store.Store) *GomesScheme {
 						return rm.Index, nil
 					},
 				},
+				"id": &graphql.Field{
+					Type:        graphql.Int,
+					Description: "identifies the member in the room; unlike index it doesn't change when others leave",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						rm := p.Source.(*RoomMember)
+						return rm.ID, nil
+					},
+				},
 			},
 		},
 	)
@@ -289,12 +323,21 @@ func InitGraphQL(stor *store.Store) *GomesScheme {
 					},
 				},
 				"you": &graphql.Field{
-					Type: graphql.Int,
+					Type:              graphql.Int,
+					DeprecationReason: "it is the index of the member which changes when others leave; use youId",
 					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 						room := p.Source.(*Room)
 						return room.You(p.Context), nil
 					},
 				},
+				"youId": &graphql.Field{
+					Type:        graphql.Int,
+					Description: "ID of the member of the asking player in the room; null if the player is not a member",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						room := p.Source.(*Room)
+						return room.YouID(p.Context), nil
+					},
+				},
 				"round": &graphql.Field{
 					Type: graphql.Int,
 					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
@@ -342,20 +385,195 @@ func InitGraphQL(stor *store.Store) *GomesScheme {
 		},
 	)
 
-	var roomUpdateInfoType = graphql.NewObject(
+	var roomEventType = graphql.NewObject(
 		graphql.ObjectConfig{
-			Name: "RoomUpdateInfo",
+			Name: "RoomEvent",
 			Fields: graphql.Fields{
-				"name": &graphql.Field{
+				"seq": &graphql.Field{
+					Type:        graphql.NewNonNull(graphql.Int),
+					Description: "number of the event in the room's sequence",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return int(p.Source.(*RoomEvent).Seq), nil
+					},
+				},
+				"type": &graphql.Field{
+					Type:        graphql.NewNonNull(graphql.String),
+					Description: "PLAYER_JOINED, PLAYER_LEFT, PLAYER_KICKED, STATE_CHANGED, ACTION_PLAYED, HISTORY_APPENDED, CHANGED or REMOVED",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*RoomEvent).Type, nil
+					},
+				},
+				"roomID": &graphql.Field{
+					Type: graphql.ID,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*RoomEvent).RoomID, nil
+					},
+				},
+				"room": &graphql.Field{
+					Type:        roomType,
+					Description: "the room as the subscriber sees it after the event; null if it was removed",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						ev := p.Source.(*RoomEvent)
+						if ev.Type == RETRemoved {
+							return nil, nil
+						}
+						return getRoom(p.Context, ev.RoomID)
+					},
+				},
+				"round": &graphql.Field{
+					Type: graphql.Int,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*RoomEvent).Round, nil
+					},
+				},
+				"state": &graphql.Field{
 					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*RoomEvent).State, nil
+					},
+				},
+				"player": &graphql.Field{
+					Type:        playerType,
+					Description: "the player who joined, left or played",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*RoomEvent).Player, nil
+					},
+				},
+				"name": &graphql.Field{
+					Type:        graphql.String,
+					Description: "the action or the key of the history entry",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*RoomEvent).Name, nil
+					},
 				},
 				"value": &graphql.Field{
+					Type:        graphql.String,
+					Description: "the value of the history entry",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*RoomEvent).Value, nil
+					},
+				},
+			},
+		},
+	)
+
+	var pageInfoType = graphql.NewObject(
+		graphql.ObjectConfig{
+			Name: "PageInfo",
+			Fields: graphql.Fields{
+				"hasNextPage": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.Boolean),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*PageInfo).HasNextPage, nil
+					},
+				},
+				"hasPreviousPage": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.Boolean),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*PageInfo).HasPreviousPage, nil
+					},
+				},
+				"startCursor": &graphql.Field{
 					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*PageInfo).StartCursor, nil
+					},
+				},
+				"endCursor": &graphql.Field{
+					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*PageInfo).EndCursor, nil
+					},
 				},
 			},
 		},
 	)
 
+	// connectionOf creates relay-style connection type for nodes of type node
+	connectionOf := func(node *graphql.Object) *graphql.Object {
+		edgeType := graphql.NewObject(
+			graphql.ObjectConfig{
+				Name: node.Name() + "Edge",
+				Fields: graphql.Fields{
+					"node": &graphql.Field{
+						Type: node,
+						Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+							return p.Source.(*Edge).Node, nil
+						},
+					},
+					"cursor": &graphql.Field{
+						Type: graphql.NewNonNull(graphql.String),
+						Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+							return p.Source.(*Edge).Cursor, nil
+						},
+					},
+				},
+			},
+		)
+		return graphql.NewObject(
+			graphql.ObjectConfig{
+				Name: node.Name() + "Connection",
+				Fields: graphql.Fields{
+					"edges": &graphql.Field{
+						Type: graphql.NewList(edgeType),
+						Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+							return p.Source.(*Connection).Edges, nil
+						},
+					},
+					"pageInfo": &graphql.Field{
+						Type: graphql.NewNonNull(pageInfoType),
+						Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+							return p.Source.(*Connection).PageInfo, nil
+						},
+					},
+				},
+			},
+		)
+	}
+
+	var roomSortFieldType = graphql.NewEnum(
+		graphql.EnumConfig{
+			Name: "RoomSortField",
+			Values: graphql.EnumValueConfigMap{
+				"CREATED":  &graphql.EnumValueConfig{Value: "Created"},
+				"ACTIVITY": &graphql.EnumValueConfig{Value: "Activity"},
+				"NAME":     &graphql.EnumValueConfig{Value: "Name"},
+			},
+		},
+	)
+
+	var playerSortFieldType = graphql.NewEnum(
+		graphql.EnumConfig{
+			Name: "PlayerSortField",
+			Values: graphql.EnumValueConfigMap{
+				"NAME":    &graphql.EnumValueConfig{Value: "Name"},
+				"LOGIN":   &graphql.EnumValueConfig{Value: "Login"},
+				"CREATED": &graphql.EnumValueConfig{Value: "Created"},
+			},
+		},
+	)
+
+	// pageArgs adds pagination arguments to args
+	pageArgs := func(sortBy *graphql.Enum, defaultSort string, defaultDesc bool, args graphql.FieldConfigArgument) graphql.FieldConfigArgument {
+		args["first"] = &graphql.ArgumentConfig{
+			Type:         graphql.Int,
+			DefaultValue: 20,
+		}
+		args["after"] = &graphql.ArgumentConfig{
+			Type:         graphql.String,
+			DefaultValue: "",
+		}
+		args["sortBy"] = &graphql.ArgumentConfig{
+			Type:         sortBy,
+			DefaultValue: defaultSort,
+		}
+		args["desc"] = &graphql.ArgumentConfig{
+			Type:         graphql.Boolean,
+			DefaultValue: defaultDesc,
+		}
+		return args
+	}
+
 	rootQuery := graphql.ObjectConfig{Name: "Query",
 		Fields: graphql.Fields{
 			"me": &graphql.Field{
@@ -363,18 +581,32 @@ func InitGraphQL(stor *store.Store) *GomesScheme {
 				Description: "me request",
 			},
 			"listRooms": &graphql.Field{
-				Type:        graphql.NewList(roomType),
+				Type:        graphql.NewNonNull(connectionOf(roomType)),
 				Description: "List all the rooms you have access",
-				Args: graphql.FieldConfigArgument{
+				Args: pageArgs(roomSortFieldType, "Created", true, graphql.FieldConfigArgument{
 					"all": &graphql.ArgumentConfig{
 						Type:         graphql.Boolean,
 						DefaultValue: false,
 					},
-				},
+					"state": &graphql.ArgumentConfig{
+						Type: graphql.String,
+					},
+					"activeSince": &graphql.ArgumentConfig{
+						Type:        graphql.Int,
+						Description: "unix time of the last activity",
+					},
+				}),
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 					// log.Tracef("resolve: %+v", p)
 					all := p.Args["all"].(bool)
-					return listRooms(p.Context, all)
+					filter := pageFilter(p.Args)
+					if state, ok := p.Args["state"].(string); ok {
+						filter.And = append(filter.And, store.Filter{Field: "State", Mask: state})
+					}
+					if since, ok := p.Args["activeSince"].(int); ok {
+						filter.And = append(filter.And, store.Filter{Field: "Activity", Op: store.FOGe, Value: since})
+					}
+					return listRooms(p.Context, all, filter)
 				},
 			},
 			"getRoom": &graphql.Field{
@@ -392,26 +624,30 @@ func InitGraphQL(stor *store.Store) *GomesScheme {
 				},
 			},
 			"listPlayers": &graphql.Field{
-				Type:        graphql.NewList(playerType),
+				Type:        graphql.NewNonNull(connectionOf(playerType)),
 				Description: "List all the players by login prefix (or all if you are admin)",
-				Args: graphql.FieldConfigArgument{
+				Args: pageArgs(playerSortFieldType, "Name", true, graphql.FieldConfigArgument{
 					"startsWith": &graphql.ArgumentConfig{
 						Type:         graphql.String,
 						DefaultValue: "",
 					},
-				},
+				}),
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 					// log.Tracef("resolve: %+v", p)
 					prefix := p.Args["startsWith"].(string)
-					var filter store.Filter
+					filter := pageFilter(p.Args)
 					if prefix != "" {
 						filter.Field = "Login"
 						filter.Mask = prefix
 						filter.Flags = store.FFSeek
 					} else if !isAdmin(p.Context) {
-						return make([]*Player, 0), nil
+						return newConnection(&store.Page{Items: []*Player{}}), nil
 					}
-					return listPlayers(filter)
+					page, err := listPlayers(filter)
+					if err != nil {
+						return nil, err
+					}
+					return newConnection(page), nil
 				},
 			},
 			"listGames": &graphql.Field{
@@ -498,6 +734,38 @@ func InitGraphQL(stor *store.Store) *GomesScheme {
 					return joinRoom(p.Context, roomID, name)
 				},
 			},
+			"leaveRoom": &graphql.Field{
+				Type:        roomType,
+				Description: "leave the room ",
+				Args: graphql.FieldConfigArgument{
+					"roomID": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.ID),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					roomID := p.Args["roomID"].(string)
+					log.Tracef("leaveRoom: %s", roomID)
+					return leaveRoom(p.Context, roomID)
+				},
+			},
+			"kickPlayer": &graphql.Field{
+				Type:        roomType,
+				Description: "remove the player from the room (owner only) ",
+				Args: graphql.FieldConfigArgument{
+					"roomID": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.ID),
+					},
+					"playerID": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.ID),
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					roomID := p.Args["roomID"].(string)
+					playerID := p.Args["playerID"].(string)
+					log.Tracef("kickPlayer: %s from %s", playerID, roomID)
+					return kickPlayer(p.Context, roomID, playerID)
+				},
+			},
 			"play": &graphql.Field{
 				Type:        actionResultType,
 				Description: "do play in the room ",
@@ -544,16 +812,17 @@ func InitGraphQL(stor *store.Store) *GomesScheme {
 	subscription := graphql.ObjectConfig{Name: "Subscription",
 		Fields: graphql.Fields{
 			"roomUpdates": &graphql.Field{
-				Type:        roomUpdateInfoType,
-				Description: "room updates subscription",
+				Type:        roomEventType,
+				Description: "events of the room",
 				Args: graphql.FieldConfigArgument{
 					"id": &graphql.ArgumentConfig{
-						Type: graphql.ID,
+						Type: graphql.NewNonNull(graphql.ID),
 					},
 				},
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-
-					return map[string]interface{}{"name": "update", "value": "changed"}, nil
+					// subscriptions are executed by sendSubscriptions for every event of the room
+					ev, _ := p.Context.Value(cROOMEVENT).(*RoomEvent)
+					return ev, nil
 				},
 			},
 		},
@@ -614,7 +883,6 @@ func (gs *GomesScheme) Process(ctx iris.Context, cont context.Context) {
 	}
 
 	// cont = context.WithValue(cont, "Schema", gs)
-	cont = context.WithValue(cont, "UpdateChannel", gs.updateChannel)
 	result := graphql.Do(graphql.Params{
 		Schema:         *gs.schema,
 		RequestString:  request.Query,
@@ -637,43 +905,60 @@ func (gs *GomesScheme) Process(ctx iris.Context, cont context.Context) {
 }
 
 func (s *GomesScheme) initSubscription() {
-	s.updateChannel = make(chan string)
 	s.subscriptionManager = graphqlws.NewSubscriptionManager(s.schema)
 	s.WSHandler = graphqlws.NewHandler(graphqlws.HandlerConfig{
 		// Wire up the GraphqL WebSocket handler with the subscription manager
 		SubscriptionManager: s.subscriptionManager,
+		// connections without valid token are rejected
+		Authenticate: authenticateSubscriber,
 	})
+	// subscriptions are served for the whole life of the server
+	events, _ := roomEvents.subscribe("")
 	go func() {
-		for msg := range s.updateChannel {
-			s.sendSubscriptions(msg)
+		for ev := range events {
+			s.sendSubscriptions(ev)
 		}
 	}()
 }
 
-func (s *GomesScheme) sendSubscriptions(string) {
+// sendSubscriptions executes roomUpdates subscriptions of the event's room with the event
+// and the player of the connection in the context, so every subscriber gets own view of the room;
+// subscriptions of players who can't see the room any more are removed (see subscriberGets)
+func (s *GomesScheme) sendSubscriptions(ev *RoomEvent) {
 	subscriptions := s.subscriptionManager.Subscriptions()
+	type ended struct {
+		conn         graphqlws.Connection
+		subscription *graphqlws.Subscription
+	}
+	over := []ended{}
+	defer func() {
+		for _, e := range over {
+			s.subscriptionManager.RemoveSubscription(e.conn, e.subscription)
+		}
+	}()
 
-	for conn, _ := range subscriptions {
-		// Things you have access to here:
-		// conn.ID()   // The connection ID
-		// conn.User() // The user returned from the subscription manager's Authenticate
-
+	for conn := range subscriptions {
+		playerID, ok := conn.User().(string)
+		if !ok || playerID == "" {
+			log.Warnf("sendSubscriptions: connection %s is not authenticated; skipping", conn.ID())
+			continue
+		}
 		for _, subscription := range subscriptions[conn] {
-			// Things you have access to here:
-			// subscription.ID            // The subscription ID (unique per conn)
-			// subscription.OperationName // The name of the subcription
-			// subscription.Query         // The subscription query/queries string
-			// subscription.Variables     // The subscription variables
-			// subscription.Document      // The GraphQL AST for the subscription
-			// subscription.Fields        // The names of top-level queries
-			// subscription.Connection    // The GraphQL WS connection
-
-			// Prepare an execution context for running the query
-			ctx := context.Background()
-
-			// Re-execute the subscription query
+			if subscriptionRoom(subscription) != ev.RoomID {
+				continue
+			}
+			ctx := context.WithValue(context.Background(), cSESSION_ID, playerID)
+			ctx = context.WithValue(ctx, cROOMEVENT, ev)
+			deliver, last := subscriberGets(ctx, ev)
+			if last {
+				over = append(over, ended{conn, subscription})
+			}
+			if !deliver {
+				continue
+			}
+
 			params := graphql.Params{
-				Schema:         *s.schema, // The GraphQL schema
+				Schema:         *s.schema,
 				RequestString:  subscription.Query,
 				VariableValues: subscription.Variables,
 				OperationName:  subscription.OperationName,
@@ -681,14 +966,48 @@ func (s *GomesScheme) sendSubscriptions(string) {
 			}
 			result := graphql.Do(params)
 
-			// Send query results back to the subscriber at any point
 			data := graphqlws.DataMessagePayload{
-				// Data can be anything (interface{})
-				Data: result.Data,
-				// Errors is optional ([]error)
+				Data:   result.Data,
 				Errors: graphqlws.ErrorsFromGraphQLErrors(result.Errors),
 			}
 			subscription.SendData(&data)
 		}
 	}
 }
+
+// subscriptionRoom returns id argument of roomUpdates field of the subscription (given inline or as a variable)
+func subscriptionRoom(subscription *graphqlws.Subscription) string {
+	if subscription.Document == nil {
+		return ""
+	}
+	for _, def := range subscription.Document.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok || op.SelectionSet == nil {
+			continue
+		}
+		if subscription.OperationName != "" && (op.Name == nil || op.Name.Value != subscription.OperationName) {
+			continue
+		}
+		for _, sel := range op.SelectionSet.Selections {
+			field, ok := sel.(*ast.Field)
+			if !ok || field.Name == nil || field.Name.Value != "roomUpdates" {
+				continue
+			}
+			for _, arg := range field.Arguments {
+				if arg.Name == nil || arg.Name.Value != "id" {
+					continue
+				}
+				switch v := arg.Value.(type) {
+				case *ast.StringValue:
+					return v.Value
+				case *ast.Variable:
+					if v.Name != nil {
+						id, _ := subscription.Variables[v.Name.Value].(string)
+						return id
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
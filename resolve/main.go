@@ -1,5 +1,11 @@
 package resolve
 
+import (
+	"reflect"
+
+	"github.com/vc2402/gomes/store"
+)
+
 // "context"
 
 // "github.com/vc2402/utils"
@@ -114,6 +120,58 @@ type ActionResult struct {
 // 	return roomUpdates(ctx, string(args.RoomID))
 // }
 
+// Connection is relay-style page of list query result
+type Connection struct {
+	Edges    []*Edge
+	PageInfo *PageInfo
+}
+
+type Edge struct {
+	Node   interface{}
+	Cursor string
+}
+
+type PageInfo struct {
+	HasNextPage     bool
+	HasPreviousPage bool
+	StartCursor     string
+	EndCursor       string
+}
+
+// ConflictError is returned to the client when the object was changed concurrently; the request may be retried
+type ConflictError struct {
+	error
+}
+
+// Extensions implements gqlerrors.ExtendedError
+func (e *ConflictError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": "CONFLICT", "retriable": true}
+}
+
+// storeError converts store errors to the errors client should get
+func storeError(err error) error {
+	if err == store.ErrConflict {
+		return &ConflictError{err}
+	}
+	return err
+}
+
+func newConnection(page *store.Page) *Connection {
+	items := reflect.ValueOf(page.Items)
+	conn := &Connection{
+		Edges:    make([]*Edge, items.Len()),
+		PageInfo: &PageInfo{HasNextPage: page.HasNext, HasPreviousPage: page.HasPrev},
+	}
+	for i := 0; i < items.Len(); i++ {
+		conn.Edges[i] = &Edge{Node: items.Index(i).Interface(), Cursor: page.Cursors[i]}
+	}
+	if len(page.Cursors) > 0 {
+		conn.PageInfo.StartCursor = page.Cursors[0]
+		conn.PageInfo.EndCursor = page.Cursors[len(page.Cursors)-1]
+	}
+	return conn
+}
+
 func (p *KVPair) Name() string          { return p.Key }
 func (p *KVPair) Value() string         { return p.Val }
 func (r *ActionResult) Status() *string { return &r.ActionStatus }
@@ -2,8 +2,6 @@ package resolve
 
 import (
 	"errors"
-	"sort"
-	"strings"
 	"sync"
 	"time"
 
@@ -17,14 +15,16 @@ import (
 
 type Player struct {
 	ID       string   `json:"id,omitempty"`
-	Name     string   `json:"name,omitempty"`
-	Login    string   `json:"login,omitempty" store:"index,unique,ci"`
-	Email    string `json:"email,omitempty"`
+	Name     string   `json:"name,omitempty" store:"fulltext"`
+	Login    string   `json:"login,omitempty" store:"index,unique,ci,fulltext"`
+	Email    string `json:"email,omitempty" store:"ci,encrypted"`
 	Avatar   string `json:"avatar,omitempty"`
-	Password string   `json:"-"`
-	Created  int64    `json:"created,omitempty"`
+	Password string   `json:"-" store:"encrypted"`
+	Created  int64    `json:"created,omitempty" store:"index"`
 	Activity int64    `json:"modified,omitempty"`
 	Roles    []string `json:"roles,omitempty"`
+	Version  int64    `json:"version,omitempty" store:"version"`
+	Deleted  int64    `json:"deleted,omitempty" store:"deleted"`
 }
 
 var players = make(map[string]*Player)
@@ -34,36 +34,24 @@ var playersMux sync.RWMutex
 // func (r *Player) Name() string   { return r.name }
 
 func FindPlayer(login string) *Player {
-	users := make([]*Player, 0)
-	storage := getStorage()
-	arr, err := storage.ListRecords(store.Filter{Field: "Login", Mask: login}, users)
-	var ok bool
-	if err == nil {
-		users, ok = arr.([]*Player)
-		if ok {
-			for _, usr := range users {
-				if usr.Login == login {
-					return usr
-				}
-			}
+	users, err := playerRepo().Find(store.Filter{Field: "Login", Mask: login})
+	if err != nil {
+		log.Warnf("FindPlayer: %v", err)
+		return nil
+	}
+	for _, usr := range users {
+		if usr.Login == login {
+			return usr
 		}
 	}
 	return nil
 }
 
 func (p *Player) save() error {
-	store := getStorage()
-	if store != nil {
-		create := p.Activity == 0
+	if getStorage() != nil {
 		p.Activity = time.Now().Unix()
-		if create {
-			log.Tracef("player: going to create new record in db %s", p.ID)
-			return store.CreateRecord(p.ID, p)
-		} else {
-			log.Tracef("player: going to update record in db %s", p.ID)
-			return store.UpdateRecord(p.ID, p)
-		}
-
+		log.Tracef("player: going to save record in db %s", p.ID)
+		return playerRepo().Put(p.ID, p)
 	} else {
 		log.Tracef("store not found. skipping saving player")
 		return nil
@@ -89,6 +77,13 @@ func newPlayer(name string, id string, login string) (*Player, error) {
 	return p, err
 }
 
+// forgetPlayer removes the player from the cache so it will be reloaded from the store next time
+func forgetPlayer(id string) {
+	playersMux.Lock()
+	defer playersMux.Unlock()
+	delete(players, id)
+}
+
 func GetPlayer(id string) *Player {
 	log.Tracef("getPlayer: %s", id)
 	playersMux.RLock()
@@ -98,15 +93,12 @@ func GetPlayer(id string) *Player {
 		p.Activity = time.Now().Unix()
 	} else {
 		log.Tracef("getPlayer: %s; looking in store", id)
-		store := getStorage()
-		if store != nil {
-			p = &Player{}
-			store.GetRecord(id, p)
-			if p.ID == id {
+		if getStorage() != nil {
+			var err error
+			if p, err = playerRepo().Get(id); err == nil {
 				players[id] = p
-				ok = true
-			} else {
-				p = nil
+			} else if !errors.Is(err, store.ErrNotFound) {
+				log.Warnf("getPlayer: %v", err)
 			}
 		}
 	}
@@ -139,47 +131,19 @@ func deletePlayer(id string) (*Player, error) {
 	playersMux.Lock()
 	defer playersMux.Unlock()
 	delete(players, id)
-	store := getStorage()
-	return pl, store.DeleteRecord("Player", id)
+	return pl, playerRepo().SoftDelete(id)
 }
 
-type PlayersSorter struct {
-	players []*Player
-	sortBy  string
-	desc    bool
+// restorePlayer restores soft deleted player
+func restorePlayer(id string) error {
+	log.Tracef("restorePlayer: restoring the player %s", id)
+	return playerRepo().Restore(id)
 }
 
-// RoomsSorter
-func (rs PlayersSorter) Len() int      { return len(rs.players) }
-func (rs PlayersSorter) Swap(i, j int) { rs.players[i], rs.players[j] = rs.players[j], rs.players[i] }
-func (rs PlayersSorter) Less(i, j int) bool {
-	var ret bool = false
-	switch rs.sortBy {
-	case "Name":
-		ret = strings.Compare(rs.players[i].Name, rs.players[j].Name) == -1
-	case "Login":
-		ret = strings.Compare(rs.players[i].Login, rs.players[j].Login) == -1
-	default:
-		ret = (rs.players[i].Created < rs.players[j].Created)
-	}
-	if rs.desc {
-		ret = !ret
-	}
-	return ret
-}
-
-func listPlayers(filter store.Filter) ([]*Player, error) {
-	ret := make([]*Player, 0)
-	storage := getStorage()
-	arr, err := storage.ListRecords(filter, ret)
-	var ok bool
-	if err == nil {
-		ret, ok = arr.([]*Player)
-		if !ok {
-			log.Warnf("listPlayers: invalid return type: %+v", arr)
-		}
-		sorter := PlayersSorter{ret, "Name", true}
-		sort.Sort(sorter)
+func listPlayers(filter store.Filter) (*store.Page, error) {
+	_, page, err := playerRepo().FindPage(filter)
+	if err != nil {
+		log.Warnf("listPlayers: %v", err)
 	}
-	return ret, err
+	return page, err
 }
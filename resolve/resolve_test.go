@@ -0,0 +1,75 @@
+package resolve
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vc2402/gomes/store"
+)
+
+// testGame is the game recording members who left
+type testGame struct {
+	room *Room
+	left []int32
+}
+
+func (g *testGame) Game() *Game { return testGameObj }
+func (g *testGame) Play(context.Context, *Action) *ActionResult {
+	return &ActionResult{ActionStatus: "ok"}
+}
+func (g *testGame) Params(context.Context) []*KVPair       { return nil }
+func (g *testGame) Phase(context.Context) string           { return "" }
+func (g *testGame) Actions(context.Context) []string       { return nil }
+func (g *testGame) NewMember(context.Context, *RoomMember) {}
+func (g *testGame) MemberLeft(ctx context.Context, rm *RoomMember) {
+	g.left = append(g.left, rm.ID)
+}
+func (g *testGame) SaveState() interface{}      { return nil }
+func (g *testGame) LoadState(interface{}) error { return nil }
+
+var testGameObj = AddGame("test", "Test", func(r *Room) GameImpl { return &testGame{room: r} })
+
+// setupStorage makes the package work with the new in-memory store and empty caches
+func setupStorage(t *testing.T) *store.Store {
+	s, err := store.Open("memory", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Schema = &GomesScheme{storage: s}
+	roomsLock.Lock()
+	rooms = map[string]*Room{}
+	roomsLock.Unlock()
+	playersMux.Lock()
+	players = map[string]*Player{}
+	playersMux.Unlock()
+	roomEvents = newRoomBus()
+	t.Cleanup(func() {
+		s.Stop()
+		Schema = nil
+	})
+	return s
+}
+
+// session returns the context of requests of the player
+func session(playerID string) context.Context {
+	return context.WithValue(context.Background(), cSESSION_ID, playerID)
+}
+
+// newTestRoom creates the room owned by player owner with members joined in the order of ids
+func newTestRoom(t *testing.T, owner string, members ...string) *Room {
+	for _, id := range append([]string{owner}, members...) {
+		if _, err := newPlayer("name-"+id, id, "login-"+id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	room, err := newRoom(session(owner), "test", "room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range members {
+		if _, err := joinRoom(session(id), room.ID, "name-"+id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return room
+}
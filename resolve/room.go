@@ -3,7 +3,6 @@ package resolve
 import (
 	"context"
 	"errors"
-	"sort"
 	"sync"
 	"time"
 
@@ -12,105 +11,216 @@ import (
 	"github.com/vc2402/utils"
 
 	log "github.com/cihub/seelog"
-	graphql "github.com/graph-gophers/graphql-go"
 )
 
 const (
 	CROOMMEMBER = "RoomMember"
+	// cHistoryJournal is the store journal rooms' history is kept in by rounds
+	cHistoryJournal = "RoomHistory"
 )
 
 type Room struct {
-	ID       string           `json:"id,omitempty" store:"id"`
-	Game     *Game            `json:"game,omitempty" store:"helper"`
-	impl     GameImpl         `store:"ignore"`
-	Name     string           `json:"name,omitempty"`
-	State    string           `json:"state,omitempty"`
-	Players  []*RoomMember    `json:"players,omitempty"`
-	Owner    *Player          `json:"owner,omitempty" store:"helper,index"`
-	Created  int64            `json:"created,omitempty"`
-	Activity int64            `json:"activity,omitempty"`
-	Round    int32            `json:"round,omitempty"`
-	History  [][]*KVPair      `json:"history,omitempty" store:"ignore"`
-	mux      sync.Mutex       `store:"ignore"`
-	channel  chan interface{} `store:"ignore"`
+	ID       string        `json:"id,omitempty" store:"id"`
+	Game     *Game         `json:"game,omitempty" store:"helper"`
+	impl     GameImpl      `store:"ignore"`
+	Name     string        `json:"name,omitempty" store:"fulltext"`
+	State    string        `json:"state,omitempty" store:"index"`
+	Players  []*RoomMember `json:"players,omitempty"`
+	Owner    *Player       `json:"owner,omitempty" store:"helper,index"`
+	Created  int64         `json:"created,omitempty" store:"index"`
+	Activity int64         `json:"activity,omitempty" store:"index"`
+	Round    int32         `json:"round,omitempty"`
+	NextID   int32         `json:"nextId,omitempty"`
+	Version  int64         `json:"version,omitempty" store:"version"`
+	Deleted  int64         `json:"deleted,omitempty" store:"deleted"`
+	History  [][]*KVPair   `json:"history,omitempty" store:"ignore"`
+	mux      sync.Mutex    `store:"ignore"`
+	histMux  sync.Mutex    `store:"ignore"`
+	pending  []*RoomEvent  `store:"ignore"`
+	evMux    sync.Mutex    `store:"ignore"`
+	// unsaved are history entries to be journaled with the next Save
+	unsaved []historyEntry `store:"ignore"`
+}
+
+// historyEntry is the entry of the history of the round
+type historyEntry struct {
+	round int32
+	entry *KVPair
 }
 
 type RoomMember struct {
 	// RoomID string  `json:"room_id,omitempty" bson:"room_id"`
+	// ID identifies the member in the room (it is taken from room's NextID and never reused), so games should
+	// keep it instead of Index which is the position in room's Players and changes when preceding members leave
+	ID     int32
 	Index  int32
 	Player *Player `store:"helper,index"`
 	Status string
 }
 
-type RoomUpdate struct {
-	event *RoomEvent
-}
-
-type RoomEvent struct {
-	name  string
-	value string
-}
-
-type RoomsSorter struct {
-	rooms  []*Room
-	sortBy string
-	desc   bool
-}
-
 var rooms map[string]*Room = make(map[string]*Room)
 var roomsLock sync.RWMutex
 
+// fixMemberIDs gives members of rooms stored before they had IDs their indexes as IDs,
+// so members' indexes kept in games' states are valid IDs
+func (r *Room) fixMemberIDs() {
+	if r.NextID != 0 || len(r.Players) == 0 {
+		return
+	}
+	for _, p := range r.Players {
+		p.ID = p.Index
+	}
+	r.NextID = int32(len(r.Players))
+}
+
 // func (r *Room) ID() graphql.ID                       { return r.id }
 // func (r *Room) Game() *Game                          { return r.game }
 // func (r *Room) Name() string                         { return r.name }
 // func (r *Room) State() string                        { return r.state }
 // func (r *Room) Round() int32                         { return r.round }
 // func (r *Room) Players() []*RoomMember               { return r.players }
-func (r *Room) SetState(c context.Context, s string) { r.State = s; r.NotifyOnChange(c) }
-func (r *Room) Phase(c context.Context) string       { return r.impl.Phase(r.fillMember(c)) }
-func (r *Room) Params(c context.Context) []*KVPair   { return r.impl.Params(r.fillMember(c)) }
-func (r *Room) Actions(c context.Context) []string   { return r.impl.Actions(r.fillMember(c)) }
+func (r *Room) SetState(c context.Context, s string) {
+	r.State = s
+	r.event(&RoomEvent{Type: RETStateChanged})
+	r.NotifyOnChange(c)
+}
+func (r *Room) Phase(c context.Context) string     { return r.impl.Phase(r.fillMember(c)) }
+func (r *Room) Params(c context.Context) []*KVPair { return r.impl.Params(r.fillMember(c)) }
+func (r *Room) Actions(c context.Context) []string { return r.impl.Actions(r.fillMember(c)) }
+
+// You returns the index of the member of the session's player; it changes when preceding members leave (see YouID)
 func (r *Room) You(ctx context.Context) *int32 {
-	id := ctx.Value(cSESSION_ID).(string)
+	if m := r.you(ctx); m != nil {
+		return &m.Index
+	}
+	return nil
+}
+
+// YouID returns the ID of the member of the session's player or nil if the player is not a member
+func (r *Room) YouID(ctx context.Context) *int32 {
+	if m := r.you(ctx); m != nil {
+		return &m.ID
+	}
+	return nil
+}
+
+// you returns the member of the session's player
+func (r *Room) you(ctx context.Context) *RoomMember {
+	id, _ := ctx.Value(cSESSION_ID).(string)
 	// log.Tracef("You: looking player with id %s", id)
 	if id != "" {
 		for _, p := range r.Players {
-			if string(p.Player.ID) == id {
-				return &p.Index
+			if p.Player != nil && string(p.Player.ID) == id {
+				return p
 			}
 		}
 	}
 	return nil
 }
+
+// Member returns the member of the room with the ID or nil if there is no such member (e.g. the member left)
+func (r *Room) Member(id int32) *RoomMember {
+	for _, p := range r.Players {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// visibleTo checks if the player of the session is a member or the owner of the room (or admin);
+// it locks the room as members are changed under room.mux
+func (r *Room) visibleTo(ctx context.Context) bool {
+	playerID, _ := ctx.Value(cSESSION_ID).(string)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.Owner != nil && r.Owner.ID == playerID {
+		return true
+	}
+	for _, m := range r.Players {
+		if m.Player != nil && m.Player.ID == playerID {
+			return true
+		}
+	}
+	return isAdmin(ctx)
+}
+
+// event queues ev to be published with the next NotifyOnChange
+func (r *Room) event(ev *RoomEvent) {
+	ev.RoomID, ev.Round, ev.State = r.ID, r.Round, r.State
+	r.evMux.Lock()
+	defer r.evMux.Unlock()
+	r.pending = append(r.pending, ev)
+}
+
+// NotifyOnChange publishes events queued since the previous call to subscribers of the room;
+// RETChanged event is published if there are no such events
 func (r *Room) NotifyOnChange(ctx context.Context) {
-	ch := ctx.Value("UpdateChannel")
-	if ch == nil {
-		log.Warnf("NotifyOnChange: UpdateChannel not found")
-	} else {
-		go func() {
-			// msg := map[string]interface{}{"data": map[string]interface{}{"roomUpdates": "changed"}}
-			msg := "changed"
-			log.Tracef("NotifyOnChange: going to send message: %+v,", msg)
-			ch.(chan string) <- msg
-		}()
+	r.evMux.Lock()
+	pending := r.pending
+	r.pending = nil
+	r.evMux.Unlock()
+	if len(pending) == 0 {
+		pending = []*RoomEvent{{Type: RETChanged, RoomID: r.ID, Round: r.Round, State: r.State}}
+	}
+	for _, ev := range pending {
+		roomEvents.publish(ev)
 	}
 }
 func (r *Room) NextRound() {
 	r.Round++
-	r.History = append(r.History, []*KVPair{})
+	r.histMux.Lock()
+	defer r.histMux.Unlock()
+	for int32(len(r.History)) <= r.Round {
+		r.History = append(r.History, nil)
+	}
+	r.History[r.Round] = []*KVPair{}
 }
+
+// AddHistory appends h to the history of the current round; it is appended to the room's journal in the store
+// by the next Save together with the room, so the journal doesn't get entries of changes which were not saved
 func (r *Room) AddHistory(h *KVPair) {
 	log.Tracef("AddHistory: %s: %s", h.Key, h.Val)
-	r.History[r.Round] = append(r.History[r.Round], h)
+	r.histMux.Lock()
+	defer r.histMux.Unlock()
+	hist := r.roundHistory(r.Round)
+	r.History[r.Round] = append(hist, h)
+	r.unsaved = append(r.unsaved, historyEntry{round: r.Round, entry: h})
+	r.event(&RoomEvent{Type: RETHistoryAppended, Name: h.Key, Value: h.Val})
 }
 func (r *Room) getHistory(round int32) []*KVPair {
 	log.Tracef("getHistory: for round: %d; current round is %d", round, r.Round)
-	if r.Round < round {
+	if r.Round < round || round < 0 {
 		return nil
 	} else {
-		log.Tracef("getHistory: returning %d values (%v)", len(r.History[round]), r.History[round])
+		r.histMux.Lock()
+		defer r.histMux.Unlock()
+		hist := r.roundHistory(round)
+		log.Tracef("getHistory: returning %d values (%v)", len(hist), hist)
+		return hist
+	}
+}
+
+// roundHistory returns the history of the round loading it from the store's journal if it was not loaded yet
+// (History caches loaded rounds); should be called under histMux
+func (r *Room) roundHistory(round int32) []*KVPair {
+	for int32(len(r.History)) <= round {
+		r.History = append(r.History, nil)
+	}
+	if r.History[round] != nil {
 		return r.History[round]
 	}
+	if s := getStorage(); s != nil {
+		entries, err := s.ReadEntries(cHistoryJournal, r.ID, int(round), []*KVPair{})
+		if err != nil {
+			log.Warnf("roundHistory: problem while loading history of room %s: %v", r.ID, err)
+			return []*KVPair{}
+		}
+		r.History[round] = entries.([]*KVPair)
+	} else {
+		r.History[round] = []*KVPair{}
+	}
+	return r.History[round]
 }
 
 // store.Helper interface
@@ -162,23 +272,62 @@ func (r *Room) SetValue(attr string, from interface{}) error {
 	}
 }
 
-func (room *Room) Save(ctx context.Context) {
-	store := getStorage()
-	if store != nil {
-		create := room.Activity == 0
+// Save stores the room and appends its new history entries to the journal within one transaction;
+// returns store.ErrConflict if the room was changed by someone else since it was loaded;
+// the room shared by requests should be locked with room.mux while it is changed and saved
+func (room *Room) Save(ctx context.Context) error {
+	if s := getStorage(); s != nil {
 		room.Activity = time.Now().Unix()
-		if create {
-			log.Tracef("room: going to create new record in db %s", room.ID)
-			store.CreateRecord(room.ID, room)
-		} else {
-			log.Tracef("room: going to update record in db %s", room.ID)
-			store.UpdateRecord(room.ID, room)
+		log.Tracef("room: going to save record in db %s", room.ID)
+		// the store sets the version of the saved record, so it gets the copy and the room takes the version only on success
+		rec := room.record()
+		room.histMux.Lock()
+		unsaved := room.unsaved
+		room.histMux.Unlock()
+		err := s.Update(func(tx store.Tx) error {
+			if err := roomRepo().WithTx(tx).Put(room.ID, rec); err != nil {
+				return err
+			}
+			for _, h := range unsaved {
+				if err := tx.AppendEntry(cHistoryJournal, room.ID, int(h.round), h.entry); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Warnf("room: problem while saving %s: %v", room.ID, err)
+			return err
 		}
+		room.histMux.Lock()
+		room.unsaved = room.unsaved[len(unsaved):]
+		room.histMux.Unlock()
+		room.Version = rec.Version
 		log.Tracef("room: record was saved successfully. Exiting (%s)", room.ID)
 
 	} else {
 		log.Tracef("store not found. skipping saving")
 	}
+	return nil
+}
+
+// record returns the copy of the stored fields of the room (and of the game which saves its state with them)
+func (room *Room) record() *Room {
+	return &Room{
+		ID:       room.ID,
+		Game:     room.Game,
+		impl:     room.impl,
+		Name:     room.Name,
+		State:    room.State,
+		Players:  append([]*RoomMember{}, room.Players...),
+		Owner:    room.Owner,
+		Created:  room.Created,
+		Activity: room.Activity,
+		Round:    room.Round,
+		NextID:   room.NextID,
+		Version:  room.Version,
+		Deleted:  room.Deleted,
+	}
 }
 
 // func (rm *RoomMember) Player() *Player     { return rm.player }
@@ -214,27 +363,6 @@ func (r *RoomMember) SetValue(attr string, from interface{}) error {
 	return errors.New("Invalid RoomMember store format")
 }
 
-func (ru *RoomUpdate) Event() *RoomEvent { return ru.event }
-
-func (re *RoomEvent) Name() string    { return re.name }
-func (re *RoomEvent) Value() string   { return re.value }
-func (re *RoomEvent) ID() *graphql.ID { return (*graphql.ID)(&re.value) }
-
-// RoomsSorter
-func (rs RoomsSorter) Len() int      { return len(rs.rooms) }
-func (rs RoomsSorter) Swap(i, j int) { rs.rooms[i], rs.rooms[j] = rs.rooms[j], rs.rooms[i] }
-func (rs RoomsSorter) Less(i, j int) bool {
-	var ret bool = false
-	switch rs.sortBy {
-	default:
-		ret = (rs.rooms[i].Created < rs.rooms[j].Created)
-	}
-	if rs.desc {
-		ret = !ret
-	}
-	return ret
-}
-
 func newRoom(ctx context.Context, gameID string, name string) (*Room, error) {
 	var id string
 	roomsLock.Lock()
@@ -260,49 +388,76 @@ func newRoom(ctx context.Context, gameID string, name string) (*Room, error) {
 		Owner:   GetPlayer(ctx.Value(cSESSION_ID).(string)),
 		History: make([][]*KVPair, 1),
 		Round:   0,
-		Created: time.Now().Unix(),
-		channel: make(chan interface{})}
+		Created: time.Now().Unix()}
 	room.impl = game.implGenerator(room)
 	room.History[0] = []*KVPair{}
 	rooms[id] = room
 	log.Tracef("context.store: %v", ctx.Value("store"))
-	room.Save(ctx)
+	if err := room.Save(ctx); err != nil {
+		delete(rooms, id)
+		return nil, storeError(err)
+	}
 	log.Debugf("newRoom: returning room %s", id)
 	return room, nil
 }
 
 func getRoom(ctx context.Context, id string) (*Room, error) {
 	roomsLock.RLock()
-	defer roomsLock.RUnlock()
 	room, ok := rooms[id]
+	roomsLock.RUnlock()
 	err := errors.New("room does not exist")
-	if !ok {
-		// store := ctx.Value("store").(*store.DB)
-		// if store != nil {
-		// 	ok, err = store.GetRecord("room", id, &room)
-		// 	if ok {
-		// 		rooms[id] = room
-		// 	}
-		// }
-		store := getStorage()
-		if store != nil {
-			room = &Room{}
-			store.GetRecord(id, room)
-			if room.ID == id {
+	if !ok && getStorage() != nil {
+		var e error
+		if room, e = roomRepo().Get(id); e == nil {
+			room.fixMemberIDs()
+			roomsLock.Lock()
+			// the room may be loaded concurrently; the first loaded one is kept
+			if loaded, found := rooms[id]; found {
+				room = loaded
+			} else {
 				rooms[id] = room
-				ok = true
 			}
+			roomsLock.Unlock()
+			ok = true
+		} else if !errors.Is(e, store.ErrNotFound) {
+			log.Warnf("getRoom: %v", e)
 		}
 	}
 	if ok {
-		log.Tracef("getRoom: returning room: %v", *room)
-		room.Activity = time.Now().Unix()
+		log.Tracef("getRoom: returning room: %s", room.ID)
+		// the activity is saved without roomsLock held, so other rooms are not blocked by the store
+		room.touch(ctx)
 		return room, nil
 	}
 	log.Warnf("getRoom: room does not exist: %s", id)
 	return nil, err
 }
 
+// cActivitySaveInterval is how often the activity of the room which is only read is saved so the sweeper sees it
+const cActivitySaveInterval = time.Minute
+
+// touch saves the activity of the room if it was saved more than cActivitySaveInterval ago;
+// the room which is busy is skipped as it is saved by the operation holding it
+func (room *Room) touch(ctx context.Context) {
+	if !room.mux.TryLock() {
+		return
+	}
+	defer room.mux.Unlock()
+	if time.Since(time.Unix(room.Activity, 0)) < cActivitySaveInterval {
+		return
+	}
+	if err := room.Save(ctx); err != nil {
+		log.Debugf("touch: activity of room %s is not saved: %v", room.ID, err)
+	}
+}
+
+// forgetRoom removes the room from the cache so it will be reloaded from the store next time
+func forgetRoom(id string) {
+	roomsLock.Lock()
+	defer roomsLock.Unlock()
+	delete(rooms, id)
+}
+
 func joinRoom(ctx context.Context, roomID string, playerName string) (*RoomMember, error) {
 	log.Tracef("joinRoom: %s joining %s", playerName, roomID)
 	room, err := getRoom(ctx, roomID)
@@ -335,34 +490,89 @@ func joinRoom(ctx context.Context, roomID string, playerName string) (*RoomMembe
 		if pl == nil {
 			return nil, errors.New("not logged in")
 		}
-		rm = &RoomMember{Player: pl, Index: int32(len(room.Players))}
+		rm = &RoomMember{ID: room.NextID, Player: pl, Index: int32(len(room.Players))}
+		room.NextID++
 		room.impl.NewMember(ctx, rm)
 		room.Players = append(room.Players, rm)
-		room.Save(ctx)
+		if err := room.Save(ctx); err != nil {
+			forgetRoom(roomID)
+			return nil, storeError(err)
+		}
+		room.event(&RoomEvent{Type: RETPlayerJoined, Player: pl})
+		room.NotifyOnChange(ctx)
 	}
-
-	room.NotifyOnChange(ctx)
 	return rm, nil
 }
 
-func listRooms(ctx context.Context, all bool) ([]*Room, error) {
-	ret := make([]*Room, 0, len(rooms))
-	storage := getStorage()
-	filter := store.Filter{Field: "Owner", Mask: ctx.Value(cSESSION_ID).(string)}
-	if all && isAdmin(ctx) {
-		filter = store.Filter{}
+// leaveRoom removes the player of the session from the members of the room
+func leaveRoom(ctx context.Context, roomID string) (*Room, error) {
+	log.Tracef("leaveRoom: leaving %s", roomID)
+	room, err := getRoom(ctx, roomID)
+	if err != nil {
+		return nil, err
 	}
-	arr, err := storage.ListRecords(filter, ret)
-	var ok bool
-	if err == nil {
-		ret, ok = arr.([]*Room)
-		if !ok {
-			log.Warnf("listRooms: invalid return type: %+v", arr)
+	playerID := ctx.Value(cSESSION_ID).(string)
+	if playerID == "" {
+		return nil, errors.New("session is undefined")
+	}
+	return room, room.removeMember(ctx, playerID, RETPlayerLeft)
+}
+
+// kickPlayer removes the player from the members of the room; only the owner of the room (or admin) can do it
+func kickPlayer(ctx context.Context, roomID string, playerID string) (*Room, error) {
+	log.Tracef("kickPlayer: kicking %s from %s", playerID, roomID)
+	room, err := getRoom(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if room.Owner == nil || room.Owner.ID != ctx.Value(cSESSION_ID).(string) {
+		if !isAdmin(ctx) {
+			return nil, errors.New("only the owner can kick players")
 		}
-		sorter := RoomsSorter{ret, "Created", true}
-		sort.Sort(sorter)
 	}
-	return ret, err
+	return room, room.removeMember(ctx, playerID, RETPlayerKicked)
+}
+
+// removeMember removes the member with the player from the room, renumbers indexes of remaining members
+// and lets the game know about it; evType is the type of the event published
+func (room *Room) removeMember(ctx context.Context, playerID string, evType string) error {
+	room.mux.Lock()
+	defer room.mux.Unlock()
+	pos := -1
+	for i, p := range room.Players {
+		if p.Player != nil && p.Player.ID == playerID {
+			pos = i
+			break
+		}
+	}
+	if pos == -1 {
+		return errors.New("player is not a member of the room")
+	}
+	rm := room.Players[pos]
+	room.Players = append(room.Players[:pos:pos], room.Players[pos+1:]...)
+	for i, p := range room.Players {
+		p.Index = int32(i)
+	}
+	room.impl.MemberLeft(ctx, rm)
+	if err := room.Save(ctx); err != nil {
+		forgetRoom(room.ID)
+		return storeError(err)
+	}
+	room.event(&RoomEvent{Type: evType, Player: rm.Player})
+	room.NotifyOnChange(ctx)
+	return nil
+}
+
+func listRooms(ctx context.Context, all bool, filter store.Filter) (*Connection, error) {
+	if !all || !isAdmin(ctx) {
+		filter.And = append(filter.And, store.Filter{Field: "Owner", Mask: ctx.Value(cSESSION_ID).(string)})
+	}
+	_, page, err := roomRepo().FindPage(filter)
+	if err != nil {
+		log.Warnf("listRooms: %v", err)
+		return nil, err
+	}
+	return newConnection(page), nil
 }
 
 func deleteRoom(ctx context.Context, id string) (*Room, error) {
@@ -374,8 +584,18 @@ func deleteRoom(ctx context.Context, id string) (*Room, error) {
 	roomsLock.Lock()
 	defer roomsLock.Unlock()
 	delete(rooms, id)
-	store := getStorage()
-	return room, store.DeleteRecord("Room", id)
+	if err = roomRepo().SoftDelete(id); err != nil {
+		return room, err
+	}
+	room.event(&RoomEvent{Type: RETRemoved})
+	room.NotifyOnChange(ctx)
+	return room, nil
+}
+
+// restoreRoom restores soft deleted room
+func restoreRoom(id string) error {
+	log.Tracef("restoreRoom: restoring the room %s", id)
+	return roomRepo().Restore(id)
 }
 
 func play(ctx context.Context, id string, act *Action) (*ActionResult, error) {
@@ -384,8 +604,15 @@ func play(ctx context.Context, id string, act *Action) (*ActionResult, error) {
 	if err != nil {
 		return nil, err
 	}
+	room.mux.Lock()
+	defer room.mux.Unlock()
 	res := room.impl.Play(room.fillMember(ctx), act)
-	room.Save(ctx)
+	if err = room.Save(ctx); err != nil {
+		forgetRoom(id)
+		return nil, storeError(err)
+	}
+	room.event(&RoomEvent{Type: RETActionPlayed, Player: resolvePlayer(ctx), Name: act.Name})
+	room.NotifyOnChange(ctx)
 	log.Tracef("play: for room %s: returning: %+v", id, *res)
 	return res, nil
 }
@@ -406,52 +633,6 @@ func history(ctx context.Context, id string, round *int32) []*KVPair {
 	return []*KVPair{}
 }
 
-func roomUpdates(ctx context.Context, id string) (chan *RoomUpdate, error) {
-	log.Tracef("roomUpdates: %s", id)
-	// room, err := getRoom(id)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	c := make(chan *RoomUpdate)
-	log.Tracef("roomUpdates: starting the gorouting")
-	go func() {
-		for {
-			log.Tracef("roomUpdates: gorouting: next loop")
-			select {
-			case <-ctx.Done():
-				close(c)
-				log.Tracef("roomUpdates: closing")
-				return
-			case <-time.After(1 * time.Second):
-			}
-			log.Tracef("roomUpdates: gorouting: sending test update")
-			c <- &RoomUpdate{&RoomEvent{name: "test", value: "test"}}
-		}
-		log.Tracef("roomUpdates: gorouting: exit")
-	}()
-	log.Tracef("roomUpdates: exiting")
-	log.Flush()
-	return c, nil
-}
-
-func setUpdatesClient(ctx context.Context, id string, ch chan interface{}) {
-	room, err := getRoom(ctx, id)
-	if err == nil {
-		log.Tracef("setUpdatesClient: setting channel for room %s", id)
-		room.channel = ch
-	}
-	go func() {
-		for {
-			log.Tracef("roomUpdates: gorouting: next loop")
-			select {
-			case <-time.After(1 * time.Second):
-			}
-			log.Tracef("roomUpdates: gorouting: sending test update")
-			room.NotifyOnChange(ctx)
-		}
-		log.Tracef("roomUpdates: gorouting: exit")
-	}()
-}
 func (r *Room) fillMember(ctx context.Context) context.Context {
 	log.Tracef("fillMemeber: looking for member")
 	if s := ctx.Value(cSESSION_ID); s != nil {
@@ -0,0 +1,121 @@
+package resolve
+
+import (
+	"testing"
+)
+
+// memberIDs returns IDs and indexes of the room's members
+func memberIDs(room *Room) (ids []int32, indexes []int32) {
+	for _, m := range room.Players {
+		ids = append(ids, m.ID)
+		indexes = append(indexes, m.Index)
+	}
+	return
+}
+
+func TestLeaveAndKick(t *testing.T) {
+	setupStorage(t)
+	// the owner is not a member, so a, b and c get IDs 0, 1 and 2
+	room := newTestRoom(t, "o", "a", "b", "c")
+	events, cancel := roomEvents.subscribe(room.ID)
+	defer cancel()
+	if id, idx := room.YouID(session("b")), room.You(session("b")); id == nil || *id != 1 || idx == nil || *idx != 1 {
+		t.Fatalf("member b is %v (index %v)", id, idx)
+	}
+
+	if _, err := leaveRoom(session("a"), room.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ev := <-events; ev.Type != RETPlayerLeft || ev.Player.ID != "a" {
+		t.Errorf("leaving is published as %+v", ev)
+	}
+	ids, indexes := memberIDs(room)
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 || indexes[0] != 0 || indexes[1] != 1 {
+		t.Errorf("members after leaving: ids %v, indexes %v", ids, indexes)
+	}
+	// the ID of the member is stable and the index is renumbered
+	if id, idx := room.YouID(session("b")), room.You(session("b")); *id != 1 || *idx != 0 {
+		t.Errorf("member b is %d (index %d) after leaving", *id, *idx)
+	}
+	if room.YouID(session("a")) != nil {
+		t.Error("the player who left is a member")
+	}
+
+	if _, err := kickPlayer(session("b"), room.ID, "c"); err == nil {
+		t.Error("the member who is not the owner kicked the player")
+	}
+	if _, err := kickPlayer(session("o"), room.ID, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if ev := <-events; ev.Type != RETPlayerKicked || ev.Player.ID != "c" {
+		t.Errorf("kicking is published as %+v", ev)
+	}
+	if _, err := kickPlayer(session("o"), room.ID, "c"); err == nil {
+		t.Error("the player who is not a member is kicked")
+	}
+	if left := room.impl.(*testGame).left; len(left) != 2 || left[0] != 0 || left[1] != 2 {
+		t.Errorf("the game got MemberLeft for %v", left)
+	}
+
+	// IDs are not reused after the room is reloaded
+	forgetRoom(room.ID)
+	if _, err := joinRoom(session("a"), room.ID, "name-a"); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := getRoom(session("a"), room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := memberIDs(reloaded); len(ids) != 2 || ids[0] != 1 || ids[1] != 3 {
+		t.Errorf("members after rejoining: %v", ids)
+	}
+}
+
+func TestHistoryIsJournaledWithRoom(t *testing.T) {
+	s := setupStorage(t)
+	room := newTestRoom(t, "o", "a")
+	journaled := func() []*KVPair {
+		entries, err := s.ReadEntries(cHistoryJournal, room.ID, 0, []*KVPair{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries.([]*KVPair)
+	}
+
+	// the room is changed by someone else, so the entry of the change which is not saved is not journaled
+	other, err := roomRepo().Get(room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = roomRepo().Put(room.ID, other); err != nil {
+		t.Fatal(err)
+	}
+	room.AddHistory(&KVPair{Key: "lost", Val: "1"})
+	if got := journaled(); len(got) != 0 {
+		t.Errorf("entry is journaled before the room is saved: %v", got)
+	}
+	if err = room.Save(session("o")); err == nil {
+		t.Fatal("stale room is saved")
+	}
+	if got := journaled(); len(got) != 0 {
+		t.Errorf("entry of the room which was not saved is journaled: %v", got)
+	}
+
+	forgetRoom(room.ID)
+	room, err = getRoom(session("o"), room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.AddHistory(&KVPair{Key: "kept", Val: "2"})
+	if err = room.Save(session("o")); err != nil {
+		t.Fatal(err)
+	}
+	if got := journaled(); len(got) != 1 || got[0].Key != "kept" {
+		t.Errorf("journaled %v", got)
+	}
+	// the history is loaded from the journal with the room
+	forgetRoom(room.ID)
+	if hist := history(session("o"), room.ID, nil); len(hist) != 1 || hist[0].Val != "2" {
+		t.Errorf("history of the reloaded room %v", hist)
+	}
+}
@@ -129,20 +129,40 @@ func Authenticate(ctx iris.Context, createResponse bool) (string, error) {
 		}
 		return "", errors.New("not logged in")
 	}
-	idx := strings.Index(authHeader, "Bearer ")
-	if idx != -1 {
-		authHeader = authHeader[idx+7:]
-	}
-	id, ok := validateToken(authHeader)
-	if !ok {
+	id, err := authenticateToken(authHeader)
+	if err != nil {
 		if createResponse {
 			createErrorResponse(ctx, -1, "not logged in", 401)
 		}
+		return "", err
+	}
+	return id, nil
+}
+
+// authenticateToken returns id of the player the token (optionally prefixed with "Bearer ") was issued for
+func authenticateToken(token string) (string, error) {
+	idx := strings.Index(token, "Bearer ")
+	if idx != -1 {
+		token = token[idx+7:]
+	}
+	id, ok := validateToken(token)
+	if !ok {
 		return "", errors.New("not logged in")
 	}
 	return id, nil
 }
 
+// authenticateSubscriber validates the authToken of connection_init message of the WebSocket client;
+// the returned player id is kept as the user of the connection
+func authenticateSubscriber(token string) (interface{}, error) {
+	id, err := authenticateToken(token)
+	if err != nil {
+		return nil, err
+	}
+	log.Tracef("authenticateSubscriber: player %s is authenticated", id)
+	return id, nil
+}
+
 func createToken(id string, timeout int) (string, error) {
 	if timeout == 0 {
 		timeout = 5 * 24 * 60 * 60
@@ -0,0 +1,23 @@
+package resolve
+
+import (
+	"testing"
+)
+
+func TestAuthenticateSubscriber(t *testing.T) {
+	token, err := createToken("p1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, auth := range []string{token, "Bearer " + token} {
+		if id, err := authenticateSubscriber(auth); err != nil || id != "p1" {
+			t.Errorf("subscriber with %q is %v: %v", auth, id, err)
+		}
+	}
+	expired, _ := createToken("p1", -10)
+	for _, auth := range []string{"", "Bearer x", token + "x", expired} {
+		if id, err := authenticateSubscriber(auth); err == nil {
+			t.Errorf("subscriber with %q is authenticated as %v", auth, id)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package resolve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/kataras/iris"
+)
+
+// cSSEKeepAlive is the interval of comments sent to idle event streams so proxies don't close them
+const cSSEKeepAlive = 30 * time.Second
+
+// RoomEventsHandler streams events of the room {id} as Server-Sent Events for clients that can't use WebSockets
+func RoomEventsHandler(cont context.Context) iris.Handler {
+	return func(ctx iris.Context) {
+		ProcessRoomEvents(ctx, cont)
+	}
+}
+
+// ProcessRoomEvents sends events of the room to its members and owner with the epoch of the server and their seq
+// as event ids; the client reconnecting with Last-Event-ID header gets events it missed (or CHANGED event
+// if they are not kept any more or the server was restarted); the stream ends when the player leaves the room
+// or is kicked (see subscriberGets)
+func ProcessRoomEvents(ctx iris.Context, cont context.Context) {
+	id, _ := Authenticate(ctx, true)
+	if id == "" {
+		return
+	}
+	roomID := ctx.Params().Get("id")
+	cont = context.WithValue(cont, cSESSION_ID, id)
+	room, err := getRoom(cont, roomID)
+	if err != nil {
+		createErrorResponse(ctx, -301, "room not found", 404)
+		return
+	}
+	if !room.visibleTo(cont) {
+		createErrorResponse(ctx, -303, "not a member of the room", 403)
+		return
+	}
+	epoch, after := roomEvents.epoch, uint64(0)
+	if last := ctx.GetHeader("Last-Event-ID"); last != "" {
+		if epoch, after, err = parseEventID(last); err != nil {
+			createErrorResponse(ctx, -302, "invalid Last-Event-ID", 400)
+			return
+		}
+	}
+	flusher, ok := ctx.ResponseWriter().(http.Flusher)
+	if !ok {
+		createErrorResponse(ctx, -500, "streaming is not supported", 500)
+		return
+	}
+	events, cancel, missed := roomEvents.resume(roomID, epoch, after)
+	defer cancel()
+	log.Tracef("ProcessRoomEvents: player %s subscribed to room %s after event %d", id, roomID, after)
+
+	ctx.ContentType("text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	// nginx buffers responses by default
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.StatusCode(200)
+	w := ctx.ResponseWriter()
+	for _, ev := range missed {
+		deliver, last := subscriberGets(cont, ev)
+		if deliver {
+			if err := writeRoomEvent(w, ev); err != nil {
+				return
+			}
+		}
+		if last {
+			flusher.Flush()
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(cSSEKeepAlive)
+	defer keepAlive.Stop()
+	done := ctx.Request().Context().Done()
+	for {
+		select {
+		case <-done:
+			log.Tracef("ProcessRoomEvents: player %s disconnected from room %s", id, roomID)
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			deliver, last := subscriberGets(cont, ev)
+			if deliver {
+				if err := writeRoomEvent(w, ev); err != nil {
+					log.Debugf("ProcessRoomEvents: %v", err)
+					return
+				}
+			}
+			if last {
+				log.Tracef("ProcessRoomEvents: stream of room %s to player %s is over with %s event", roomID, id, ev.Type)
+				flusher.Flush()
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeRoomEvent writes ev in the text/event-stream format
+func writeRoomEvent(w http.ResponseWriter, ev *RoomEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", roomEvents.eventID(ev), ev.Type, data)
+	return err
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"time"
 
 	"github.com/vc2402/gomes/store"
 
@@ -38,7 +39,14 @@ func main() {
 	utils.Init()
 	// resolve.Init()
 	initGames()
+	// commands (e.g. 'gomes export dump.ndjson') are executed instead of starting the server
+	if runCommand(pflag.Args()) {
+		return
+	}
 	stor = initStore()
+	if stor != nil {
+		stor.ScheduleBackups(backupConfig())
+	}
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, "store", stor)
 	app := iris.Default()
@@ -46,6 +54,10 @@ func main() {
 	app.Logger().Install(utils.ExternalLogger)
 
 	gql := resolve.InitGraphQL(stor)
+	if stor != nil {
+		defer resolve.StartRoomSweeper(roomExpiry())()
+		defer resolve.StartPurgeJob(purgeConfig())()
+	}
 
 	// app.Options("/api/query", CORS)
 	app.Options("/api/*", CORS)
@@ -55,6 +67,8 @@ func main() {
 	// app.Any("/api/query", resolve.Handler(ctx))
 	app.Any("/api/query", gql.GQLHandler(ctx))
 	app.Any("/api/query/ws", iris.FromStd(gql.WSHandler))
+	// Server-Sent Events fallback of roomUpdates subscription for clients behind proxies breaking WebSockets
+	app.Get("/api/rooms/{id}/events", resolve.RoomEventsHandler(ctx))
 
 	user := app.Party("/api/user")
 	user.Post("/login", resolve.LoginHandler(ctx))
@@ -106,13 +120,68 @@ func initStore() *store.Store {
 	// db, err := store.InitBolt("gomes.bolt")
 	db, err := store.Init()
 	if err == nil {
-		db.RebuildIndexes(resolve.Player{})
-		db.RebuildIndexes(resolve.Room{})
+		// records should be converted to the current schema before indexes are built on them
+		migrated, err := db.Migrate(storedTypes...)
+		if err != nil {
+			log.Errorf("initStore: problem while migrating the store: %v", err)
+			db.Stop()
+			return nil
+		}
+		// indexes are maintained on every update; full rebuild is needed only to repair old databases or after migration;
+		// otherwise only indexes of types with changed indexed fields are rebuilt
+		if migrated || viper.GetBool("store.rebuildIndexes") {
+			for _, t := range storedTypes {
+				db.RebuildIndexes(t)
+			}
+		} else if _, err = db.SyncIndexes(storedTypes...); err != nil {
+			log.Warnf("initStore: problem while rebuilding changed indexes: %v", err)
+		}
 		return db
 	}
 	return nil
 }
 
+// backupConfig reads store.backup.* properties: dir, keep (number of backups), maxAge and interval (durations)
+func backupConfig() store.BackupConfig {
+	dir := viper.GetString("store.backup.dir")
+	if dir == "" {
+		dir = "backups"
+	}
+	return store.BackupConfig{
+		Dir:      dir,
+		Keep:     viper.GetInt("store.backup.keep"),
+		MaxAge:   viper.GetDuration("store.backup.maxAge"),
+		Interval: viper.GetDuration("store.backup.interval"),
+	}
+}
+
+// roomExpiry reads rooms.expiry.* properties: finished, abandoned and interval (durations) and archive (bool)
+func roomExpiry() resolve.RoomExpiry {
+	interval := viper.GetDuration("rooms.expiry.interval")
+	if interval == 0 {
+		interval = 10 * time.Minute
+	}
+	return resolve.RoomExpiry{
+		Finished:  viper.GetDuration("rooms.expiry.finished"),
+		Abandoned: viper.GetDuration("rooms.expiry.abandoned"),
+		Archive:   viper.GetBool("rooms.expiry.archive"),
+		Interval:  interval,
+	}
+}
+
+// purgeConfig reads store.deleted.* properties: retention (soft deleted items are kept for) and purgeInterval
+func purgeConfig() (retention time.Duration, interval time.Duration) {
+	retention = viper.GetDuration("store.deleted.retention")
+	if retention == 0 {
+		retention = 30 * 24 * time.Hour
+	}
+	interval = viper.GetDuration("store.deleted.purgeInterval")
+	if interval == 0 {
+		interval = time.Hour
+	}
+	return
+}
+
 func stopStore() {
 	if stor != nil {
 		stor.Stop()
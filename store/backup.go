@@ -0,0 +1,187 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// BackupConfig describes where backups are kept and how often they are made
+type BackupConfig struct {
+	// Dir is the directory for backup files
+	Dir string
+	// Keep is the number of the latest backups to keep; 0 means all of them
+	Keep int
+	// MaxAge is the age older backups are removed after; 0 means they are not removed by age
+	MaxAge time.Duration
+	// Interval is the period of scheduled backups; 0 means there are no scheduled ones
+	Interval time.Duration
+}
+
+// backuper is implemented by backends which can write consistent copy of the database while it is in use
+type backuper interface {
+	backup(w io.Writer) (int64, error)
+	// backupName returns the base name for backup files
+	backupName() string
+}
+
+// backups keeps the backup configuration and the state of the scheduled job
+type backups struct {
+	cfg  BackupConfig
+	mux  sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// cBackupTimeFormat has fixed-width nanoseconds so backups made within one second get distinct names sorted by time
+const cBackupTimeFormat = "20060102-150405.000000000"
+
+// Backup writes consistent copy of the database to w; returns the number of written bytes
+func (s *Store) Backup(w io.Writer) (int64, error) {
+	b, ok := s.db.(backuper)
+	if !ok {
+		return 0, errors.New("store: backups are not supported by the backend")
+	}
+	return b.backup(w)
+}
+
+// ScheduleBackups sets the configuration used by BackupNow and makes backups every cfg.Interval (if it is set)
+// until the store is stopped
+func (s *Store) ScheduleBackups(cfg BackupConfig) {
+	s.stopBackups()
+	s.backups = &backups{cfg: cfg}
+	if cfg.Interval <= 0 {
+		return
+	}
+	log.Infof("store: backups are scheduled every %v to %s", cfg.Interval, cfg.Dir)
+	s.backups.stop = make(chan struct{})
+	s.backups.done = make(chan struct{})
+	go func(b *backups) {
+		defer close(b.done)
+		ticker := time.NewTicker(b.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.stop:
+				return
+			case <-ticker.C:
+				if _, err := s.BackupNow(); err != nil {
+					log.Errorf("store: scheduled backup failed: %v", err)
+				}
+			}
+		}
+	}(s.backups)
+}
+
+// BackupNow writes timestamped backup file to the configured directory and removes backups out of retention;
+// returns the name of the file
+func (s *Store) BackupNow() (string, error) {
+	if s.backups == nil {
+		return "", errors.New("store: backups are not configured")
+	}
+	b, ok := s.db.(backuper)
+	if !ok {
+		return "", errors.New("store: backups are not supported by the backend")
+	}
+	s.backups.mux.Lock()
+	defer s.backups.mux.Unlock()
+	cfg := s.backups.cfg
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return "", err
+	}
+	prefix := b.backupName() + "-"
+	name := backupFileName(cfg.Dir, prefix, time.Now().UTC())
+	if err := writeBackup(b, name); err != nil {
+		log.Warnf("BackupNow: problem while writing %s: %v", name, err)
+		return "", err
+	}
+	log.Debugf("BackupNow: backup was written to %s", name)
+	rotateBackups(cfg, prefix)
+	return name, nil
+}
+
+// backupFileName returns the name of the backup made at t; the time is moved forward while the name is taken
+// as the clock may be coarser than the format
+func backupFileName(dir string, prefix string, t time.Time) string {
+	for {
+		name := filepath.Join(dir, prefix+t.Format(cBackupTimeFormat)+".bolt")
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return name
+		}
+		t = t.Add(time.Nanosecond)
+	}
+}
+
+// writeBackup writes the backup to temporary file and renames it to name when it is complete
+func writeBackup(b backuper, name string) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = b.backup(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// rotateBackups removes backups with prefix which are out of cfg.Keep latest ones or older than cfg.MaxAge
+func rotateBackups(cfg BackupConfig, prefix string) {
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		log.Warnf("rotateBackups: can't read %s: %v", cfg.Dir, err)
+		return
+	}
+	type backupFile struct {
+		name    string
+		created time.Time
+	}
+	files := []backupFile{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".bolt") {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".bolt")
+		created, err := time.Parse(cBackupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		files = append(files, backupFile{name: name, created: created})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].created.After(files[j].created) })
+	for i, f := range files {
+		expired := cfg.MaxAge > 0 && time.Since(f.created) > cfg.MaxAge
+		// the latest backup is kept anyway
+		if (cfg.Keep > 0 && i >= cfg.Keep) || (expired && i > 0) {
+			log.Debugf("rotateBackups: removing %s", f.name)
+			if err := os.Remove(filepath.Join(cfg.Dir, f.name)); err != nil {
+				log.Warnf("rotateBackups: can't remove %s: %v", f.name, err)
+			}
+		}
+	}
+}
+
+// stopBackups stops the scheduled job and waits for the backup in progress
+func (s *Store) stopBackups() {
+	if s.backups != nil && s.backups.stop != nil {
+		close(s.backups.stop)
+		<-s.backups.done
+		s.backups.stop = nil
+	}
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBackups(t *testing.T) {
+	s := openTestStore(t, "bolt", "", t.TempDir()+"/test.bolt")
+	fillItems(t, s)
+	if _, err := s.BackupNow(); err == nil {
+		t.Error("backup is made without the configuration")
+	}
+	dir := t.TempDir()
+	s.ScheduleBackups(BackupConfig{Dir: dir, Keep: 2, MaxAge: time.Hour})
+	// the expired backup and the file which is not a backup
+	old := filepath.Join(dir, "test-"+time.Now().Add(-2*time.Hour).UTC().Format(cBackupTimeFormat)+".bolt")
+	other := filepath.Join(dir, "test-notes.bolt")
+	for _, name := range []string{old, other} {
+		if err := os.WriteFile(name, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names := []string{}
+	for i := 0; i < 3; i++ {
+		name, err := s.BackupNow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	sort.Strings(files)
+	if want := []string{names[1], names[2], other}; len(files) != 3 || files[0] != want[0] || files[1] != want[1] || files[2] != want[2] {
+		t.Errorf("files after rotation %v, want %v", files, want)
+	}
+	backup := openTestStore(t, "bolt", "", names[2])
+	items, err := backup.ListRecords(Filter{Field: "Score", Value: 3}, []testItem{})
+	if got := itemIDs(items.([]testItem)); err != nil || len(got) != 2 {
+		t.Errorf("backup contains %v: %v", got, err)
+	}
+}
+
+func TestBackupFileName(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	first := backupFileName(dir, "test-", now)
+	os.WriteFile(first, nil, 0600)
+	if second := backupFileName(dir, "test-", now); second == first || second < first {
+		t.Errorf("name of the backup made at the same time is %s after %s", second, first)
+	}
+}
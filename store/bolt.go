@@ -2,10 +2,14 @@ package store
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"io"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 
 	log "github.com/cihub/seelog"
@@ -16,137 +20,408 @@ import (
 type boltDB struct {
 	bolt *bolt.DB
 	*storage
+	// tx is set for the db view used within update
+	tx *bolt.Tx
 }
 
-const cNonUniqueIndexDelimiter = "->"
+const (
+	// cNonUniqueIndexDelimiter separates the value from the record key; it is less than any character of values,
+	// so index keys are ordered by values first as compareRecords does
+	cNonUniqueIndexDelimiter = "\x00"
+	cIndexPrefix             = "idx_"
+)
 
-func initBolt(dbName string, st *storage) (*boltDB, error) {
+func init() {
+	registerBackend("bolt", SKBolt, func(dbType string, dbName string, st *storage) (backend, error) {
+		db, err := initBolt(dbName, st)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	})
+}
+
+// BoltFile returns the name of the bolt file for store.dbName property
+func BoltFile(dbName string) string {
 	if strings.Index(dbName, ".") == -1 {
 		_, err := os.Stat(dbName)
 		if err != nil {
 			dbName += ".bolt"
 		}
 	}
+	return dbName
+}
+
+func initBolt(dbName string, st *storage) (*boltDB, error) {
+	dbName = BoltFile(dbName)
 	log.Tracef("store: trying to open db %s", dbName)
 	bolt, err := bolt.Open(dbName, 0600, nil)
 	if err != nil {
 		log.Warnf("store: problems whileopening bolt file: %v", err)
 		return nil, err
 	}
-	return &boltDB{bolt, st}, nil
+	return &boltDB{bolt: bolt, storage: st}, nil
+}
+
+func (db *boltDB) stop() {
+	if db.tx == nil {
+		db.bolt.Close()
+	}
+}
+
+func (db *boltDB) update(fn func(db backend) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return fn(&boltDB{bolt: db.bolt, storage: db.storage, tx: tx})
+	})
+}
+
+// read calls fn within read-only transaction or within the one of update
+func (db *boltDB) read(fn func(tx *bolt.Tx) error) error {
+	if db.tx != nil {
+		return fn(db.tx)
+	}
+	return db.bolt.View(fn)
+}
+
+// write calls fn within read-write transaction or within the one of update
+func (db *boltDB) write(fn func(tx *bolt.Tx) error) error {
+	if db.tx != nil {
+		return fn(db.tx)
+	}
+	return db.bolt.Update(fn)
+}
+
+func (db *boltDB) ListRecords(desc *storable, filter Filter) (ret []record, hasNext bool, err error) {
+	err = db.read(func(tx *bolt.Tx) error {
+		var e error
+		ret, hasNext, e = db.listRecords(tx, desc, filter)
+		return e
+	})
+	return
 }
 
-func (db *boltDB) stopBolt() {
-	db.bolt.Close()
+func (db *boltDB) listRecords(tx *bolt.Tx, desc *storable, filter Filter) ([]record, bool, error) {
+	buck := tx.Bucket([]byte(desc.name))
+	if buck == nil {
+		return []record{}, false, nil
+	}
+	fld := desc.topField(filter.Field)
+	sortFld := desc.topField(filter.SortBy)
+	sortIndexed := sortFld != nil && sortFld.flags&FFIndex != 0
+	compound := len(filter.And) != 0 || len(filter.Or) != 0
+	if sortIndexed && !compound && (fld == nil || fld == sortFld) {
+		recs, hasNext, ok, err := db.listByIndexOrder(tx, buck, desc, sortFld, filter)
+		if ok || err != nil {
+			return recs, hasNext, err
+		}
+	}
+	keys, planned := planKeys(desc, filter, func(f *field, from string, to string) ([]string, bool) {
+		idx := tx.Bucket([]byte(getIndexName(desc.name, f.name)))
+		if idx == nil {
+			return nil, false
+		}
+		keys := []string{}
+		c := idx.Cursor()
+		for k, v := c.Seek([]byte(from)); k != nil && inRange(string(k), from, to); k, v = c.Next() {
+			keys = append(keys, string(v))
+		}
+		return keys, true
+	})
+	if !planned && sortIndexed && compound {
+		recs, hasNext, ok, err := db.listByIndexOrder(tx, buck, desc, sortFld, filter)
+		if ok || err != nil {
+			return recs, hasNext, err
+		}
+	}
+	recs := []record{}
+	addRecord := func(k []byte, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		rec, err := db.decodeRecord(desc, string(k), v)
+		if err != nil {
+			return err
+		}
+		if matchRecord(desc, filter, rec) {
+			recs = append(recs, rec)
+		}
+		return nil
+	}
+	if planned {
+		log.Tracef("ListRecords: looking by indexes")
+		for _, k := range keys {
+			if err := addRecord([]byte(k), buck.Get([]byte(k))); err != nil {
+				return nil, false, err
+			}
+		}
+	} else {
+		c := buck.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if err := addRecord(k, v); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	recs, hasNext := pageRecords(desc, filter, recs)
+	return recs, hasNext, nil
 }
 
-func (db *boltDB) ListRecords(desc *storable, filter Filter, buffer interface{}) (ret interface{}, err error) {
-	arr := reflect.ValueOf(buffer)
-	if arr.Kind() != reflect.Slice {
-		err = errors.New("ListRecords arg should be a slice")
+// listByIndexOrder selects the page walking the index of the sort field; ok is false if the index can't be used
+func (db *boltDB) listByIndexOrder(tx *bolt.Tx, buck *bolt.Bucket, desc *storable, f *field, filter Filter) (recs []record, hasNext bool, ok bool, err error) {
+	idx := tx.Bucket([]byte(getIndexName(desc.name, f.name)))
+	if idx == nil {
 		return
 	}
-	err = db.bolt.View(func(tx *bolt.Tx) error {
-		if filter.Field != "" {
-			for _, fld := range desc.fields {
-				if fld.name == filter.Field {
-					if fld.flags&FFIndex != 0 {
-						addRecord := func(rec []byte) error {
-							if rec != nil {
-								id := string(rec)
-								val := reflect.New(arr.Type().Elem())
-								ok, err := db.GetRecord(id, desc, val.Interface())
-								if err == nil {
-									if ok {
-										arr = reflect.Append(arr, val.Elem())
-									}
-									return nil
-								} else {
-									return err
-								}
-							}
-							return nil
-						}
+	var from, to string
+	if desc.topField(filter.Field) == f {
+		if from, to, ok = indexRange(f, filter); !ok {
+			return
+		}
+		ok = false
+	}
+	var after []byte
+	if filter.After != "" {
+		c, _ := decodeCursor(filter.After)
+		v, valid := indexValue(f, c.value)
+		if !valid {
+			return
+		}
+		after = []byte(indexKey(f, v, c.key))
+	}
+	log.Tracef("ListRecords: walking index of %s", f.name)
+	p := newPager(filter)
+	// records without values in the index go before indexed ones (after them if desc) as nil values do in compareValues
+	var unindexed []record
+	if from == "" && to == "" && (after == nil || filter.Desc) {
+		if unindexed, err = db.unindexedRecords(buck, idx, desc, filter); err != nil {
+			return
+		}
+	}
+	addAll := func(recs []record) bool {
+		for _, rec := range recs {
+			if !p.add(rec) {
+				return false
+			}
+		}
+		return true
+	}
+	if !filter.Desc && !addAll(unindexed) {
+		return p.items, p.hasNext, true, nil
+	}
+	full := false
+	seen := map[string]bool{}
+	scanIndex(idx, []byte(from), []byte(to), after, filter.Desc, func(k []byte, v []byte) bool {
+		if seen[string(v)] {
+			return true
+		}
+		seen[string(v)] = true
+		d := buck.Get(v)
+		if d == nil {
+			return true
+		}
+		var rec record
+		rec, err = db.decodeRecord(desc, string(v), d)
+		if err != nil {
+			return false
+		}
+		if !matchRecord(desc, filter, rec) {
+			return true
+		}
+		full = !p.add(rec)
+		return !full
+	})
+	if err == nil && !full && filter.Desc {
+		addAll(unindexed)
+	}
+	return p.items, p.hasNext, err == nil, err
+}
 
-						log.Tracef("ListRecords: looking by index")
-						indexName := getIndexName(desc.name, fld.name)
-						buck := tx.Bucket([]byte(indexName))
-						if buck != nil {
-							mask := []byte(filter.Mask)
-							if fld.flags&FFCaseInsensitive != 0 {
-								mask = []byte(strings.ToLower(filter.Mask))
-							}
-							// TODO: mask search
-							if fld.flags&FFUnique != 0 {
-								log.Tracef("ListRecords: looking by unique index")
-								if fld.flags&FFSeek != 0 {
-									c := buck.Cursor()
-									for k, v := c.Seek(mask); k != nil && bytes.HasPrefix(k, mask); k, v = c.Next() {
-										err = addRecord(v)
-										if err != nil {
-											return err
-										}
-									}
-								} else {
-									rec := buck.Get(mask)
-									return addRecord(rec)
-								}
-							} else {
-								// non-unique index - composed key
-
-								if fld.flags&FFSeek == 0 {
-									mask = []byte(filter.Mask + cNonUniqueIndexDelimiter)
-								}
-								c := buck.Cursor()
-								for k, v := c.Seek(mask); k != nil && bytes.HasPrefix(k, mask); k, v = c.Next() {
-									err = addRecord(v)
-									if err != nil {
-										return err
-									}
-								}
-							}
-						}
-						return nil
+// unindexedRecords returns records matching the filter which have no entries in the index idx ordered by keys
+func (db *boltDB) unindexedRecords(buck *bolt.Bucket, idx *bolt.Bucket, desc *storable, filter Filter) ([]record, error) {
+	indexed := map[string]bool{}
+	idx.ForEach(func(k []byte, v []byte) error {
+		indexed[string(v)] = true
+		return nil
+	})
+	recs := []record{}
+	c := buck.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v == nil || indexed[string(k)] {
+			continue
+		}
+		rec, err := db.decodeRecord(desc, string(k), v)
+		if err != nil {
+			return nil, err
+		}
+		if matchRecord(desc, filter, rec) {
+			recs = append(recs, rec)
+		}
+	}
+	if filter.Desc {
+		for i, j := 0, len(recs)-1; i < j; i, j = i+1, j-1 {
+			recs[i], recs[j] = recs[j], recs[i]
+		}
+	}
+	return recs, nil
+}
+
+// scanIndex walks keys in [from, to) (empty to means no upper bound) after the key after (if it is not nil);
+// stops when fn returns false
+func scanIndex(buck *bolt.Bucket, from []byte, to []byte, after []byte, desc bool, fn func(k []byte, v []byte) bool) {
+	c := buck.Cursor()
+	var k, v []byte
+	if !desc {
+		start := from
+		if after != nil && bytes.Compare(after, from) >= 0 {
+			start = after
+		}
+		k, v = c.Seek(start)
+		if after != nil && k != nil && bytes.Equal(k, after) {
+			k, v = c.Next()
+		}
+		for ; k != nil && (len(to) == 0 || bytes.Compare(k, to) < 0); k, v = c.Next() {
+			if !fn(k, v) {
+				return
+			}
+		}
+		return
+	}
+	end := to
+	if after != nil && (len(end) == 0 || bytes.Compare(after, end) < 0) {
+		end = after
+	}
+	if len(end) != 0 {
+		k, _ = c.Seek(end)
+	}
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+	for ; k != nil && bytes.Compare(k, from) >= 0; k, v = c.Prev() {
+		if !fn(k, v) {
+			return
+		}
+	}
+}
+
+// searchRecords looks for records in full-text indexes: their keys start with the token
+func (db *boltDB) searchRecords(desc *storable, terms []string) (recs []record, total int, ok bool, err error) {
+	err = db.read(func(tx *bolt.Tx) error {
+		for _, f := range desc.fullText {
+			if tx.Bucket([]byte(fullTextIndexName(desc.name, f.name))) == nil {
+				return nil
+			}
+		}
+		buck := tx.Bucket([]byte(desc.name))
+		if buck == nil {
+			ok = true
+			return nil
+		}
+		total = buck.Stats().KeyN
+		seen := map[string]bool{}
+		for _, f := range desc.fullText {
+			idx := tx.Bucket([]byte(fullTextIndexName(desc.name, f.name)))
+			for _, term := range terms {
+				c := idx.Cursor()
+				for k, v := c.Seek([]byte(term)); k != nil && bytes.HasPrefix(k, []byte(term)); k, v = c.Next() {
+					if seen[string(v)] {
+						continue
+					}
+					seen[string(v)] = true
+					d := buck.Get(v)
+					if d == nil {
+						continue
+					}
+					rec, err := db.decodeRecord(desc, string(v), d)
+					if err != nil {
+						return err
 					}
+					recs = append(recs, rec)
 				}
 			}
 		}
-		buck := tx.Bucket([]byte(desc.name))
-		if buck != nil {
+		ok = true
+		return nil
+	})
+	return
+}
 
-			c := buck.Cursor()
-			var err error
-			for k, v := c.First(); k != nil; k, v = c.Next() {
-				obj := map[string]interface{}{}
-				err = json.Unmarshal(v, &obj)
-				if err == nil {
-					val := reflect.New(arr.Type().Elem())
-					err = db.fromObject(desc, &val, obj)
-					arr = reflect.Append(arr, val.Elem())
-				} else {
-					return err
-				}
+// ensureFullText builds absent full-text indexes of desc; their buckets are created even if there are no tokens
+// so an absent bucket always means the index was not built
+func (db *boltDB) ensureFullText(desc *storable) error {
+	absent := false
+	db.read(func(tx *bolt.Tx) error {
+		for _, f := range desc.fullText {
+			absent = absent || tx.Bucket([]byte(fullTextIndexName(desc.name, f.name))) == nil
+		}
+		return nil
+	})
+	if !absent {
+		return nil
+	}
+	return db.write(func(tx *bolt.Tx) error {
+		for _, f := range desc.fullText {
+			name := fullTextIndexName(desc.name, f.name)
+			if tx.Bucket([]byte(name)) != nil {
+				continue
+			}
+			log.Debugf("ensureFullText: building index %s", name)
+			if err := db.buildIndex(tx, desc, name); err != nil {
+				return err
 			}
+		}
+		return nil
+	})
+}
 
+// buildIndex creates the bucket of the index and fills it with entries of stored records of desc
+func (db *boltDB) buildIndex(tx *bolt.Tx, desc *storable, index string) error {
+	if _, err := tx.CreateBucketIfNotExists([]byte(index)); err != nil {
+		return err
+	}
+	buck := tx.Bucket([]byte(desc.name))
+	if buck == nil {
+		return nil
+	}
+	return buck.ForEach(func(k []byte, v []byte) error {
+		obj := map[string]interface{}{}
+		if err := json.Unmarshal(v, &obj); err != nil {
+			return err
+		}
+		for _, e := range indexEntries(desc.name, desc, obj) {
+			if e.index != index {
+				continue
+			}
+			if err := db.addIndex(tx, e, string(k)); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
-	ret = arr.Interface()
-	return
 }
 
 func (db *boltDB) GetRecord(key string, desc *storable, rec interface{}) (bool, error) {
 	var err error
 	var d []byte
-	db.bolt.View(func(tx *bolt.Tx) error {
+	db.read(func(tx *bolt.Tx) error {
 		buck := tx.Bucket([]byte(desc.name))
 		val := reflect.ValueOf(rec)
 		if buck != nil {
 			d = buck.Get([]byte(key))
+			if d == nil {
+				return nil
+			}
 			switch desc.kind {
 			case reflect.Struct:
 				obj := map[string]interface{}{}
 				err = json.Unmarshal(d, &obj)
+				if err == nil {
+					err = db.openFields(desc, obj)
+				}
 				if err == nil {
 					err = db.fromObject(desc, &val, obj)
 				}
@@ -166,7 +441,7 @@ func (db *boltDB) GetRecord(key string, desc *storable, rec interface{}) (bool,
 }
 
 func (db *boltDB) PutRecord(key string, desc *storable, rec interface{}) error {
-	return db.bolt.Update(func(tx *bolt.Tx) error {
+	return db.write(func(tx *bolt.Tx) error {
 		log.Tracef("PutRecord: for key %s and descriptor %+v", key, *desc)
 		buck, err := tx.CreateBucketIfNotExists([]byte(desc.name))
 		if err != nil {
@@ -181,40 +456,58 @@ func (db *boltDB) PutRecord(key string, desc *storable, rec interface{}) error {
 			if err != nil {
 				return err
 			}
+			old := buck.Get([]byte(key))
+			if err = nextVersion(desc, old, rec, obj.(map[string]interface{})); err != nil {
+				return err
+			}
 			log.Tracef("PutRecord: going to save value %+v", obj)
+			if err = db.sealFields(desc, obj.(map[string]interface{})); err != nil {
+				return err
+			}
 			buf, err = json.Marshal(obj)
 			if err != nil {
 				log.Warnf("PutRecord: problem found while marshalling the record: %+v", err)
 				return err
 			}
-			err = db.processFieldsIndexes(tx, desc.name, desc, key, obj.(map[string]interface{}))
+			err = db.updateIndexes(tx, desc, key, old, obj.(map[string]interface{}))
 			if err != nil {
-				log.Warnf("PutRecord: problem found while creating the index: %+v", err)
+				log.Warnf("PutRecord: problem found while updating the index: %+v", err)
 				return err
 			}
 		case reflect.String:
 			buf = []byte(rec.(string))
 		}
 		log.Tracef("PutRecord: putting record to bucket")
-		buck.Put([]byte(key), buf)
-		return nil
+		return buck.Put([]byte(key), buf)
 	})
 }
 
 func (db *boltDB) DeleteRecord(object string, key string) error {
-	return db.bolt.Update(func(tx *bolt.Tx) error {
+	return db.write(func(tx *bolt.Tx) error {
 		log.Tracef("DeleteRecord: for key %s and object type %s", key, object)
 		buck := tx.Bucket([]byte(object))
-		if buck != nil {
-			return buck.Delete([]byte(key))
+		if buck == nil {
+			return errors.New("invalif object kind: " + object)
+		}
+		old := buck.Get([]byte(key))
+		if old == nil {
+			return nil
+		}
+		if desc := db.descriptorByName(object); desc != nil {
+			if desc.kind == reflect.Struct {
+				if err := db.updateIndexes(tx, desc, key, old, nil); err != nil {
+					return err
+				}
+			}
+		} else if err := db.purgeIndexes(tx, object, key); err != nil {
+			return err
 		}
-		// TODO: delete index
-		return errors.New("invalif object kind: " + object)
+		return buck.Delete([]byte(key))
 	})
 }
 
 func (db *boltDB) RebuildIndexes(desc *storable) error {
-	return db.bolt.Update(func(tx *bolt.Tx) error {
+	return db.write(func(tx *bolt.Tx) error {
 		log.Tracef("RebuildIndexes: for descriptor %s ", desc.name)
 		db.dropFieldsIndexes(tx, desc.name, desc)
 		buck := tx.Bucket([]byte(desc.name))
@@ -225,414 +518,331 @@ func (db *boltDB) RebuildIndexes(desc *storable) error {
 				obj := map[string]interface{}{}
 				err = json.Unmarshal(v, &obj)
 				if err == nil {
-					err = db.processFieldsIndexes(tx, desc.name, desc, string(k), obj)
+					for _, e := range indexEntries(desc.name, desc, obj) {
+						if err = db.addIndex(tx, e, string(k)); err != nil {
+							break
+						}
+					}
 				}
 				if err != nil {
 					return err
 				}
 			}
 		}
+		// full-text indexes are created even if there are no tokens so they are not built again on search
+		for _, f := range desc.fullText {
+			if _, err := tx.CreateBucketIfNotExists([]byte(fullTextIndexName(desc.name, f.name))); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 }
 
-func getIndexName(objName string, fieldName string) string {
-	return "idx_" + objName + "." + fieldName
-}
-
-func (db *boltDB) processFieldsIndexes(tx *bolt.Tx, name string, s *storable, key string, obj map[string]interface{}) error {
-	log.Tracef("processFieldsIndexes: starting for %s", name)
-	for _, f := range s.fields {
-		val, ok := obj[f.name]
-		if ok {
-			if f.flags&FFIndex != 0 {
-				switch val.(type) {
-				case string:
-					err := db.addIndex(tx, name, f, val.(string), key)
-					if err != nil {
-						return err
-					}
-				case []interface{}:
-					for _, v := range val.([]interface{}) {
-						err := db.addIndex(tx, name, f, v.(string), key)
-						if err != nil {
-							return err
-						}
-					}
-				default:
-					log.Warnf("processFieldsIndexes: can't process field %+v", val)
-				}
+func (db *boltDB) dump(fn func(object string, key string, obj interface{}) error) error {
+	return db.read(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, buck *bolt.Bucket) error {
+			object := string(name)
+			if isServiceBucket(object) {
+				return nil
 			}
-			if f.tip == FTComplex {
-				log.Tracef("processFieldsIndexes: processing complex field %s", f.name)
-				err := db.processFieldsIndexes(tx, name+"."+f.name, f.elem, key, val.(map[string]interface{}))
+			log.Tracef("dump: walking bucket %s", object)
+			return buck.ForEach(func(k []byte, v []byte) error {
+				obj, err := db.dumpedValue(object, v)
 				if err != nil {
 					return err
 				}
-			} else if f.tip == FTArray {
-				log.Tracef("processFieldsIndexes: processing array field %s", f.name)
-				for _, v := range val.([]interface{}) {
-					var err error
-					switch f.tip {
-					case FTComplex:
-						err = db.processFieldsIndexes(tx, name+"."+f.name, f.elem, key, v.(map[string]interface{}))
-					}
-					if err != nil {
-						return err
-					}
-				}
-			}
-		} else {
-			log.Warnf("processFieldsIndexes: field's %s value is absent in %s", f.name, name)
-		}
-
-	}
-	return nil
+				return fn(object, string(k), obj)
+			})
+		})
+	})
 }
-func (db *boltDB) dropFieldsIndexes(tx *bolt.Tx, name string, s *storable) error {
-	log.Tracef("dropFieldsIndexes: starting for %s", name)
-	for _, f := range s.fields {
-		if f.flags&FFIndex != 0 {
-			db.dropIndex(tx, name, f)
-		}
-		if f.tip == FTComplex || f.tip == FTArray {
-			log.Tracef("dropFieldsIndexes: processing complex field %s", f.name)
-			err := db.dropFieldsIndexes(tx, name+"."+f.name, f.elem)
-			if err != nil {
-				return err
-			}
+
+func (db *boltDB) restore(desc *storable, key string, obj interface{}) error {
+	return db.write(func(tx *bolt.Tx) error {
+		buck, err := tx.CreateBucketIfNotExists([]byte(desc.name))
+		if err != nil {
+			return err
 		}
-	}
-	return nil
-}
-func (db *boltDB) addIndex(tx *bolt.Tx, name string, field *field, key string, value string) error {
-	indexName := getIndexName(name, field.name)
-	buck, err := tx.CreateBucketIfNotExists([]byte(indexName))
-	if err != nil {
-		return err
-	}
-	idxKey := key
-	if field.flags&FFCaseInsensitive != 0 {
-		idxKey = strings.ToLower(key)
-	}
-	if field.flags&FFUnique == 0 {
-		idxKey += cNonUniqueIndexDelimiter + value
-	} else {
-		existing := buck.Get([]byte(idxKey))
-		log.Tracef("addIndex: checking if key already exists: %v", existing != nil)
-		if existing != nil && string(existing) != value {
-			log.Debugf("Unique key violation: %s(%s): %s", name, field.name, key)
-			return errors.New("Unique key is violated")
+		buf, err := db.storedValue(desc, obj)
+		if err != nil {
+			return err
 		}
-	}
-	return buck.Put([]byte(idxKey), []byte(value))
+		return buck.Put([]byte(key), buf)
+	})
 }
 
-func (db *boltDB) deleteIndex(tx *bolt.Tx, name string, field *field, key string, value string) error {
-	indexName := getIndexName(name, field.name)
-	buck, err := tx.CreateBucketIfNotExists([]byte(indexName))
-	if err != nil {
+// backup writes the copy of the database within read transaction so it may be done while the db is in use
+func (db *boltDB) backup(w io.Writer) (n int64, err error) {
+	err = db.read(func(tx *bolt.Tx) error {
+		n, err = tx.WriteTo(w)
 		return err
-	}
-	idxKey := key
-	if field.flags&FFCaseInsensitive != 0 {
-		idxKey = strings.ToLower(key)
-	}
-	if field.flags&FFUnique == 0 {
-		idxKey += cNonUniqueIndexDelimiter + value
-	}
-	return buck.Delete([]byte(idxKey))
+	})
+	return
 }
 
-func (db *boltDB) getNonUniqueIndexRecord() {
+func (db *boltDB) backupName() string {
+	name := filepath.Base(db.bolt.Path())
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
 
+func (db *boltDB) schemaValue(key string) (value string, err error) {
+	err = db.read(func(tx *bolt.Tx) error {
+		if schema := tx.Bucket([]byte(cSchemaBucket)); schema != nil {
+			value = string(schema.Get([]byte(key)))
+		}
+		return nil
+	})
+	return
 }
-func (db *boltDB) dropIndex(tx *bolt.Tx, name string, field *field) error {
-	indexName := getIndexName(name, field.name)
-	return tx.DeleteBucket([]byte(indexName))
+
+func (db *boltDB) setSchemaValue(key string, value string) error {
+	return db.write(func(tx *bolt.Tx) error {
+		schema, err := tx.CreateBucketIfNotExists([]byte(cSchemaBucket))
+		if err != nil {
+			return err
+		}
+		return schema.Put([]byte(key), []byte(value))
+	})
 }
 
-func (db *boltDB) toObject(desc *storable, rec *reflect.Value) (interface{}, error) {
-	var fields interface{}
-	var err error
-	log.Tracef("toObject: for %s: %+v", desc.name, *rec)
-	switch desc.kind {
-	case reflect.Struct:
-		// val := reflect.ValueOf(*rec)
-		log.Tracef("toObject: going to fill map")
-		fields, err = db.fillMap(desc, rec)
+// isServiceBucket checks if the bucket is not the one of records (i.e. it is an index, a journal or schema versions)
+func isServiceBucket(name string) bool {
+	return strings.HasPrefix(name, cIndexPrefix) || strings.HasPrefix(name, cJournalPrefix) || name == cSchemaBucket
+}
 
-	case reflect.String:
-		fields = rec.String()
-	}
-	return fields, err
+// appendEntry puts d to the owner's sub bucket of the journal bucket with the key of the group and the sequence number
+func (db *boltDB) appendEntry(journal string, owner string, group int, d []byte) error {
+	return db.write(func(tx *bolt.Tx) error {
+		buck, err := tx.CreateBucketIfNotExists([]byte(cJournalPrefix + journal))
+		if err != nil {
+			return err
+		}
+		if buck, err = buck.CreateBucketIfNotExists([]byte(owner)); err != nil {
+			return err
+		}
+		seq, err := buck.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 16)
+		binary.BigEndian.PutUint64(key, uint64(group))
+		binary.BigEndian.PutUint64(key[8:], seq)
+		return buck.Put(key, d)
+	})
 }
 
-func (db *boltDB) fromObject(desc *storable, rec *reflect.Value, buf interface{}) error {
-	var err error
-	log.Tracef("fromObject: for %s", desc.name)
-	switch desc.kind {
-	case reflect.Struct:
-		// val := reflect.ValueOf(rec)
-		err = db.fromMap(desc, rec, buf.(map[string]interface{}))
-
-	case reflect.String:
-		str, ok := buf.(string)
-		if ok {
-			log.Tracef("going to set value of %+v to %+v", rec, buf)
-			reflect.Indirect(*rec).SetString(str)
-		} else {
-			log.Warnf("fromObject: can't get string from %+v", buf)
+func (db *boltDB) readEntries(journal string, owner string, group int) ([][]byte, error) {
+	ret := [][]byte{}
+	err := db.read(func(tx *bolt.Tx) error {
+		buck := tx.Bucket([]byte(cJournalPrefix + journal))
+		if buck != nil {
+			buck = buck.Bucket([]byte(owner))
 		}
-	}
-	return err
+		if buck == nil {
+			return nil
+		}
+		prefix := make([]byte, 8)
+		binary.BigEndian.PutUint64(prefix, uint64(group))
+		c := buck.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			ret = append(ret, append([]byte{}, v...))
+		}
+		return nil
+	})
+	return ret, err
 }
 
-func (db *boltDB) fillMap(desc *storable, rec *reflect.Value) (fields map[string]interface{}, err error) {
-	fields = make(map[string]interface{})
-	if rec.Kind() == reflect.Ptr {
-		elem := rec.Elem()
-		rec = &elem
-	}
-	log.Tracef("fillMap: for %s; rec is %s", desc.name, rec.Kind().String())
-	for i := 0; i < rec.NumField(); i++ {
-		log.Tracef("fillMap: field N %d is %s", i, rec.Type().Field(i).Name)
-	}
-	for _, f := range desc.fields {
-		attrVal := rec.FieldByName(f.name)
-		log.Tracef("fillMap: processing field %s: %+v", f.name, attrVal)
-		if attrVal.IsValid() {
-			fields[f.accessor], err = db.prepareField(f, &attrVal, rec)
-			if err != nil {
-				return
-			}
-		} else {
-			log.Warnf("fillMap: can't find field %s on record %+v", f.name, *rec)
+func (db *boltDB) dropJournal(journal string, owner string) error {
+	return db.write(func(tx *bolt.Tx) error {
+		buck := tx.Bucket([]byte(cJournalPrefix + journal))
+		if buck == nil || buck.Bucket([]byte(owner)) == nil {
+			return nil
 		}
+		return buck.DeleteBucket([]byte(owner))
+	})
+}
 
-	}
-	return
+func (db *boltDB) dumpEntries(fn func(journal string, owner string, group int, d []byte) error) error {
+	return db.read(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, buck *bolt.Bucket) error {
+			if !bytes.HasPrefix(name, []byte(cJournalPrefix)) {
+				return nil
+			}
+			journal := strings.TrimPrefix(string(name), cJournalPrefix)
+			return buck.ForEach(func(owner []byte, v []byte) error {
+				sub := buck.Bucket(owner)
+				if v != nil || sub == nil {
+					return nil
+				}
+				return sub.ForEach(func(k []byte, v []byte) error {
+					if len(k) != 16 {
+						return nil
+					}
+					return fn(journal, string(owner), int(binary.BigEndian.Uint64(k)), v)
+				})
+			})
+		})
+	})
 }
 
-func (db *boltDB) fromMap(desc *storable, rec *reflect.Value, buf map[string]interface{}) (err error) {
-	log.Tracef("fromMap: for %s", desc.name)
-	v := reflect.Indirect(*rec)
-	rec = &v
-	var val reflect.Value
-	if rec.Kind() == reflect.Ptr {
-		log.Tracef("fromMap: found pointer for field %s of type %s (%s)", desc.name, rec.Type().Elem().Name(), rec.Type().Elem().Kind().String())
+func getIndexName(objName string, fieldName string) string {
+	return cIndexPrefix + objName + "." + fieldName
+}
 
-		if rec.IsNil() {
-			val = reflect.New(rec.Type().Elem())
-			rec.Set(val)
+// updateIndexes replaces index entries of the stored record old (may be nil) with ones of obj (may be nil)
+func (db *boltDB) updateIndexes(tx *bolt.Tx, desc *storable, key string, old []byte, obj map[string]interface{}) error {
+	oldEntries := map[string]indexEntry{}
+	if old != nil {
+		oldObj := map[string]interface{}{}
+		if err := json.Unmarshal(old, &oldObj); err != nil {
+			log.Warnf("updateIndexes: can't unmarshal stored record %s.%s: %v", desc.name, key, err)
+		} else {
+			for _, e := range indexEntries(desc.name, desc, oldObj) {
+				oldEntries[e.index+"\x00"+indexKey(e.field, e.value, key)] = e
+			}
 		}
-		val = rec.Elem()
-		log.Tracef("fromMap: going to fill value: %s (%s)", val.Type().Name(), val.Kind().String())
-		rec = &val
-	} else {
-		val = *rec
 	}
-	if val.Kind() == reflect.Ptr {
-		return db.fromMap(desc, &val, buf)
+	newEntries := map[string]indexEntry{}
+	if obj != nil {
+		for _, e := range indexEntries(desc.name, desc, obj) {
+			newEntries[e.index+"\x00"+indexKey(e.field, e.value, key)] = e
+		}
 	}
-	for _, f := range desc.fields {
-		var attrVal reflect.Value
-		attrVal = val.FieldByName(f.name)
-		err = db.putField(f, &attrVal, buf[f.accessor], &val)
-		if err != nil {
-			return
+	for k, e := range oldEntries {
+		if _, ok := newEntries[k]; !ok {
+			if err := db.deleteIndex(tx, e, key); err != nil {
+				return err
+			}
 		}
 	}
-	return
-}
-
-func (db *boltDB) fillArray(desc *storable, rec *reflect.Value) ([]interface{}, error) {
-	log.Tracef("fillAray: for %s", desc.name)
-	arr := make([]interface{}, 0)
-	for i := 0; i < rec.Len(); i++ {
-		val := rec.Index(i)
-		el, err := db.toObject(desc, &val)
-		if err != nil {
-			return nil, err
+	for k, e := range newEntries {
+		if _, ok := oldEntries[k]; !ok {
+			if err := db.addIndex(tx, e, key); err != nil {
+				return err
+			}
 		}
-		arr = append(arr, el)
 	}
-	log.Tracef("fillAray: for %s; exiting", desc.name)
-	return arr, nil
+	return nil
 }
 
-func (db *boltDB) fromArray(desc *storable, rec *reflect.Value, buf []interface{}) (err error) {
-	log.Tracef("fromArray: for %s of %d elements", desc.name, len(buf))
-	for i := 0; i < len(buf); i++ {
-		log.Tracef("fromArray: creating value for next element: %s (%s)", rec.Type().Elem().Name(), rec.Type().Elem().Kind().String())
-		log.Tracef("fromArray: length fo slice: %d", rec.Len())
-		val := reflect.New(rec.Type().Elem())
-		err = db.fromObject(desc, &val, buf[i])
-		if err != nil {
-			return
+// purgeIndexes removes all the entries pointing to key from indexes of object; used when there is no descriptor
+func (db *boltDB) purgeIndexes(tx *bolt.Tx, object string, key string) error {
+	prefix := []byte(getIndexName(object, ""))
+	return tx.ForEach(func(name []byte, buck *bolt.Bucket) error {
+		if !bytes.HasPrefix(name, prefix) {
+			return nil
 		}
-		rec.Set(reflect.Append(*rec, reflect.Indirect(val)))
-	}
-	log.Tracef("fromAray: for %s: exting", desc.name)
-	return
+		stale := [][]byte{}
+		buck.ForEach(func(k, v []byte) error {
+			if string(v) == key {
+				stale = append(stale, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range stale {
+			if err := buck.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-func (db *boltDB) prepareField(f *field, v *reflect.Value, parent *reflect.Value) (fldVal interface{}, err error) {
-	log.Tracef("prepareField: for %s", f.name)
-	switch f.tip {
-	case FTArray:
-		if v.IsNil() {
-			fldVal = nil
-		} else {
-			fldVal, err = db.fillArray(f.elem, v)
+func (db *boltDB) dropFieldsIndexes(tx *bolt.Tx, name string, s *storable) error {
+	log.Tracef("dropFieldsIndexes: starting for %s", name)
+	for _, f := range s.fields {
+		// encrypted fields may have plain text index left from the time they were not encrypted
+		if f.flags&(FFIndex|FFEncrypted) != 0 {
+			db.dropIndex(tx, name, f)
 		}
-	case FTBool:
-		fldVal = 0
-		if v.Bool() {
-			fldVal = 1
+		if f.flags&FFFullText != 0 {
+			tx.DeleteBucket([]byte(fullTextIndexName(name, f.name)))
 		}
-	case FTByteArray:
-	case FTComplex:
-		if v.IsNil() {
-			fldVal = nil
-		} else {
-			fldVal, err = db.fillMap(f.elem, v)
-		}
-	case FTPointer:
-		elem := v.Elem()
-		return db.toObject(f.elem, &elem)
-	case FTHelper:
-		meth := parent.MethodByName("GetValue")
-		if !meth.IsValid() {
-			if parent.Kind() == reflect.Ptr {
-				meth = parent.Elem().MethodByName("GetValue")
-			} else {
-				meth = parent.Addr().MethodByName("GetValue")
+		if (f.tip == FTComplex || f.tip == FTArray || f.tip == FTPointer || f.tip == FTMap) && f.elem != nil {
+			log.Tracef("dropFieldsIndexes: processing complex field %s", f.name)
+			err := db.dropFieldsIndexes(tx, name+"."+f.name, f.elem)
+			if err != nil {
+				return err
 			}
 		}
-		if meth.IsValid() {
-			result := meth.Call([]reflect.Value{reflect.ValueOf(f.name)})
-			if len(result) > 1 && !result[1].IsNil() {
-				err = result[1].Interface().(error)
-				fldVal = nil
-				return
-			}
-			switch result[0].Kind() {
-			case reflect.Struct:
-				desc, err := db.storage.findDescriptor(result[0].Type())
-				if err != nil {
-					return nil, err
-				}
-				fldVal, err = db.toObject(desc, &result[0])
-			default:
-				fldVal = result[0].Interface()
-			}
-
-		} else {
-			err = errors.New("Can't find method 'GetValue' for type " + parent.Type().Name())
+	}
+	return nil
+}
+func (db *boltDB) addIndex(tx *bolt.Tx, e indexEntry, recKey string) error {
+	buck, err := tx.CreateBucketIfNotExists([]byte(e.index))
+	if err != nil {
+		return err
+	}
+	idxKey := []byte(indexKey(e.field, e.value, recKey))
+	if e.field.flags&FFUnique != 0 {
+		existing := buck.Get(idxKey)
+		log.Tracef("addIndex: checking if key already exists: %v", existing != nil)
+		if existing != nil && string(existing) != recKey {
+			log.Debugf("Unique key violation: %s: %s", e.index, e.value)
+			return errors.New("Unique key is violated")
 		}
-	default:
-		err = nil
-		log.Tracef("prepareField: going to call interface for %s; value: %+v", f.name, v)
-
-		fldVal = v.Interface()
-
 	}
-	log.Tracef("prepareField: for %s: exiting", f.name)
-	return
+	return buck.Put(idxKey, []byte(recKey))
 }
 
-func (db *boltDB) putField(f *field, v *reflect.Value, fldVal interface{}, parent *reflect.Value) (err error) {
-	log.Tracef("putField: for %s", f.name)
-	if fldVal == nil {
-		log.Tracef("putField: for %s: value is nil, skipping", f.name)
-		return
+func (db *boltDB) deleteIndex(tx *bolt.Tx, e indexEntry, recKey string) error {
+	buck := tx.Bucket([]byte(e.index))
+	if buck == nil {
+		return nil
 	}
-	switch f.tip {
-	case FTArray:
-		err = db.fromArray(f.elem, v, fldVal.([]interface{}))
-	case FTBool:
-		val, ok := fldVal.(int)
-		if ok {
-			b := false
-			if val == 1 {
-				b = true
-			}
-			log.Tracef("putField: setting bool value %v for %s", val, f.name)
-			v.SetBool(b)
-		} else {
-			log.Warnf("putField: can't put bool value from $+v", fldVal)
-		}
-	case FTInt, FTFloat:
-		numb, ok := fldVal.(float64)
-		if !ok {
-			log.Warnf("putField: can't get number from %+v", fldVal)
+	idxKey := []byte(indexKey(e.field, e.value, recKey))
+	if existing := buck.Get(idxKey); existing == nil || string(existing) != recKey {
+		// the entry belongs to another record (or is absent already)
+		return nil
+	}
+	return buck.Delete(idxKey)
+}
+
+func (db *boltDB) getNonUniqueIndexRecord() {
+
+}
+func (db *boltDB) dropIndex(tx *bolt.Tx, name string, field *field) error {
+	indexName := getIndexName(name, field.name)
+	return tx.DeleteBucket([]byte(indexName))
+}
+
+func (db *boltDB) migrateObject(object string, to int, convert func(from int, key string, obj map[string]interface{}) error) (migrated bool, err error) {
+	err = db.write(func(tx *bolt.Tx) error {
+		schema, err := tx.CreateBucketIfNotExists([]byte(cSchemaBucket))
+		if err != nil {
+			return err
 		}
-		if f.tip == FTInt {
-			log.Tracef("putField: setting int value %f for %s", numb, f.name)
-			v.SetInt(int64(numb))
-		} else {
-			log.Tracef("putField: setting float value %f for %s", numb, f.name)
-			v.SetFloat(numb)
-		}
-
-	case FTByteArray:
-	case FTComplex:
-		err = db.fromMap(f.elem, v, fldVal.(map[string]interface{}))
-	case FTPointer:
-		val := reflect.New((*f.rtype).Elem())
-		v.Set(val.Addr())
-		log.Tracef("putField: dereferencing pointer for %s", f.name)
-		return db.fromObject(f.elem, &val, fldVal)
-	case FTHelper:
-		meth := parent.MethodByName("SetValue")
-		getMeth := parent.MethodByName("GetValue")
-		if !meth.IsValid() {
-			if parent.Kind() == reflect.Ptr {
-				meth = parent.Elem().MethodByName("SetValue")
-				getMeth = parent.Elem().MethodByName("GetValue")
-			} else {
-				meth = parent.Addr().MethodByName("SetValue")
-				getMeth = parent.Addr().MethodByName("GetValue")
+		stored := 0
+		if v := schema.Get([]byte(object)); v != nil {
+			if stored, err = strconv.Atoi(string(v)); err != nil {
+				return err
 			}
 		}
-		if meth.IsValid() && getMeth.IsValid() {
-			log.Tracef("putField: calling GetValue for %s", f.name)
-			buff := getMeth.Call([]reflect.Value{reflect.ValueOf(f.name)})
-			if len(buff) > 1 && !buff[1].IsNil() {
-				err = buff[1].Interface().(error)
-				return
+		if err = checkSchemaVersion(object, stored, to); err != nil || stored == to {
+			return err
+		}
+		log.Debugf("migrateObject: migrating %s from version %d to %d", object, stored, to)
+		if buck := tx.Bucket([]byte(object)); buck != nil {
+			updates := map[string][]byte{}
+			err = buck.ForEach(func(k []byte, v []byte) error {
+				d, err := db.convertStored(object, v, func(obj map[string]interface{}) error {
+					return convert(stored, string(k), obj)
+				})
+				updates[string(k)] = d
+				return err
+			})
+			if err != nil {
+				return err
 			}
-			var result []reflect.Value
-			switch buff[0].Kind() {
-			case reflect.Struct:
-				desc, err := db.storage.findDescriptor(buff[0].Type())
-				if err != nil {
+			for k, d := range updates {
+				if err = buck.Put([]byte(k), d); err != nil {
 					return err
 				}
-				val := reflect.New(reflect.TypeOf(buff[0]))
-				log.Tracef("putField: calling fromObject for %s", f.name)
-				err = db.fromObject(desc, v, val.Interface())
-				log.Tracef("putField: calling the helper for %s", f.name)
-				result = meth.Call([]reflect.Value{reflect.ValueOf(f.name), val})
-			default:
-				log.Tracef("putField: calling the helper for %s", f.name)
-				result = meth.Call([]reflect.Value{reflect.ValueOf(f.name), reflect.ValueOf(fldVal)})
-			}
-			if len(result) > 0 && !result[0].IsNil() {
-				err = result[0].Interface().(error)
 			}
-		} else {
-			log.Warnf("putField: method 'GetValue' not found for type %s (field %s)", parent.Type().Name(), f.name)
-			err = errors.New("Can't find method 'GetValue' for type " + parent.Type().Name())
+			migrated = len(updates) > 0
 		}
-	default:
-		err = nil
-		log.Tracef("putField: setting value from interface %v for %s", fldVal, f.name)
-		// if fldVal != nil {
-		v.Set(reflect.ValueOf(fldVal))
-		// }
-	}
-	log.Tracef("putField: for %s: exiting; error: %+v", f.name, err)
+		return schema.Put([]byte(object), []byte(strconv.Itoa(to)))
+	})
 	return
 }
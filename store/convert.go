@@ -0,0 +1,395 @@
+package store
+
+import (
+	"errors"
+	"reflect"
+
+	log "github.com/cihub/seelog"
+)
+
+func (s *storage) toObject(desc *storable, rec *reflect.Value) (interface{}, error) {
+	var fields interface{}
+	var err error
+	log.Tracef("toObject: for %s: %+v", desc.name, *rec)
+	switch desc.kind {
+	case reflect.Struct:
+		// val := reflect.ValueOf(*rec)
+		log.Tracef("toObject: going to fill map")
+		fields, err = s.fillMap(desc, rec)
+
+	case reflect.String:
+		fields = rec.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Float32, reflect.Float64, reflect.Bool:
+		// elements of arrays and maps
+		fields = reflect.Indirect(*rec).Interface()
+	}
+	return fields, err
+}
+
+func (s *storage) fromObject(desc *storable, rec *reflect.Value, buf interface{}) error {
+	var err error
+	log.Tracef("fromObject: for %s", desc.name)
+	switch desc.kind {
+	case reflect.Struct:
+		// val := reflect.ValueOf(rec)
+		err = s.fromMap(desc, rec, buf.(map[string]interface{}))
+
+	case reflect.String:
+		str, ok := buf.(string)
+		if ok {
+			log.Tracef("going to set value of %+v to %+v", rec, buf)
+			reflect.Indirect(*rec).SetString(str)
+		} else {
+			log.Warnf("fromObject: can't get string from %+v", buf)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := buf.(float64); ok {
+			reflect.Indirect(*rec).SetInt(int64(n))
+		} else {
+			log.Warnf("fromObject: can't get number from %+v", buf)
+		}
+	case reflect.Float32, reflect.Float64:
+		if n, ok := buf.(float64); ok {
+			reflect.Indirect(*rec).SetFloat(n)
+		} else {
+			log.Warnf("fromObject: can't get number from %+v", buf)
+		}
+	case reflect.Bool:
+		if b, ok := buf.(bool); ok {
+			reflect.Indirect(*rec).SetBool(b)
+		} else {
+			log.Warnf("fromObject: can't get bool from %+v", buf)
+		}
+	}
+	return err
+}
+
+func (s *storage) fillMap(desc *storable, rec *reflect.Value) (fields map[string]interface{}, err error) {
+	fields = make(map[string]interface{})
+	if rec.Kind() == reflect.Ptr {
+		elem := rec.Elem()
+		rec = &elem
+	}
+	log.Tracef("fillMap: for %s; rec is %s", desc.name, rec.Kind().String())
+	for i := 0; i < rec.NumField(); i++ {
+		log.Tracef("fillMap: field N %d is %s", i, rec.Type().Field(i).Name)
+	}
+	for _, f := range desc.fields {
+		attrVal := fieldValue(*rec, f, false)
+		log.Tracef("fillMap: processing field %s: %+v", f.name, attrVal)
+		if attrVal.IsValid() {
+			fields[f.accessor], err = s.prepareField(f, &attrVal, rec)
+			if err != nil {
+				return
+			}
+		} else if len(f.index) < 2 {
+			log.Warnf("fillMap: can't find field %s on record %+v", f.name, *rec)
+		}
+
+	}
+	return
+}
+
+// fieldValue returns the field of struct rec; fields promoted through nil embedded pointers
+// are invalid unless alloc is set and the pointers may be allocated
+func fieldValue(rec reflect.Value, f *field, alloc bool) reflect.Value {
+	if len(f.index) == 0 {
+		return rec.FieldByName(f.name)
+	}
+	v := rec
+	for i, idx := range f.index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(idx)
+	}
+	return v
+}
+
+func (s *storage) fromMap(desc *storable, rec *reflect.Value, buf map[string]interface{}) (err error) {
+	log.Tracef("fromMap: for %s", desc.name)
+	v := reflect.Indirect(*rec)
+	rec = &v
+	var val reflect.Value
+	if rec.Kind() == reflect.Ptr {
+		log.Tracef("fromMap: found pointer for field %s of type %s (%s)", desc.name, rec.Type().Elem().Name(), rec.Type().Elem().Kind().String())
+
+		if rec.IsNil() {
+			val = reflect.New(rec.Type().Elem())
+			rec.Set(val)
+		}
+		val = rec.Elem()
+		log.Tracef("fromMap: going to fill value: %s (%s)", val.Type().Name(), val.Kind().String())
+		rec = &val
+	} else {
+		val = *rec
+	}
+	if val.Kind() == reflect.Ptr {
+		return s.fromMap(desc, &val, buf)
+	}
+	for _, f := range desc.fields {
+		var attrVal reflect.Value
+		attrVal = fieldValue(val, f, buf[f.accessor] != nil)
+		if !attrVal.IsValid() {
+			continue
+		}
+		err = s.putField(f, &attrVal, buf[f.accessor], &val)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *storage) fillArray(desc *storable, rec *reflect.Value) ([]interface{}, error) {
+	log.Tracef("fillAray: for %s", desc.name)
+	arr := make([]interface{}, 0)
+	for i := 0; i < rec.Len(); i++ {
+		val := rec.Index(i)
+		el, err := s.toObject(desc, &val)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, el)
+	}
+	log.Tracef("fillAray: for %s; exiting", desc.name)
+	return arr, nil
+}
+
+func (s *storage) fromArray(desc *storable, rec *reflect.Value, buf []interface{}) (err error) {
+	log.Tracef("fromArray: for %s of %d elements", desc.name, len(buf))
+	for i := 0; i < len(buf); i++ {
+		log.Tracef("fromArray: creating value for next element: %s (%s)", rec.Type().Elem().Name(), rec.Type().Elem().Kind().String())
+		log.Tracef("fromArray: length fo slice: %d", rec.Len())
+		val := reflect.New(rec.Type().Elem())
+		err = s.fromObject(desc, &val, buf[i])
+		if err != nil {
+			return
+		}
+		rec.Set(reflect.Append(*rec, reflect.Indirect(val)))
+	}
+	log.Tracef("fromAray: for %s: exting", desc.name)
+	return
+}
+
+func (s *storage) fillDict(desc *storable, rec *reflect.Value) (map[string]interface{}, error) {
+	log.Tracef("fillDict: for %s", desc.name)
+	dict := make(map[string]interface{}, rec.Len())
+	iter := rec.MapRange()
+	for iter.Next() {
+		val := iter.Value()
+		el, err := s.toObject(desc, &val)
+		if err != nil {
+			return nil, err
+		}
+		dict[iter.Key().String()] = el
+	}
+	return dict, nil
+}
+
+func (s *storage) fromDict(desc *storable, rec *reflect.Value, buf map[string]interface{}) error {
+	log.Tracef("fromDict: for %s of %d elements", desc.name, len(buf))
+	dict := reflect.MakeMapWithSize(rec.Type(), len(buf))
+	for k, el := range buf {
+		val := reflect.New(rec.Type().Elem())
+		if err := s.fromObject(desc, &val, el); err != nil {
+			return err
+		}
+		dict.SetMapIndex(reflect.ValueOf(k).Convert(rec.Type().Key()), val.Elem())
+	}
+	rec.Set(dict)
+	return nil
+}
+
+func (s *storage) prepareField(f *field, v *reflect.Value, parent *reflect.Value) (fldVal interface{}, err error) {
+	log.Tracef("prepareField: for %s", f.name)
+	switch f.tip {
+	case FTArray:
+		if v.IsNil() {
+			fldVal = nil
+		} else {
+			fldVal, err = s.fillArray(f.elem, v)
+		}
+	case FTBool:
+		fldVal = 0
+		if v.Bool() {
+			fldVal = 1
+		}
+	case FTByteArray:
+	case FTDate:
+		fldVal = formatDate(*v)
+	case FTMap:
+		if v.IsNil() {
+			fldVal = nil
+		} else {
+			fldVal, err = s.fillDict(f.elem, v)
+		}
+	case FTComplex:
+		if v.IsNil() {
+			fldVal = nil
+		} else {
+			fldVal, err = s.fillMap(f.elem, v)
+		}
+	case FTPointer:
+		elem := v.Elem()
+		return s.toObject(f.elem, &elem)
+	case FTHelper:
+		meth := parent.MethodByName("GetValue")
+		if !meth.IsValid() {
+			if parent.Kind() == reflect.Ptr {
+				meth = parent.Elem().MethodByName("GetValue")
+			} else {
+				meth = parent.Addr().MethodByName("GetValue")
+			}
+		}
+		if meth.IsValid() {
+			result := meth.Call([]reflect.Value{reflect.ValueOf(f.name)})
+			if len(result) > 1 && !result[1].IsNil() {
+				err = result[1].Interface().(error)
+				fldVal = nil
+				return
+			}
+			switch result[0].Kind() {
+			case reflect.Struct:
+				desc, err := s.findDescriptor(result[0].Type())
+				if err != nil {
+					return nil, err
+				}
+				fldVal, err = s.toObject(desc, &result[0])
+			default:
+				fldVal = result[0].Interface()
+			}
+
+		} else {
+			err = errors.New("Can't find method 'GetValue' for type " + parent.Type().Name())
+		}
+	default:
+		err = nil
+		log.Tracef("prepareField: going to call interface for %s; value: %+v", f.name, v)
+
+		fldVal = v.Interface()
+
+	}
+	log.Tracef("prepareField: for %s: exiting", f.name)
+	return
+}
+
+func (s *storage) putField(f *field, v *reflect.Value, fldVal interface{}, parent *reflect.Value) (err error) {
+	log.Tracef("putField: for %s", f.name)
+	if fldVal == nil {
+		log.Tracef("putField: for %s: value is nil, skipping", f.name)
+		return
+	}
+	switch f.tip {
+	case FTArray:
+		err = s.fromArray(f.elem, v, fldVal.([]interface{}))
+	case FTBool:
+		val, ok := fldVal.(int)
+		if num, isNum := fldVal.(float64); isNum {
+			// numbers come as float64 from JSON
+			val, ok = int(num), true
+		}
+		if ok {
+			b := false
+			if val == 1 {
+				b = true
+			}
+			log.Tracef("putField: setting bool value %v for %s", val, f.name)
+			v.SetBool(b)
+		} else {
+			log.Warnf("putField: can't put bool value from $+v", fldVal)
+		}
+	case FTInt, FTFloat:
+		numb, ok := fldVal.(float64)
+		if !ok {
+			log.Warnf("putField: can't get number from %+v", fldVal)
+		}
+		if f.tip == FTInt {
+			log.Tracef("putField: setting int value %f for %s", numb, f.name)
+			v.SetInt(int64(numb))
+		} else {
+			log.Tracef("putField: setting float value %f for %s", numb, f.name)
+			v.SetFloat(numb)
+		}
+
+	case FTByteArray:
+	case FTDate:
+		str, ok := fldVal.(string)
+		if !ok {
+			log.Warnf("putField: can't get date from %+v", fldVal)
+			return
+		}
+		err = parseDate(*v, str)
+	case FTMap:
+		dict, ok := fldVal.(map[string]interface{})
+		if !ok {
+			log.Warnf("putField: can't get map from %+v", fldVal)
+			return
+		}
+		err = s.fromDict(f.elem, v, dict)
+	case FTComplex:
+		err = s.fromMap(f.elem, v, fldVal.(map[string]interface{}))
+	case FTPointer:
+		val := reflect.New((*f.rtype).Elem())
+		v.Set(val.Addr())
+		log.Tracef("putField: dereferencing pointer for %s", f.name)
+		return s.fromObject(f.elem, &val, fldVal)
+	case FTHelper:
+		meth := parent.MethodByName("SetValue")
+		getMeth := parent.MethodByName("GetValue")
+		if !meth.IsValid() {
+			if parent.Kind() == reflect.Ptr {
+				meth = parent.Elem().MethodByName("SetValue")
+				getMeth = parent.Elem().MethodByName("GetValue")
+			} else {
+				meth = parent.Addr().MethodByName("SetValue")
+				getMeth = parent.Addr().MethodByName("GetValue")
+			}
+		}
+		if meth.IsValid() && getMeth.IsValid() {
+			log.Tracef("putField: calling GetValue for %s", f.name)
+			buff := getMeth.Call([]reflect.Value{reflect.ValueOf(f.name)})
+			if len(buff) > 1 && !buff[1].IsNil() {
+				err = buff[1].Interface().(error)
+				return
+			}
+			var result []reflect.Value
+			switch buff[0].Kind() {
+			case reflect.Struct:
+				desc, err := s.findDescriptor(buff[0].Type())
+				if err != nil {
+					return err
+				}
+				val := reflect.New(reflect.TypeOf(buff[0]))
+				log.Tracef("putField: calling fromObject for %s", f.name)
+				err = s.fromObject(desc, v, val.Interface())
+				log.Tracef("putField: calling the helper for %s", f.name)
+				result = meth.Call([]reflect.Value{reflect.ValueOf(f.name), val})
+			default:
+				log.Tracef("putField: calling the helper for %s", f.name)
+				result = meth.Call([]reflect.Value{reflect.ValueOf(f.name), reflect.ValueOf(fldVal)})
+			}
+			if len(result) > 0 && !result[0].IsNil() {
+				err = result[0].Interface().(error)
+			}
+		} else {
+			log.Warnf("putField: method 'GetValue' not found for type %s (field %s)", parent.Type().Name(), f.name)
+			err = errors.New("Can't find method 'GetValue' for type " + parent.Type().Name())
+		}
+	default:
+		err = nil
+		log.Tracef("putField: setting value from interface %v for %s", fldVal, f.name)
+		// if fldVal != nil {
+		v.Set(reflect.ValueOf(fldVal))
+		// }
+	}
+	log.Tracef("putField: for %s: exiting; error: %+v", f.name, err)
+	return
+}
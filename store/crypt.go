@@ -0,0 +1,241 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+)
+
+// cEncryptedPrefix starts stored values of encrypted fields; it is followed by the key id, ':' and base64 of nonce and sealed value;
+// plain values starting with it (stored when there are no keys) get the empty key id, so every stored value
+// with the prefix and non-empty key id is encrypted whatever the user puts to the field
+const cEncryptedPrefix = "enc:"
+
+// cPlainPrefix starts plain values escaped with the empty key id
+const cPlainPrefix = cEncryptedPrefix + ":"
+
+// ErrNoEncryptionKey is returned when the value is encrypted with the key that is not configured
+var ErrNoEncryptionKey = errors.New("encryption key is not configured")
+
+// keyring keeps keys for encrypted fields; the current one is used for encryption and all of them for decryption
+type keyring struct {
+	mux     sync.RWMutex
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// parseKeys parses the list of keys in the form "id:base64key,id:base64key"; the first key is the current one;
+// keys should be 16, 24 or 32 bytes long (AES-128, AES-192 or AES-256)
+func parseKeys(keys string) (current string, aeads map[string]cipher.AEAD, err error) {
+	aeads = map[string]cipher.AEAD{}
+	for _, k := range strings.Split(keys, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		parts := strings.SplitN(k, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return "", nil, errors.New("store: encryption key should be in form id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return "", nil, errors.New("store: invalid encryption key " + parts[0] + ": " + err.Error())
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return "", nil, errors.New("store: invalid encryption key " + parts[0] + ": " + err.Error())
+		}
+		if aeads[parts[0]], err = cipher.NewGCM(block); err != nil {
+			return "", nil, err
+		}
+		if current == "" {
+			current = parts[0]
+		}
+	}
+	return current, aeads, nil
+}
+
+// SetEncryptionKeys sets keys for fields with 'encrypted' tag in the form "id:base64key,id:base64key";
+// the first key is used for encryption and all of them for decryption, so the key is rotated by putting the new one first
+// (see Reencrypt); values are stored as plain text if there are no keys
+func (s *Store) SetEncryptionKeys(keys string) error {
+	current, aeads, err := parseKeys(keys)
+	if err != nil {
+		return err
+	}
+	s.st.keys.mux.Lock()
+	defer s.st.keys.mux.Unlock()
+	s.st.keys.current, s.st.keys.aeads = current, aeads
+	return nil
+}
+
+// Reencrypt rewrites records of the types of given values having encrypted fields with the current key
+// (values stored as plain text are encrypted as well) and rebuilds their indexes; returns the number of rewritten records
+func (s *Store) Reencrypt(types ...interface{}) (int, error) {
+	count := 0
+	for _, t := range types {
+		desc, err := s.st.getDescriptor(t)
+		if err != nil {
+			return count, err
+		}
+		if !desc.encrypted {
+			continue
+		}
+		err = s.db.update(func(db backend) error {
+			l, ok := db.(loader)
+			if !ok {
+				return errors.New("store: re-encryption is not supported by the backend")
+			}
+			recs, _, err := db.ListRecords(desc, Filter{})
+			if err != nil {
+				return err
+			}
+			for _, rec := range recs {
+				// listed records are decrypted
+				if err = s.st.sealFields(desc, rec.obj.(map[string]interface{})); err != nil {
+					return err
+				}
+				if err = l.restore(desc, rec.key, rec.obj); err != nil {
+					return err
+				}
+			}
+			count += len(recs)
+			return nil
+		})
+		if err == nil {
+			err = s.rebuildIndexes(desc)
+		}
+		if err != nil {
+			log.Warnf("Reencrypt: problem while re-encrypting %s: %v", desc.name, err)
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// encrypt returns the stored form of the plain value v; it is v itself if there are no keys
+// (escaped with the empty key id if it looks like the encrypted one)
+func (k *keyring) encrypt(v string) (string, error) {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+	if k.current == "" {
+		if strings.HasPrefix(v, cEncryptedPrefix) {
+			return cPlainPrefix + v, nil
+		}
+		return v, nil
+	}
+	aead := k.aeads[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(v), nil)
+	return cEncryptedPrefix + k.current + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt returns the value of stored v; v is returned as is if it is not encrypted
+func (k *keyring) decrypt(v string) (string, error) {
+	if !strings.HasPrefix(v, cEncryptedPrefix) {
+		return v, nil
+	}
+	if strings.HasPrefix(v, cPlainPrefix) {
+		return strings.TrimPrefix(v, cPlainPrefix), nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(v, cEncryptedPrefix), ":", 2)
+	k.mux.RLock()
+	aead, ok := k.aeads[parts[0]]
+	k.mux.RUnlock()
+	if !ok || len(parts) != 2 {
+		return "", ErrNoEncryptionKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("store: invalid encrypted value")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// reseal returns the stored form of the stored value v for the current keys: encrypted v is kept as is
+// (it may be encrypted with the key that is not configured) and plain one is encrypted
+func (k *keyring) reseal(v string) (string, error) {
+	if strings.HasPrefix(v, cEncryptedPrefix) && !strings.HasPrefix(v, cPlainPrefix) {
+		return v, nil
+	}
+	plain, err := k.decrypt(v)
+	if err != nil {
+		return "", err
+	}
+	return k.encrypt(plain)
+}
+
+// sealFields encrypts in place values of encrypted fields of obj (including nested ones) before it is stored
+func (s *storage) sealFields(desc *storable, obj map[string]interface{}) error {
+	return cryptFields(desc, obj, s.keys.encrypt)
+}
+
+// resealFields converts in place values of encrypted fields of obj which is in the stored form (e.g. dumped one)
+// to the form it should be stored in with the current keys
+func (s *storage) resealFields(desc *storable, obj map[string]interface{}) error {
+	return cryptFields(desc, obj, s.keys.reseal)
+}
+
+// openFields decrypts in place values of encrypted fields of stored obj (including nested ones)
+func (s *storage) openFields(desc *storable, obj map[string]interface{}) error {
+	return cryptFields(desc, obj, s.keys.decrypt)
+}
+
+func cryptFields(desc *storable, obj map[string]interface{}, fn func(string) (string, error)) error {
+	if !desc.encrypted {
+		return nil
+	}
+	for _, f := range desc.fields {
+		val, ok := obj[f.accessor]
+		if !ok || val == nil {
+			continue
+		}
+		if f.flags&FFEncrypted != 0 {
+			if str, ok := val.(string); ok {
+				var err error
+				if obj[f.accessor], err = fn(str); err != nil {
+					return errors.New("store: " + desc.name + "." + f.name + ": " + err.Error())
+				}
+			}
+			continue
+		}
+		if f.elem == nil || f.elem.kind != reflect.Struct || !f.elem.encrypted {
+			continue
+		}
+		nested := []interface{}{val}
+		switch v := val.(type) {
+		case []interface{}:
+			nested = v
+		case map[string]interface{}:
+			if f.tip == FTMap {
+				nested = nested[:0]
+				for _, el := range v {
+					nested = append(nested, el)
+				}
+			}
+		}
+		for _, el := range nested {
+			if m, ok := el.(map[string]interface{}); ok {
+				if err := cryptFields(f.elem, m, fn); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+type testSecret struct {
+	ID    string
+	Login string `store:"index,unique"`
+	Email string `store:"encrypted"`
+}
+
+func testKey(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+// storedEmail returns the value of Email as it is stored
+func storedEmail(t *testing.T, s *Store, key string) string {
+	t.Helper()
+	found := ""
+	err := s.db.(dumper).dump(func(object string, k string, obj interface{}) error {
+		if object == "testSecret" && k == key {
+			found, _ = obj.(map[string]interface{})["Email"].(string)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestEncryptedFields(t *testing.T) {
+	values := []string{"a@b.c", "enc:foo", "enc:k1:AAAA", "enc::x", ""}
+	for _, kind := range []string{"memory", "bolt"} {
+		for _, keys := range []string{"", testKey("k1", 1)} {
+			s := openTestStore(t, kind, "", t.TempDir()+"/test.bolt")
+			if err := s.SetEncryptionKeys(keys); err != nil {
+				t.Fatal(err)
+			}
+			for i, v := range values {
+				key := string(rune('a' + i))
+				if err := s.CreateRecord(key, &testSecret{ID: key, Login: key, Email: v}); err != nil {
+					t.Fatalf("%s: %q: %v", kind, v, err)
+				}
+				got := &testSecret{}
+				if ok, err := s.GetRecord(key, got); !ok || err != nil || got.Email != v {
+					t.Errorf("%s (keys %q): %q is read as %q: %v", kind, keys, v, got.Email, err)
+				}
+				stored := storedEmail(t, s, key)
+				if keys != "" && v != "" && (!strings.HasPrefix(stored, "enc:k1:") || strings.Contains(stored, v)) {
+					t.Errorf("%s: %q is stored as %q", kind, v, stored)
+				}
+			}
+		}
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	for _, kind := range []string{"memory", "bolt"} {
+		s := openTestStore(t, kind, "", t.TempDir()+"/test.bolt")
+		s.CreateRecord("plain", &testSecret{ID: "plain", Login: "p", Email: "enc:plain"})
+		s.SetEncryptionKeys(testKey("k1", 1))
+		s.CreateRecord("old", &testSecret{ID: "old", Login: "o", Email: "old@x"})
+		if err := s.SetEncryptionKeys(testKey("k2", 2) + "," + testKey("k1", 1)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := s.Reencrypt(testSecret{})
+		if err != nil || n != 2 {
+			t.Fatalf("%s: re-encrypted %d: %v", kind, n, err)
+		}
+		for key, email := range map[string]string{"plain": "enc:plain", "old": "old@x"} {
+			if stored := storedEmail(t, s, key); !strings.HasPrefix(stored, "enc:k2:") {
+				t.Errorf("%s: %s is stored as %q", kind, key, stored)
+			}
+			got := &testSecret{}
+			s.GetRecord(key, got)
+			if got.Email != email {
+				t.Errorf("%s: %s is read as %q", kind, key, got.Email)
+			}
+		}
+		// the old key is not needed any more
+		s.SetEncryptionKeys(testKey("k2", 2))
+		items, err := s.ListRecords(Filter{Field: "Login", Value: "o"}, []testSecret{})
+		if got := items.([]testSecret); err != nil || len(got) != 1 || got[0].Email != "old@x" {
+			t.Errorf("%s: indexed lookup after re-encryption %v: %v", kind, got, err)
+		}
+	}
+}
+
+func TestImportEncrypted(t *testing.T) {
+	src := openTestStore(t, "memory", "", "")
+	src.CreateRecord("plain", &testSecret{ID: "plain", Login: "p", Email: "enc:foo"})
+	src.SetEncryptionKeys(testKey("k1", 1))
+	src.CreateRecord("sealed", &testSecret{ID: "sealed", Login: "s", Email: "s@x"})
+	buf := &bytes.Buffer{}
+	if _, err := src.Export(buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "s@x") {
+		t.Fatal("encrypted value is exported as plain text")
+	}
+	for _, b := range testBackends {
+		dst := b.open(t)
+		dst.SetEncryptionKeys(testKey("k1", 1))
+		if _, err := dst.Import(bytes.NewReader(buf.Bytes()), testSecret{}); err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		for key, email := range map[string]string{"plain": "enc:foo", "sealed": "s@x"} {
+			got := &testSecret{}
+			if ok, err := dst.GetRecord(key, got); !ok || err != nil || got.Email != email {
+				t.Errorf("%s: imported %s is read as %q: %v", b.name, key, got.Email, err)
+			}
+		}
+	}
+}
+
+type testIndexedSecret struct {
+	ID    string
+	Email string `store:"index,encrypted"`
+}
+
+type testNestedSecret struct {
+	ID     string
+	Secret testIndexedSecret
+}
+
+func TestEncryptedIndexIsRejected(t *testing.T) {
+	s := openTestStore(t, "memory", "", "")
+	for _, v := range []interface{}{&testIndexedSecret{ID: "a"}, &testNestedSecret{ID: "a"}} {
+		if err := s.CreateRecord("a", v); err == nil || !strings.Contains(err.Error(), "can't be indexed") {
+			t.Errorf("%T is stored: %v", v, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// cDateFormat is the form dates are stored in; being fixed length and in UTC it is ordered the same way as dates are
+const cDateFormat = "2006-01-02T15:04:05.000000000Z07:00"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// isDate checks if t is time.Time or pointer to it
+func isDate(t reflect.Type) bool {
+	return t == timeType || t.Kind() == reflect.Ptr && t.Elem() == timeType
+}
+
+// formatDate returns the stored form of time.Time (or *time.Time) v; zero and nil dates are stored as nil
+func formatDate(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	t := v.Interface().(time.Time)
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(cDateFormat)
+}
+
+// parseDate sets time.Time (or *time.Time) v from its stored form
+func parseDate(v reflect.Value, stored string) error {
+	t, err := time.Parse(time.RFC3339Nano, stored)
+	if err != nil {
+		return err
+	}
+	if v.Kind() == reflect.Ptr {
+		v.Set(reflect.ValueOf(&t))
+	} else {
+		v.Set(reflect.ValueOf(t))
+	}
+	return nil
+}
+
+// dateOperand converts filter operand for date field to the stored form; it may be time.Time,
+// string in RFC3339 format or number of seconds since unix epoch
+func dateOperand(f *field, v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case time.Time:
+		return val.UTC().Format(cDateFormat), nil
+	case *time.Time:
+		if val != nil {
+			return val.UTC().Format(cDateFormat), nil
+		}
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, val)
+		if err != nil {
+			return nil, errors.New("invalid date value for field " + f.name + ": " + val)
+		}
+		return t.UTC().Format(cDateFormat), nil
+	default:
+		if n, ok := numberValue(v); ok {
+			return time.Unix(int64(n), 0).UTC().Format(cDateFormat), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid date value for field %s: %v", f.name, v)
+}
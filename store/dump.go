@@ -0,0 +1,250 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+// dumpRecord is one line of the dump written by Export
+type dumpRecord struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	// Group is the group of the journal entry (Type is the journal with cJournalPrefix and Key is the owner then)
+	Group int `json:"group,omitempty"`
+	// Record is the record as it is stored: JSON object for structs and string for strings; the entry itself for journals
+	Record interface{} `json:"record"`
+}
+
+// dumper is implemented by backends which can walk all the stored records without knowing their types
+type dumper interface {
+	// dump calls fn for every stored record (except service ones) within one read transaction
+	dump(fn func(object string, key string, obj interface{}) error) error
+}
+
+// loader is implemented by backends which can store records in the form they are dumped
+type loader interface {
+	// restore puts the record obj in the stored form (values of encrypted fields are as they are stored)
+	// without maintaining indexes; they should be rebuilt afterwards
+	restore(desc *storable, key string, obj interface{}) error
+}
+
+// Export writes all the records of the store to w as NDJSON: one object with type, key and record per line;
+// schema versions of types go first as records of type _schema with the type as the key;
+// journal entries go after records with journal_ prefixed type, the owner as the key and the group;
+// returns the number of written records and entries
+func (s *Store) Export(w io.Writer) (int, error) {
+	d, ok := s.db.(dumper)
+	if !ok {
+		return 0, errors.New("store: export is not supported by the backend")
+	}
+	enc := json.NewEncoder(w)
+	if err := s.exportSchema(enc); err != nil {
+		log.Warnf("Export: problem while exporting schema versions: %v", err)
+		return 0, err
+	}
+	count := 0
+	err := d.dump(func(object string, key string, obj interface{}) error {
+		count++
+		return enc.Encode(&dumpRecord{Type: object, Key: key, Record: obj})
+	})
+	if jd, ok := s.db.(journalDumper); ok && err == nil {
+		err = jd.dumpEntries(func(journal string, owner string, group int, d []byte) error {
+			count++
+			return enc.Encode(&dumpRecord{Type: cJournalPrefix + journal, Key: owner, Group: group, Record: json.RawMessage(d)})
+		})
+	}
+	if err != nil {
+		log.Warnf("Export: problem while exporting the store: %v", err)
+	}
+	return count, err
+}
+
+// exportSchema writes stored schema versions of types with registered migrations
+func (s *Store) exportSchema(enc *json.Encoder) error {
+	keeper, ok := s.db.(schemaKeeper)
+	if !ok {
+		return nil
+	}
+	migrationsMux.Lock()
+	objects := make([]string, 0, len(migrations))
+	for object := range migrations {
+		objects = append(objects, object)
+	}
+	migrationsMux.Unlock()
+	sort.Strings(objects)
+	for _, object := range objects {
+		version, err := keeper.schemaValue(object)
+		if err != nil {
+			return err
+		}
+		if version == "" {
+			continue
+		}
+		if err = enc.Encode(&dumpRecord{Type: cSchemaBucket, Key: object, Record: version}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import loads records written by Export within one transaction and rebuilds indexes of loaded types;
+// types are values of all the types the dump may contain (the same as for RebuildIndexes);
+// schema versions are restored as well so records of older versions are converted by the next Migrate;
+// journals of owners found in the dump are replaced with dumped entries;
+// returns the number of loaded records and entries
+func (s *Store) Import(r io.Reader, types ...interface{}) (int, error) {
+	descs := map[string]*storable{}
+	for _, t := range types {
+		desc, err := s.st.getDescriptor(t)
+		if err != nil {
+			return 0, err
+		}
+		descs[desc.name] = desc
+	}
+	loaded := map[string]*storable{}
+	// dropped are journals of owners which were cleared before their first dumped entry
+	dropped := map[string]bool{}
+	count := 0
+	err := s.db.update(func(db backend) error {
+		l, ok := db.(loader)
+		if !ok {
+			return errors.New("store: import is not supported by the backend")
+		}
+		dec := json.NewDecoder(r)
+		for {
+			rec := dumpRecord{}
+			err := dec.Decode(&rec)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if rec.Type == cSchemaBucket {
+				if err = restoreSchema(db, rec); err != nil {
+					return err
+				}
+				continue
+			}
+			if strings.HasPrefix(rec.Type, cJournalPrefix) {
+				if err = restoreEntry(db, rec, dropped); err != nil {
+					return err
+				}
+				count++
+				continue
+			}
+			desc, ok := descs[rec.Type]
+			if base, archived := descs[strings.TrimPrefix(rec.Type, cArchivePrefix)]; !ok && archived {
+				desc, ok = s.st.archiveDescriptor(base), true
+			}
+			if !ok {
+				return errors.New("store: unknown type in dump: " + rec.Type)
+			}
+			if err = checkDumped(desc, rec); err != nil {
+				return err
+			}
+			if err = l.restore(desc, rec.Key, rec.Record); err != nil {
+				return err
+			}
+			loaded[desc.name] = desc
+			count++
+		}
+	})
+	if err != nil {
+		log.Warnf("Import: problem while importing the store: %v", err)
+		return 0, err
+	}
+	for _, desc := range loaded {
+		if err = s.rebuildIndexes(desc); err != nil {
+			log.Warnf("Import: problem while rebuilding indexes of %s: %v", desc.name, err)
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// restoreSchema puts the dumped schema version of the type to the schema bucket
+func restoreSchema(db backend, rec dumpRecord) error {
+	version, ok := rec.Record.(string)
+	if !ok {
+		return errors.New("store: invalid dumped schema version of " + rec.Key)
+	}
+	stored, err := strconv.Atoi(version)
+	if err != nil {
+		return err
+	}
+	if err = checkSchemaVersion(rec.Key, stored, SchemaVersion(rec.Key)); err != nil {
+		return err
+	}
+	keeper, ok := db.(schemaKeeper)
+	if !ok {
+		log.Warnf("Import: schema versions are not kept by the backend; skipping the one of %s", rec.Key)
+		return nil
+	}
+	return keeper.setSchemaValue(rec.Key, version)
+}
+
+// restoreEntry appends the dumped entry to its journal; the journal of the owner is cleared before its first entry
+func restoreEntry(db backend, rec dumpRecord, dropped map[string]bool) error {
+	j, ok := db.(journaler)
+	if !ok {
+		return errNoJournals
+	}
+	journal := strings.TrimPrefix(rec.Type, cJournalPrefix)
+	if key := journalKey(journal, rec.Key, -1); !dropped[key] {
+		if err := j.dropJournal(journal, rec.Key); err != nil {
+			return err
+		}
+		dropped[key] = true
+	}
+	d, err := json.Marshal(rec.Record)
+	if err != nil {
+		return err
+	}
+	return j.appendEntry(journal, rec.Key, rec.Group, d)
+}
+
+// checkDumped validates the form of the dumped record against its descriptor
+func checkDumped(desc *storable, rec dumpRecord) error {
+	var ok bool
+	switch desc.kind {
+	case reflect.Struct:
+		_, ok = rec.Record.(map[string]interface{})
+	case reflect.String:
+		_, ok = rec.Record.(string)
+	}
+	if !ok {
+		return errors.New("store: invalid dumped record " + rec.Type + "." + rec.Key)
+	}
+	return nil
+}
+
+// dumpedValue converts the stored data of object to the form it is dumped in
+func (s *storage) dumpedValue(object string, d []byte) (interface{}, error) {
+	desc := s.descriptorByName(object)
+	if desc != nil && desc.kind != reflect.Struct || desc == nil && (len(d) == 0 || d[0] != '{') {
+		return string(d), nil
+	}
+	obj := map[string]interface{}{}
+	err := json.Unmarshal(d, &obj)
+	return obj, err
+}
+
+// storedValue converts the dumped record to the form it is stored in; plain values of encrypted fields are encrypted
+func (s *storage) storedValue(desc *storable, obj interface{}) ([]byte, error) {
+	if desc.kind != reflect.Struct {
+		str, _ := obj.(string)
+		return []byte(str), nil
+	}
+	if err := s.resealFields(desc, obj.(map[string]interface{})); err != nil {
+		return nil, err
+	}
+	return json.Marshal(obj)
+}
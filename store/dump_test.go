@@ -0,0 +1,41 @@
+package store
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	for _, from := range testBackends {
+		src := from.open(t)
+		fillItems(t, src)
+		src.AppendEntry("moves", "i1", 2, map[string]int{"n": 1})
+		buf := &bytes.Buffer{}
+		n, err := src.Export(buf)
+		if err != nil || n != 11 {
+			t.Fatalf("%s: exported %d: %v", from.name, n, err)
+		}
+		for _, to := range testBackends {
+			dst := to.open(t)
+			if n, err = dst.Import(bytes.NewReader(buf.Bytes()), testItem{}); err != nil || n != 11 {
+				t.Fatalf("%s to %s: imported %d: %v", from.name, to.name, n, err)
+			}
+			items, err := dst.ListRecords(Filter{Field: "Score", Value: 3}, []testItem{})
+			if err != nil {
+				t.Fatalf("%s to %s: %v", from.name, to.name, err)
+			}
+			if got := itemIDs(items.([]testItem)); !reflect.DeepEqual(got, []string{"i3", "i7"}) {
+				t.Errorf("%s to %s: indexed lookup got %v", from.name, to.name, got)
+			}
+			it := &testItem{}
+			if ok, _ := dst.GetRecord("i6", it); !ok || it.Name != "N6" || it.Ver != 1 {
+				t.Errorf("%s to %s: imported %+v", from.name, to.name, it)
+			}
+			entries, _ := dst.ReadEntries("moves", "i1", 2, []map[string]int{})
+			if got := entries.([]map[string]int); len(got) != 1 || got[0]["n"] != 1 {
+				t.Errorf("%s to %s: imported entries %v", from.name, to.name, got)
+			}
+		}
+	}
+}
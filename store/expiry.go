@@ -0,0 +1,99 @@
+package store
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// Expiry selects stale records: ones matching Filter which Field (unix time or date) is set and older than TTL
+type Expiry struct {
+	Field  string
+	TTL    time.Duration
+	Filter Filter
+	// Archive makes the store move expired records to the archive (see ListArchived) instead of deleting them
+	Archive bool
+}
+
+const cArchivePrefix = "archive_"
+
+// Expire removes (or archives) records of the type of buffer selected with e within one transaction;
+// returns removed records in the slice of the same type as buffer
+func (s *Store) Expire(buffer interface{}, e Expiry) (interface{}, error) {
+	desc, err := s.st.getDescriptor(buffer)
+	if err != nil {
+		return nil, err
+	}
+	f := desc.topField(e.Field)
+	if f == nil || !isNumeric(f) && f.tip != FTDate {
+		return nil, errors.New("store: expiry field should be numeric or date: " + e.Field)
+	}
+	var bound, unset interface{} = time.Now().Add(-e.TTL), time.Time{}
+	if isNumeric(f) {
+		bound, unset = time.Now().Add(-e.TTL).Unix(), int64(0)
+	}
+	// records without the time are not expired; soft deleted ones are expired only if e.Filter asks for them
+	filter := Filter{And: []Filter{{Field: e.Field, Op: FOGt, Value: unset}, {Field: e.Field, Op: FOLt, Value: bound}, e.Filter},
+		Flags: e.Filter.Flags & FFWithDeleted}
+	var expired interface{}
+	err = s.Update(func(tx Tx) error {
+		a := tx.(*access)
+		page, err := a.ListPage(filter, buffer)
+		if err != nil {
+			return err
+		}
+		items := reflect.ValueOf(page.Items)
+		for i := 0; i < items.Len(); i++ {
+			c, _ := decodeCursor(page.Cursors[i])
+			if e.Archive {
+				rec := items.Index(i)
+				if rec.Kind() != reflect.Ptr {
+					rec = rec.Addr()
+				}
+				if err = a.putRecord(c.key, s.st.archiveDescriptor(desc), rec.Interface()); err != nil {
+					return err
+				}
+			}
+			if err = a.DeleteRecord(desc.name, c.key); err != nil {
+				return err
+			}
+		}
+		expired = page.Items
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Expire: problem while expiring %s: %v", desc.name, err)
+		return nil, err
+	}
+	return expired, nil
+}
+
+// ListArchived returns archived records of the type of buffer the same way as ListPage does
+func (s *access) ListArchived(filter Filter, buffer interface{}) (*Page, error) {
+	desc, err := s.st.getDescriptor(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return s.listPage(s.st.archiveDescriptor(desc), filter, buffer)
+}
+
+// archiveDescriptor returns the descriptor archived records of desc are stored with; they are indexed the same way
+// but unique constraints and versions are not maintained
+func (s *storage) archiveDescriptor(desc *storable) *storable {
+	name := cArchivePrefix + desc.name
+	if st := s.descriptorByName(name); st != nil {
+		return st
+	}
+	st := &storable{name: name, kind: desc.kind, rtype: desc.rtype, fields: make([]*field, len(desc.fields)), encrypted: desc.encrypted}
+	for i, f := range desc.fields {
+		af := *f
+		af.flags &^= FFUnique | FFVersion
+		st.fields[i] = &af
+	}
+	DescriptorsAccessGuard.Lock()
+	defer DescriptorsAccessGuard.Unlock()
+	s.objects[name] = st
+	return st
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+type testSession struct {
+	ID   string
+	Seen int64 `store:"index"`
+}
+
+type testVisit struct {
+	ID string
+	At time.Time
+}
+
+func TestExpire(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	for _, b := range testBackends {
+		s := b.open(t)
+		for id, seen := range map[string]int64{"old": old.Unix(), "fresh": time.Now().Unix(), "unset": 0} {
+			s.CreateRecord(id, &testSession{ID: id, Seen: seen})
+		}
+		expired, err := s.Expire([]testSession{}, Expiry{Field: "Seen", TTL: time.Hour, Archive: true})
+		if got := expired.([]testSession); err != nil || len(got) != 1 || got[0].ID != "old" {
+			t.Errorf("%s: expired %v: %v", b.name, got, err)
+		}
+		items, _ := s.ListRecords(Filter{}, []testSession{})
+		ids := []string{}
+		for _, it := range items.([]testSession) {
+			ids = append(ids, it.ID)
+		}
+		sort.Strings(ids)
+		if !reflect.DeepEqual(ids, []string{"fresh", "unset"}) {
+			t.Errorf("%s: records after expiry %v", b.name, ids)
+		}
+		archived, err := s.ListArchived(Filter{}, []testSession{})
+		if got := archived.Items.([]testSession); err != nil || len(got) != 1 || got[0].Seen != old.Unix() {
+			t.Errorf("%s: archived %v: %v", b.name, got, err)
+		}
+
+		for id, at := range map[string]time.Time{"old": old, "fresh": time.Now(), "unset": {}} {
+			s.CreateRecord(id, &testVisit{ID: id, At: at})
+		}
+		expired, err = s.Expire([]testVisit{}, Expiry{Field: "At", TTL: time.Hour})
+		if got := expired.([]testVisit); err != nil || len(got) != 1 || got[0].ID != "old" {
+			t.Errorf("%s: expired by date %v: %v", b.name, got, err)
+		}
+	}
+}
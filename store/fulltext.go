@@ -0,0 +1,194 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// cFullTextSuffix is added to the index name of the field to get the name of its full-text index
+const cFullTextSuffix = "#fulltext"
+
+// tokenField describes entries of full-text indexes: tokens are lower-cased already and many records may have the same one
+var tokenField = &field{name: "token", tip: FTString}
+
+// textSearcher is implemented by backends keeping full-text indexes; records of other ones are scanned
+type textSearcher interface {
+	// searchRecords returns records having tokens starting with any of terms in full-text fields of desc
+	// and the number of all the records of desc; it only reads, so ok is false if some of the indexes
+	// were not built yet (an absent index is not the empty one) and records should be scanned
+	searchRecords(desc *storable, terms []string) (recs []record, total int, ok bool, err error)
+	// ensureFullText builds absent full-text indexes of desc
+	ensureFullText(desc *storable) error
+}
+
+// SearchResult is the result of Search
+type SearchResult struct {
+	// Items is a slice of the same type as the buffer passed to Search ordered by relevance
+	Items interface{}
+	// Scores contains relevance of every item
+	Scores []float64
+}
+
+type searchHit struct {
+	rec   record
+	score float64
+}
+
+func fullTextIndexName(objName string, fieldName string) string {
+	return getIndexName(objName, fieldName) + cFullTextSuffix
+}
+
+// tokenize splits text to lower-cased words (sequences of letters and digits)
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// distinctTokens returns words of text without repetitions
+func distinctTokens(text string) []string {
+	seen := map[string]bool{}
+	ret := []string{}
+	for _, t := range tokenize(text) {
+		if !seen[t] {
+			seen[t] = true
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Search returns up to limit records (all of them if limit is 0) of the type of buffer having words of query
+// (or words starting with them) in fields with 'fulltext' tag; records are ordered by relevance
+// and returned in the slice of the same type as buffer; soft deleted records are not returned
+func (s *access) Search(query string, limit int, buffer interface{}) (*SearchResult, error) {
+	desc, err := s.st.getDescriptor(buffer)
+	if err != nil {
+		return nil, err
+	}
+	arr := reflect.ValueOf(buffer)
+	if arr.Kind() != reflect.Slice {
+		return nil, errors.New("Search arg should be a slice")
+	}
+	if len(desc.fullText) == 0 {
+		return nil, errors.New("store: there are no full-text fields in " + desc.name)
+	}
+	defer catch(desc)
+	res := &SearchResult{Scores: []float64{}}
+	terms := distinctTokens(query)
+	if len(terms) == 0 {
+		res.Items = arr.Interface()
+		return res, nil
+	}
+	var recs []record
+	total := 0
+	indexed := false
+	// indexes are built by SyncIndexes (or RebuildIndexes), so Search doesn't write;
+	// full-text indexes built for other fields of the type can't be used until then
+	if ts, ok := s.db.(textSearcher); ok && s.indexesInSync(desc) {
+		if recs, total, indexed, err = ts.searchRecords(desc, terms); err != nil {
+			return nil, err
+		}
+	}
+	if !indexed {
+		// soft deleted records are counted in total as they are with indexes; rankRecords skips them
+		if recs, _, err = s.db.ListRecords(desc, Filter{Flags: FFWithDeleted}); err != nil {
+			return nil, err
+		}
+		total = len(recs)
+	}
+	hits := rankRecords(desc, terms, recs, total)
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	for _, h := range hits {
+		val := reflect.New(arr.Type().Elem())
+		if err = s.st.fromObject(desc, &val, h.rec.obj); err != nil {
+			return nil, err
+		}
+		arr = reflect.Append(arr, val.Elem())
+		res.Scores = append(res.Scores, h.score)
+	}
+	res.Items = arr.Interface()
+	return res, nil
+}
+
+// rankRecords scores records matching terms: every term adds its weight in the field it fits best
+// multiplied by its rarity among total records (recs should contain all the records having any of terms);
+// the whole word weighs twice as much as the beginning of one and matches in short fields weigh more than in long ones
+func rankRecords(desc *storable, terms []string, recs []record, total int) []searchHit {
+	weights := make([]map[string]float64, len(recs))
+	frequency := map[string]int{}
+	for i, rec := range recs {
+		obj, ok := rec.obj.(map[string]interface{})
+		if !ok || isDeletedObject(desc, obj) {
+			continue
+		}
+		w := map[string]float64{}
+		for _, f := range desc.fullText {
+			str, _ := obj[f.accessor].(string)
+			tokens := tokenize(str)
+			if len(tokens) == 0 {
+				continue
+			}
+			norm := 1 / math.Sqrt(float64(len(tokens)))
+			for _, term := range terms {
+				tw := 0.0
+				for _, t := range tokens {
+					if t == term {
+						tw += 1
+					} else if strings.HasPrefix(t, term) {
+						tw += 0.5
+					}
+				}
+				if tw*norm > w[term] {
+					w[term] = tw * norm
+				}
+			}
+		}
+		for term := range w {
+			frequency[term]++
+		}
+		weights[i] = w
+	}
+	hits := []searchHit{}
+	for i, w := range weights {
+		score := 0.0
+		for term, tw := range w {
+			score += tw * math.Log(1+float64(total)/float64(frequency[term]))
+		}
+		if score > 0 {
+			hits = append(hits, searchHit{rec: recs[i], score: score})
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].rec.key < hits[j].rec.key
+	})
+	return hits
+}
+
+// indexesInSync checks if indexes of desc are built for its current indexed fields
+func (s *access) indexesInSync(desc *storable) bool {
+	keeper, ok := s.db.(schemaKeeper)
+	if !ok {
+		return true
+	}
+	stored, err := keeper.schemaValue(desc.name + cIndexSignatureSuffix)
+	return err == nil && stored == indexSignature(desc)
+}
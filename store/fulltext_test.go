@@ -0,0 +1,68 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+type testProfile struct {
+	ID      string
+	Name    string `store:"fulltext"`
+	Bio     string `store:"fulltext"`
+	Deleted int64  `store:"deleted"`
+}
+
+func TestSearch(t *testing.T) {
+	profiles := []testProfile{
+		{ID: "a", Name: "Alice Smith", Bio: "plays chess"},
+		{ID: "b", Name: "Bob Smithson"},
+		{ID: "c", Name: "Carol Jones", Bio: "likes smith's songs"},
+		{ID: "d", Name: "Dan Jones"},
+	}
+	for i := 0; i < 6; i++ {
+		profiles = append(profiles, testProfile{ID: fmt.Sprintf("x%d", i), Name: "somebody else"})
+	}
+	for _, b := range testBackends {
+		s := b.open(t)
+		for i := range profiles {
+			if err := s.CreateRecord(profiles[i].ID, &profiles[i]); err != nil {
+				t.Fatalf("%s: %v", b.name, err)
+			}
+		}
+		s.SoftDeleteRecord("testProfile", "d")
+		// records are scanned until indexes are built and found with indexes after that
+		scanned, err := s.Search("smith jones", 0, []testProfile{})
+		if err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		if _, err = s.SyncIndexes(testProfile{}); err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		res, err := s.Search("smith jones", 2, []testProfile{})
+		if err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		got := res.Items.([]testProfile)
+		if len(got) != 2 || got[0].ID != "c" || got[1].ID != "a" {
+			t.Fatalf("%s: found %v", b.name, got)
+		}
+		// the rarity of terms is counted among all the records (including deleted ones), not only found ones
+		want := math.Log(1+10/3.0)/2 + math.Log(1+10/1.0)/math.Sqrt(2)
+		if math.Abs(res.Scores[0]-want) > 1e-9 {
+			t.Errorf("%s: score %v, want %v", b.name, res.Scores[0], want)
+		}
+		for i := range res.Scores {
+			if res.Scores[i] != scanned.Scores[i] {
+				t.Errorf("%s: scores with indexes %v differ from scanned ones %v", b.name, res.Scores, scanned.Scores)
+				break
+			}
+		}
+		if res, _ = s.Search("smiths", 0, []testProfile{}); len(res.Scores) != 1 || res.Items.([]testProfile)[0].ID != "b" {
+			t.Errorf("%s: found by prefix %v", b.name, res.Items)
+		}
+		if res, _ = s.Search("dan", 0, []testProfile{}); len(res.Scores) != 0 {
+			t.Errorf("%s: deleted record is found", b.name)
+		}
+	}
+}
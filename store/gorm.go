@@ -1,25 +1,1018 @@
 package store
 
-// import (
-// 	log "github.com/cihub/seelog"
-// 	"github.com/jinzhu/gorm"
-// 	_ "github.com/jinzhu/gorm/dialects/sqlite"
-// )
-
-// type gormDB struct {
-// 	gorm *gorm.DB
-// }
-
-// func initGorm(dbType string, dbName string) (*gormDB, error) {
-// 	log.Tracef("gorm: going to open db %s/%s", dbType, dbName)
-// 	db, err := gorm.Open(dbType, dbName)
-// 	if err == nil {
-// 		return &gormDB{db}, nil
-// 	}
-// 	log.Warnf("gorm: problem while opening db: %v", err)
-// 	return nil, err
-// }
-
-// func (g *gormDB) stopGorm() {
-// 	g.gorm.Close()
-// }
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// gormDB keeps every storable in its own table: one column per top level field,
+// scalar fields as is and helper, complex, array and pointer fields as JSON;
+// case insensitive fields are compared and ordered with LOWER and indexed with NOCASE collation
+// which fold only ASCII letters in SQLite, so other letters are compared case sensitively there
+type gormDB struct {
+	gorm *gorm.DB
+	*storage
+	tables    map[string]bool
+	tablesMux sync.Mutex
+	// parent is set for the db view used within update; gorm is the transaction then
+	parent *gormDB
+}
+
+const (
+	cKeyColumn   = "store_key"
+	cValueColumn = "store_value"
+)
+
+func init() {
+	registerBackend("gorm", SKGorm, func(dbType string, dbName string, st *storage) (backend, error) {
+		db, err := initGorm(dbType, dbName, st)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	})
+}
+
+func initGorm(dbType string, dbName string, st *storage) (*gormDB, error) {
+	log.Tracef("gorm: going to open db %s/%s", dbType, dbName)
+	db, err := gorm.Open(dbType, dbName)
+	if err == nil {
+		// errors are logged by the store itself
+		db.LogMode(false)
+		return &gormDB{gorm: db, storage: st, tables: map[string]bool{}}, nil
+	}
+	log.Warnf("gorm: problem while opening db: %v", err)
+	return nil, err
+}
+
+func (g *gormDB) stop() {
+	if g.parent == nil {
+		g.gorm.Close()
+	}
+}
+
+// update runs fn with the view of the db bound to the transaction; tables created within it
+// become known to the db only after commit
+func (g *gormDB) update(fn func(db backend) error) (err error) {
+	if g.parent != nil {
+		return fn(g)
+	}
+	tx := g.gorm.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	view := &gormDB{gorm: tx, storage: g.storage, tables: map[string]bool{}, parent: g}
+	g.tablesMux.Lock()
+	for t := range g.tables {
+		view.tables[t] = true
+	}
+	g.tablesMux.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+	if err = fn(view); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit().Error; err != nil {
+		return err
+	}
+	g.tablesMux.Lock()
+	defer g.tablesMux.Unlock()
+	for t := range view.tables {
+		g.tables[t] = true
+	}
+	return nil
+}
+
+func (g *gormDB) ListRecords(desc *storable, filter Filter) ([]record, bool, error) {
+	err := g.ensureTable(desc)
+	if err != nil {
+		return nil, false, err
+	}
+	query := "SELECT " + g.columnsList(desc) + " FROM " + g.quote(desc.name)
+	conds := []string{}
+	args := []interface{}{}
+	if where, whereArgs, ok := g.whereClause(desc, filter); ok {
+		conds = append(conds, where)
+		args = whereArgs
+	}
+	var c *cursor
+	if filter.After != "" {
+		c, _ = decodeCursor(filter.After)
+	}
+	f := desc.topField(filter.SortBy)
+	// sql can't order by encrypted column so the page is selected from all the matching records;
+	// it is selected by sql itself if sql selects exactly the matching records
+	sqlOrdered := f == nil || f.flags&FFEncrypted == 0
+	sqlPaged := sqlOrdered && g.exactWhere(desc, filter)
+	if sqlPaged && c != nil {
+		cond, condArgs := g.cursorCondition(desc, filter, c)
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY " + g.orderBy(desc, filter)
+	if sqlPaged && (filter.Limit > 0 || filter.Offset > 0) {
+		// one more record tells if there is the next page
+		limit := int64(math.MaxInt64)
+		if filter.Limit > 0 {
+			limit = int64(filter.Limit) + 1
+		}
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, filter.Offset)
+	}
+	log.Tracef("ListRecords: query: %s; args: %v", query, args)
+	rows, err := g.gorm.Raw(query, args...).Rows()
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	if !sqlOrdered {
+		recs := []record{}
+		for rows.Next() {
+			key, obj, err := g.scanRow(desc, rows)
+			if err != nil {
+				return nil, false, err
+			}
+			if rec := (record{key: key, obj: obj}); matchRecord(desc, filter, rec) {
+				recs = append(recs, rec)
+			}
+		}
+		recs, hasNext := pageRecords(desc, filter, recs)
+		return recs, hasNext, rows.Err()
+	}
+	if sqlPaged {
+		// the offset and the cursor are applied by sql already
+		filter.Offset, c = 0, nil
+	}
+	p := newPager(filter)
+	for rows.Next() {
+		key, obj, err := g.scanRow(desc, rows)
+		if err != nil {
+			return nil, false, err
+		}
+		rec := record{key: key, obj: obj}
+		if !matchRecord(desc, filter, rec) || !afterCursor(desc, filter, c, rec) {
+			continue
+		}
+		if !p.add(rec) {
+			break
+		}
+	}
+	return p.items, p.hasNext, rows.Err()
+}
+
+func (g *gormDB) GetRecord(key string, desc *storable, rec interface{}) (bool, error) {
+	err := g.ensureTable(desc)
+	if err != nil {
+		return false, err
+	}
+	query := "SELECT " + g.columnsList(desc) + " FROM " + g.quote(desc.name) + " WHERE " + g.quote(cKeyColumn) + " = ?"
+	rows, err := g.gorm.Raw(query, key).Rows()
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return false, rows.Err()
+	}
+	_, obj, err := g.scanRow(desc, rows)
+	if err != nil {
+		return false, err
+	}
+	val := reflect.ValueOf(rec)
+	switch desc.kind {
+	case reflect.Struct:
+		err = g.fromObject(desc, &val, obj)
+	case reflect.String:
+		strPtr, ok := rec.(*string)
+		if ok {
+			*strPtr, _ = obj.(string)
+		} else {
+			log.Warnf("GetRecord: can't put string to %v", val.Type())
+		}
+	}
+	return true, err
+}
+
+func (g *gormDB) PutRecord(key string, desc *storable, rec interface{}) error {
+	log.Tracef("PutRecord: for key %s and descriptor %+v", key, *desc)
+	return g.update(func(db backend) error {
+		return db.(*gormDB).putRecord(key, desc, rec)
+	})
+}
+
+// putRecord saves the record; should be called within the transaction;
+// the stored record is looked up first as RowsAffected of UPDATE is 0 for unchanged rows in some databases (MySQL)
+func (g *gormDB) putRecord(key string, desc *storable, rec interface{}) error {
+	err := g.ensureTable(desc)
+	if err != nil {
+		return err
+	}
+	columns, values, err := g.rowValues(desc, rec)
+	if err != nil {
+		return err
+	}
+	version, versioned := recordVersion(desc, rec)
+	exists, stored, err := g.storedVersion(desc, key)
+	if err != nil {
+		return err
+	}
+	if versioned {
+		if stored != version {
+			log.Debugf("PutRecord: %s: stored version %d of %s differs from %d", desc.name, stored, key, version)
+			return ErrConflict
+		}
+		for i, c := range columns {
+			if c == desc.version.accessor {
+				values[i] = version + 1
+			}
+		}
+	}
+	var res *gorm.DB
+	if exists {
+		sets := make([]string, len(columns))
+		for i, c := range columns {
+			sets[i] = g.quote(c) + " = ?"
+		}
+		where := g.quote(cKeyColumn) + " = ?"
+		whereArgs := []interface{}{key}
+		if versioned {
+			// the record may be changed by another transaction since it was looked up
+			where += " AND COALESCE(" + g.quote(desc.version.accessor) + ", 0) = ?"
+			whereArgs = append(whereArgs, version)
+		}
+		res = g.gorm.Exec("UPDATE "+g.quote(desc.name)+" SET "+strings.Join(sets, ", ")+" WHERE "+where,
+			append(values, whereArgs...)...)
+		if res.Error == nil && versioned && res.RowsAffected == 0 {
+			log.Debugf("PutRecord: %s: record %s was changed concurrently", desc.name, key)
+			return ErrConflict
+		}
+	} else {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)+1), ", ")
+		quoted := make([]string, len(columns))
+		for i, c := range columns {
+			quoted[i] = g.quote(c)
+		}
+		res = g.gorm.Exec("INSERT INTO "+g.quote(desc.name)+" ("+g.quote(cKeyColumn)+", "+strings.Join(quoted, ", ")+") VALUES ("+placeholders+")",
+			append([]interface{}{key}, values...)...)
+		if res.Error != nil && versioned {
+			if ok, _, err := g.storedVersion(desc, key); err == nil && ok {
+				log.Debugf("PutRecord: %s: record %s was created concurrently", desc.name, key)
+				return ErrConflict
+			}
+		}
+	}
+	if res.Error != nil {
+		log.Warnf("PutRecord: problem found while saving the record: %+v", res.Error)
+		return g.translateError(res.Error)
+	}
+	return nil
+}
+
+// storedVersion checks if the record with key exists and returns its version (0 if desc has no version field)
+func (g *gormDB) storedVersion(desc *storable, key string) (exists bool, version int64, err error) {
+	column := "1"
+	if desc.version != nil {
+		column = "COALESCE(" + g.quote(desc.version.accessor) + ", 0)"
+	}
+	var v int64
+	err = g.gorm.Raw("SELECT "+column+" FROM "+g.quote(desc.name)+" WHERE "+g.quote(cKeyColumn)+" = ?", key).Row().Scan(&v)
+	if err == sql.ErrNoRows {
+		return false, 0, nil
+	}
+	if err != nil || desc.version == nil {
+		return err == nil, 0, err
+	}
+	return true, v, nil
+}
+
+func (g *gormDB) DeleteRecord(object string, key string) error {
+	log.Tracef("DeleteRecord: for key %s and object type %s", key, object)
+	if !g.gorm.Dialect().HasTable(object) {
+		return errors.New("invalif object kind: " + object)
+	}
+	return g.gorm.Exec("DELETE FROM "+g.quote(object)+" WHERE "+g.quote(cKeyColumn)+" = ?", key).Error
+}
+
+func (g *gormDB) restore(desc *storable, key string, obj interface{}) error {
+	err := g.ensureTable(desc)
+	if err != nil {
+		return err
+	}
+	columns := []string{cValueColumn}
+	values := []interface{}{obj}
+	if desc.kind == reflect.Struct {
+		if err = g.resealFields(desc, obj.(map[string]interface{})); err != nil {
+			return err
+		}
+		if columns, values, err = objectRow(desc, obj.(map[string]interface{})); err != nil {
+			return err
+		}
+	}
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = g.quote(c)
+	}
+	if err = g.gorm.Exec("DELETE FROM "+g.quote(desc.name)+" WHERE "+g.quote(cKeyColumn)+" = ?", key).Error; err != nil {
+		return err
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)+1), ", ")
+	err = g.gorm.Exec("INSERT INTO "+g.quote(desc.name)+" ("+g.quote(cKeyColumn)+", "+strings.Join(quoted, ", ")+") VALUES ("+placeholders+")",
+		append([]interface{}{key}, values...)...).Error
+	if err != nil {
+		return g.translateError(err)
+	}
+	return nil
+}
+
+// RebuildIndexes drops sql indexes of desc fields and creates them with the current flags of the fields
+func (g *gormDB) RebuildIndexes(desc *storable) error {
+	log.Tracef("RebuildIndexes: for descriptor %s ", desc.name)
+	err := g.ensureTable(desc)
+	if err != nil {
+		return err
+	}
+	if desc.kind == reflect.Struct {
+		dialect := g.gorm.Dialect()
+		for _, f := range desc.fields {
+			indexName := getIndexName(desc.name, f.accessor)
+			if !g.hasIndex(desc.name, indexName) {
+				continue
+			}
+			stmt := "DROP INDEX " + g.quote(indexName)
+			if dialect.GetName() == "mysql" {
+				stmt += " ON " + g.quote(desc.name)
+			}
+			log.Debugf("RebuildIndexes: %s", stmt)
+			if err = g.gorm.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		g.tablesMux.Lock()
+		delete(g.tables, desc.name)
+		g.tablesMux.Unlock()
+		if err = g.ensureTable(desc); err != nil {
+			return err
+		}
+	}
+	if g.gorm.Dialect().GetName() != "sqlite3" {
+		// indexes of other databases are rebuilt by dropping and creating them above
+		return nil
+	}
+	return g.gorm.Exec("REINDEX " + g.quote(desc.name)).Error
+}
+
+// ensureTable creates the table for desc (or adds absent columns) and its indexes
+func (g *gormDB) ensureTable(desc *storable) error {
+	g.tablesMux.Lock()
+	defer g.tablesMux.Unlock()
+	if g.tables[desc.name] {
+		return nil
+	}
+	dialect := g.gorm.Dialect()
+	columns := g.tableColumns(desc)
+	if !dialect.HasTable(desc.name) {
+		defs := []string{g.quote(cKeyColumn) + " VARCHAR(255) PRIMARY KEY"}
+		for _, c := range columns {
+			defs = append(defs, g.quote(c[0])+" "+c[1])
+		}
+		stmt := "CREATE TABLE " + g.quote(desc.name) + " (" + strings.Join(defs, ", ") + ")"
+		log.Debugf("ensureTable: %s", stmt)
+		if err := g.gorm.Exec(stmt).Error; err != nil {
+			return err
+		}
+	} else {
+		for _, c := range columns {
+			if !dialect.HasColumn(desc.name, c[0]) {
+				stmt := "ALTER TABLE " + g.quote(desc.name) + " ADD COLUMN " + g.quote(c[0]) + " " + c[1]
+				log.Debugf("ensureTable: %s", stmt)
+				if err := g.gorm.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if desc.kind == reflect.Struct {
+		for _, f := range desc.fields {
+			if f.flags&FFIndex == 0 {
+				continue
+			}
+			indexName := getIndexName(desc.name, f.accessor)
+			if g.hasIndex(desc.name, indexName) {
+				continue
+			}
+			stmt := "CREATE INDEX "
+			if f.flags&FFUnique != 0 {
+				stmt = "CREATE UNIQUE INDEX "
+			}
+			stmt += g.quote(indexName) + " ON " + g.quote(desc.name) + " (" + g.quote(f.accessor)
+			if f.flags&FFCaseInsensitive != 0 {
+				stmt += " COLLATE NOCASE"
+			}
+			stmt += ")"
+			log.Debugf("ensureTable: %s", stmt)
+			if err := g.gorm.Exec(stmt).Error; err != nil {
+				return g.translateError(err)
+			}
+		}
+		g.logNestedIndexes(desc.name, desc)
+	}
+	g.tables[desc.name] = true
+	return nil
+}
+
+// hasIndex checks if the table has the index; sqlite dialect looks only for indexes created with unquoted names
+func (g *gormDB) hasIndex(table string, index string) bool {
+	dialect := g.gorm.Dialect()
+	if dialect.GetName() != "sqlite3" {
+		return dialect.HasIndex(table, index)
+	}
+	var count int
+	err := g.gorm.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND name = ?", table, index).Row().Scan(&count)
+	if err != nil {
+		log.Warnf("hasIndex: problem while looking for index %s: %v", index, err)
+	}
+	return count > 0
+}
+
+// logNestedIndexes reports indexes that have no own column and so can't be created in sql
+func (g *gormDB) logNestedIndexes(name string, desc *storable) {
+	for _, f := range desc.fields {
+		if f.elem != nil && f.elem.kind == reflect.Struct && f.elem != desc {
+			for _, ef := range f.elem.fields {
+				if ef.flags&FFIndex != 0 {
+					log.Debugf("ensureTable: index on nested field %s.%s.%s is not supported; skipping", name, f.name, ef.name)
+				}
+			}
+		}
+	}
+}
+
+// tableColumns returns pairs of column name and sql type for desc
+func (g *gormDB) tableColumns(desc *storable) [][2]string {
+	if desc.kind != reflect.Struct {
+		return [][2]string{{cValueColumn, "TEXT"}}
+	}
+	ret := make([][2]string, 0, len(desc.fields))
+	for _, f := range desc.fields {
+		var tip string
+		switch f.tip {
+		case FTInt, FTBool:
+			tip = "BIGINT"
+		case FTFloat:
+			tip = "DOUBLE PRECISION"
+		default:
+			tip = "TEXT"
+		}
+		ret = append(ret, [2]string{f.accessor, tip})
+	}
+	return ret
+}
+
+func (g *gormDB) columnsList(desc *storable) string {
+	columns := []string{g.quote(cKeyColumn)}
+	for _, c := range g.tableColumns(desc) {
+		columns = append(columns, g.quote(c[0]))
+	}
+	return strings.Join(columns, ", ")
+}
+
+// rowValues converts the record to the columns values
+func (g *gormDB) rowValues(desc *storable, rec interface{}) (columns []string, values []interface{}, err error) {
+	if desc.kind != reflect.Struct {
+		return []string{cValueColumn}, []interface{}{reflect.Indirect(reflect.ValueOf(rec)).String()}, nil
+	}
+	val := reflect.ValueOf(rec)
+	o, err := g.toObject(desc, &val)
+	if err != nil {
+		return
+	}
+	obj := o.(map[string]interface{})
+	log.Tracef("rowValues: going to save value %+v", obj)
+	if err = g.sealFields(desc, obj); err != nil {
+		return
+	}
+	return objectRow(desc, obj)
+}
+
+// objectRow converts the record in the form it would be marshalled to JSON to the columns values
+func objectRow(desc *storable, obj map[string]interface{}) (columns []string, values []interface{}, err error) {
+	for _, f := range desc.fields {
+		var v interface{}
+		v, err = columnValue(f, obj[f.accessor])
+		if err != nil {
+			return
+		}
+		columns = append(columns, f.accessor)
+		values = append(values, v)
+	}
+	return
+}
+
+// scanRow reads the current row and returns its key and the object as it would be unmarshalled from JSON
+func (g *gormDB) scanRow(desc *storable, rows interface {
+	Scan(dest ...interface{}) error
+}) (key string, obj interface{}, err error) {
+	key, obj, err = g.scanStored(desc, rows)
+	if m, ok := obj.(map[string]interface{}); ok && err == nil {
+		err = g.openFields(desc, m)
+	}
+	return
+}
+
+// scanStored reads the current row like scanRow but leaves values of encrypted fields as they are stored
+func (g *gormDB) scanStored(desc *storable, rows interface {
+	Scan(dest ...interface{}) error
+}) (key string, obj interface{}, err error) {
+	columns := g.tableColumns(desc)
+	vals := make([]interface{}, len(columns)+1)
+	ptrs := make([]interface{}, len(vals))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	err = rows.Scan(ptrs...)
+	if err != nil {
+		return
+	}
+	key = sqlString(vals[0])
+	if desc.kind != reflect.Struct {
+		return key, sqlString(vals[1]), nil
+	}
+	res := map[string]interface{}{}
+	for i, f := range desc.fields {
+		res[f.accessor], err = objectValue(f, vals[i+1])
+		if err != nil {
+			return
+		}
+	}
+	return key, res, nil
+}
+
+// orderBy returns order clause for the filter
+func (g *gormDB) orderBy(desc *storable, filter Filter) string {
+	direction := " ASC"
+	if filter.Desc {
+		direction = " DESC"
+	}
+	order := g.quote(cKeyColumn) + direction
+	if f := desc.topField(filter.SortBy); f != nil && f.flags&FFEncrypted == 0 {
+		column := g.quote(f.accessor)
+		if f.flags&FFCaseInsensitive != 0 {
+			column = "LOWER(" + column + ")"
+		}
+		order = column + direction + ", " + order
+	}
+	return order
+}
+
+// whereClause returns where clause for the filter and its sub filters; conditions that can't be expressed in sql
+// are left out as records are checked with matchRecord anyway; ok is false if there are no conditions at all
+func (g *gormDB) whereClause(desc *storable, filter Filter) (where string, args []interface{}, ok bool) {
+	parts := []string{}
+	if fld := desc.topField(filter.Field); fld != nil {
+		if cond, condArgs, ok := g.fieldCondition(fld, filter); ok {
+			parts = append(parts, cond)
+			args = append(args, condArgs...)
+		}
+	}
+	for _, sub := range filter.And {
+		if cond, condArgs, ok := g.whereClause(desc, sub); ok {
+			parts = append(parts, cond)
+			args = append(args, condArgs...)
+		}
+	}
+	if len(filter.Or) > 0 {
+		alternatives := []string{}
+		altArgs := []interface{}{}
+		for _, sub := range filter.Or {
+			cond, condArgs, ok := g.whereClause(desc, sub)
+			if !ok {
+				alternatives = nil
+				break
+			}
+			alternatives = append(alternatives, cond)
+			altArgs = append(altArgs, condArgs...)
+		}
+		if alternatives != nil {
+			parts = append(parts, "("+strings.Join(alternatives, " OR ")+")")
+			args = append(args, altArgs...)
+		}
+	}
+	if len(parts) == 0 {
+		return "", nil, false
+	}
+	return strings.Join(parts, " AND "), args, true
+}
+
+// exactWhere checks if every condition of the filter is expressed in its where clause, so sql selects exactly
+// the records matchRecord accepts and the page may be selected by sql
+func (g *gormDB) exactWhere(desc *storable, filter Filter) bool {
+	if filter.Field != "" {
+		fld := desc.topField(filter.Field)
+		if fld == nil {
+			return false
+		}
+		if _, _, ok := g.fieldCondition(fld, filter); !ok {
+			return false
+		}
+	}
+	for _, sub := range filter.And {
+		if !g.exactWhere(desc, sub) {
+			return false
+		}
+	}
+	for _, sub := range filter.Or {
+		if !g.exactWhere(desc, sub) {
+			return false
+		}
+	}
+	return true
+}
+
+// cursorCondition returns where clause selecting records following the cursor in the order of orderBy;
+// null values go before all the others as compareValues orders them
+func (g *gormDB) cursorCondition(desc *storable, filter Filter, c *cursor) (string, []interface{}) {
+	op := " > ?"
+	if filter.Desc {
+		op = " < ?"
+	}
+	key := g.quote(cKeyColumn)
+	f := desc.topField(filter.SortBy)
+	if f == nil {
+		return key + op, []interface{}{c.key}
+	}
+	column := g.quote(f.accessor)
+	value := c.value
+	if str, ok := value.(string); ok && f.flags&FFCaseInsensitive != 0 {
+		column = "LOWER(" + column + ")"
+		value = strings.ToLower(str)
+	}
+	if value == nil {
+		if filter.Desc {
+			return column + " IS NULL AND " + key + op, []interface{}{c.key}
+		}
+		return "(" + column + " IS NOT NULL OR " + key + op + ")", []interface{}{c.key}
+	}
+	cond := "(" + column + op + " OR " + column + " = ? AND " + key + op
+	if filter.Desc {
+		cond += " OR " + column + " IS NULL"
+	}
+	return cond + ")", []interface{}{value, value, c.key}
+}
+
+var sqlOperators = map[FilterOp]string{FOEq: " = ?", FOGt: " > ?", FOGe: " >= ?", FOLt: " < ?", FOLe: " <= ?", FOBetween: " BETWEEN ? AND ?"}
+
+// fieldCondition returns where clause and its args for filter on fld; ok is false if the filter can't be expressed in sql
+func (g *gormDB) fieldCondition(fld *field, filter Filter) (where string, args []interface{}, ok bool) {
+	if fld.flags&FFEncrypted != 0 || fld.elem != nil && fld.elem.encrypted {
+		// stored values are encrypted
+		return "", nil, false
+	}
+	column := g.quote(fld.accessor)
+	if filter.Op != FOEq || filter.Value != nil {
+		if !isScalar(fld) {
+			return "", nil, false
+		}
+		args = []interface{}{filter.Value}
+		if filter.Op == FOBetween {
+			args = append(args, filter.To)
+		}
+		if fld.flags&FFCaseInsensitive != 0 && !isNumeric(fld) {
+			column = "LOWER(" + column + ")"
+			for i, a := range args {
+				args[i] = strings.ToLower(a.(string))
+			}
+		}
+		if isNumeric(fld) {
+			// absent numeric value is read as 0 (see matchField)
+			column = "COALESCE(" + column + ", 0)"
+		}
+		return column + sqlOperators[filter.Op], args, true
+	}
+	if !isScalar(fld) && fld.tip != FTHelper {
+		return "", nil, false
+	}
+	mask := filter.Mask
+	if !isScalar(fld) {
+		enc, _ := json.Marshal(mask)
+		mask = string(enc)
+		if filter.Flags&FFSeek != 0 {
+			mask = strings.TrimSuffix(mask, "\"")
+		}
+	}
+	if fld.flags&FFCaseInsensitive != 0 {
+		column = "LOWER(" + column + ")"
+		mask = strings.ToLower(mask)
+	}
+	if filter.Flags&FFSeek != 0 {
+		return "SUBSTR(" + column + ", 1, ?) = ?", []interface{}{len([]rune(mask)), mask}, true
+	}
+	return column + " = ?", []interface{}{mask}, true
+}
+
+func (g *gormDB) quote(name string) string {
+	return g.gorm.Dialect().Quote(name)
+}
+
+func (g *gormDB) translateError(err error) error {
+	if strings.Contains(strings.ToLower(err.Error()), "unique") {
+		log.Debugf("Unique key violation: %v", err)
+		return errors.New("Unique key is violated")
+	}
+	return err
+}
+
+func isScalar(f *field) bool {
+	switch f.tip {
+	case FTInt, FTFloat, FTBool, FTString, FTDate:
+		return true
+	}
+	return false
+}
+
+// columnValue converts value of field got from toObject to the value for sql column
+func columnValue(f *field, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if isScalar(f) {
+		return v, nil
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		log.Warnf("columnValue: problem found while marshalling the field %s: %+v", f.name, err)
+		return nil, err
+	}
+	return string(buf), nil
+}
+
+// objectValue converts value of column to the value as it would be got from JSON
+func objectValue(f *field, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch f.tip {
+	case FTInt, FTFloat, FTBool:
+		switch n := v.(type) {
+		case int64:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		case bool:
+			if n {
+				return float64(1), nil
+			}
+			return float64(0), nil
+		}
+		return nil, errors.New("invalid numeric value for field " + f.name)
+	case FTString, FTDate:
+		return sqlString(v), nil
+	}
+	var res interface{}
+	err := json.Unmarshal([]byte(sqlString(v)), &res)
+	return res, err
+}
+
+func sqlString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	case nil:
+		return ""
+	}
+	log.Warnf("sqlString: unexpected value %+v", v)
+	return ""
+}
+
+// tableNames returns the names of all the tables of the database
+func (g *gormDB) tableNames() ([]string, error) {
+	dialect := g.gorm.Dialect()
+	var rows *sql.Rows
+	var err error
+	if dialect.GetName() == "sqlite3" {
+		rows, err = g.gorm.Raw("SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name").Rows()
+	} else {
+		rows, err = g.gorm.Raw("SELECT table_name FROM information_schema.tables WHERE table_schema = ? ORDER BY table_name",
+			dialect.CurrentDatabase()).Rows()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []string{}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		ret = append(ret, name)
+	}
+	return ret, rows.Err()
+}
+
+// dump walks tables of known types (and their archives); columns of other tables can't be converted to records
+func (g *gormDB) dump(fn func(object string, key string, obj interface{}) error) error {
+	return g.update(func(db backend) error {
+		tx := db.(*gormDB)
+		tables, err := tx.tableNames()
+		if err != nil {
+			return err
+		}
+		for _, table := range tables {
+			if table == cSchemaBucket || strings.HasPrefix(table, cJournalPrefix) {
+				continue
+			}
+			desc := tx.descriptorByName(table)
+			if base := tx.descriptorByName(strings.TrimPrefix(table, cArchivePrefix)); desc == nil && base != nil {
+				desc = tx.archiveDescriptor(base)
+			}
+			if desc == nil {
+				log.Warnf("dump: table %s is not of known type; skipping", table)
+				continue
+			}
+			log.Tracef("dump: walking table %s", table)
+			if err = tx.dumpTable(desc, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (g *gormDB) dumpTable(desc *storable, fn func(object string, key string, obj interface{}) error) error {
+	rows, err := g.gorm.Raw("SELECT " + g.columnsList(desc) + " FROM " + g.quote(desc.name) + " ORDER BY " + g.quote(cKeyColumn)).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		key, obj, err := g.scanStored(desc, rows)
+		if err != nil {
+			return err
+		}
+		if err = fn(desc.name, key, obj); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (g *gormDB) dumpEntries(fn func(journal string, owner string, group int, d []byte) error) error {
+	return g.update(func(db backend) error {
+		tx := db.(*gormDB)
+		tables, err := tx.tableNames()
+		if err != nil {
+			return err
+		}
+		for _, table := range tables {
+			if !strings.HasPrefix(table, cJournalPrefix) {
+				continue
+			}
+			journal := strings.TrimPrefix(table, cJournalPrefix)
+			rows, err := tx.gorm.Raw("SELECT owner, grp, entry FROM " + tx.quote(table) + " ORDER BY owner, grp, seq").Rows()
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var owner, entry string
+				var group int
+				if err = rows.Scan(&owner, &group, &entry); err == nil {
+					err = fn(journal, owner, group, []byte(entry))
+				}
+				if err != nil {
+					rows.Close()
+					return err
+				}
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ensureSchema creates the table of the schema bucket
+func (g *gormDB) ensureSchema() error {
+	g.tablesMux.Lock()
+	defer g.tablesMux.Unlock()
+	if g.tables[cSchemaBucket] || g.gorm.Dialect().HasTable(cSchemaBucket) {
+		g.tables[cSchemaBucket] = true
+		return nil
+	}
+	stmt := "CREATE TABLE " + g.quote(cSchemaBucket) + " (name VARCHAR(255) PRIMARY KEY, value TEXT)"
+	log.Debugf("ensureSchema: %s", stmt)
+	if err := g.gorm.Exec(stmt).Error; err != nil {
+		return err
+	}
+	g.tables[cSchemaBucket] = true
+	return nil
+}
+
+func (g *gormDB) schemaValue(key string) (string, error) {
+	if err := g.ensureSchema(); err != nil {
+		return "", err
+	}
+	var value string
+	err := g.gorm.Raw("SELECT value FROM "+g.quote(cSchemaBucket)+" WHERE name = ?", key).Row().Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func (g *gormDB) setSchemaValue(key string, value string) error {
+	return g.update(func(db backend) error {
+		tx := db.(*gormDB)
+		if err := tx.ensureSchema(); err != nil {
+			return err
+		}
+		if err := tx.gorm.Exec("DELETE FROM "+tx.quote(cSchemaBucket)+" WHERE name = ?", key).Error; err != nil {
+			return err
+		}
+		return tx.gorm.Exec("INSERT INTO "+tx.quote(cSchemaBucket)+" (name, value) VALUES (?, ?)", key, value).Error
+	})
+}
+
+// ensureJournal creates the table of the journal: one row per entry with the owner, the group and the sequence number
+func (g *gormDB) ensureJournal(journal string) (string, error) {
+	table := cJournalPrefix + journal
+	g.tablesMux.Lock()
+	defer g.tablesMux.Unlock()
+	if g.tables[table] || g.gorm.Dialect().HasTable(table) {
+		g.tables[table] = true
+		return table, nil
+	}
+	stmt := "CREATE TABLE " + g.quote(table) + " (owner VARCHAR(255), grp BIGINT, seq BIGINT, entry TEXT, PRIMARY KEY (owner, grp, seq))"
+	log.Debugf("ensureJournal: %s", stmt)
+	if err := g.gorm.Exec(stmt).Error; err != nil {
+		return "", err
+	}
+	g.tables[table] = true
+	return table, nil
+}
+
+func (g *gormDB) appendEntry(journal string, owner string, group int, d []byte) error {
+	return g.update(func(db backend) error {
+		tx := db.(*gormDB)
+		table, err := tx.ensureJournal(journal)
+		if err != nil {
+			return err
+		}
+		var seq int64
+		err = tx.gorm.Raw("SELECT COALESCE(MAX(seq), 0) FROM "+tx.quote(table)+" WHERE owner = ? AND grp = ?", owner, group).Row().Scan(&seq)
+		if err != nil {
+			return err
+		}
+		return tx.gorm.Exec("INSERT INTO "+tx.quote(table)+" (owner, grp, seq, entry) VALUES (?, ?, ?, ?)", owner, group, seq+1, string(d)).Error
+	})
+}
+
+func (g *gormDB) readEntries(journal string, owner string, group int) ([][]byte, error) {
+	table, err := g.ensureJournal(journal)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := g.gorm.Raw("SELECT entry FROM "+g.quote(table)+" WHERE owner = ? AND grp = ? ORDER BY seq", owner, group).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := [][]byte{}
+	for rows.Next() {
+		var d string
+		if err = rows.Scan(&d); err != nil {
+			return nil, err
+		}
+		ret = append(ret, []byte(d))
+	}
+	return ret, rows.Err()
+}
+
+func (g *gormDB) dropJournal(journal string, owner string) error {
+	table, err := g.ensureJournal(journal)
+	if err != nil {
+		return err
+	}
+	return g.gorm.Exec("DELETE FROM "+g.quote(table)+" WHERE owner = ?", owner).Error
+}
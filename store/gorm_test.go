@@ -0,0 +1,31 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestGormPutRecord(t *testing.T) {
+	s := openTestStore(t, "gorm", "sqlite3", t.TempDir()+"/test.db")
+	for i := 0; i < 2; i++ {
+		// the second save doesn't change the row
+		if err := s.CreateRecord("l", &testLegacy{ID: "l", Title: "t"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items, err := s.ListRecords(Filter{}, []testLegacy{})
+	if got := items.([]testLegacy); err != nil || len(got) != 1 || got[0].Title != "t" {
+		t.Errorf("stored %v: %v", got, err)
+	}
+	if err = s.CreateRecord("a", &testItem{ID: "a", Name: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CreateRecord("a", &testItem{ID: "a", Name: "second"}); err != ErrConflict {
+		t.Errorf("versioned record is created over the existing one: %v", err)
+	}
+	if err = s.UpdateRecord("b", &testItem{ID: "b", Ver: 3}); err != ErrConflict {
+		t.Errorf("absent record of version 3 is saved: %v", err)
+	}
+	if err = s.RebuildIndexes(testItem{}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,291 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+// cIndexSignatureSuffix is appended to the type name for the key of its index signature in the schema bucket
+const cIndexSignatureSuffix = "#indexes"
+
+// cIndexFormat is the version of the form of index keys; it is changed with the form, so indexes are rebuilt
+const cIndexFormat = "v2"
+
+// indexSignature lists indexed fields of desc (including nested ones) with their types and index flags
+// after the format of index keys; indexes of the type are to be rebuilt when it changes
+func indexSignature(desc *storable) string {
+	parts := []string{}
+	signFields(&parts, "", desc, map[*storable]bool{})
+	if len(parts) == 0 {
+		return ""
+	}
+	return cIndexFormat + "," + strings.Join(parts, ",")
+}
+
+func signFields(parts *[]string, prefix string, desc *storable, seen map[*storable]bool) {
+	if seen[desc] {
+		return
+	}
+	seen[desc] = true
+	defer delete(seen, desc)
+	for _, f := range desc.fields {
+		if flags := f.flags & (FFIndex | FFUnique | FFCaseInsensitive | FFFullText); flags != 0 {
+			*parts = append(*parts, fmt.Sprintf("%s%s:%d:%d", prefix, f.name, f.tip, flags))
+		}
+		if f.elem != nil && f.elem.kind == reflect.Struct {
+			signFields(parts, prefix+f.name+".", f.elem, seen)
+		}
+	}
+}
+
+// indexEntry is one value of indexed field of the record
+type indexEntry struct {
+	index string
+	field *field
+	value string
+}
+
+// indexEntries walks obj (as it is stored) and returns entries for all its indexed fields including nested ones
+func indexEntries(name string, s *storable, obj map[string]interface{}) []indexEntry {
+	ret := []indexEntry{}
+	for _, f := range s.fields {
+		val, ok := obj[f.accessor]
+		if !ok || val == nil {
+			continue
+		}
+		if f.flags&FFIndex != 0 {
+			switch v := val.(type) {
+			case []interface{}:
+				for _, el := range v {
+					if iv, ok := indexValue(f, el); ok {
+						ret = append(ret, indexEntry{getIndexName(name, f.name), f, iv})
+					}
+				}
+			case map[string]interface{}:
+				// values of map fields are indexed the same way as elements of arrays
+				for _, el := range v {
+					if iv, ok := indexValue(f, el); ok {
+						ret = append(ret, indexEntry{getIndexName(name, f.name), f, iv})
+					}
+				}
+			default:
+				if iv, ok := indexValue(f, v); ok {
+					ret = append(ret, indexEntry{getIndexName(name, f.name), f, iv})
+				} else {
+					log.Warnf("indexEntries: can't process field %s: %+v", f.name, val)
+				}
+			}
+		}
+		if f.flags&FFFullText != 0 {
+			if str, ok := val.(string); ok {
+				for _, t := range distinctTokens(str) {
+					ret = append(ret, indexEntry{fullTextIndexName(name, f.name), tokenField, t})
+				}
+			}
+		}
+		if f.elem == nil || f.elem.kind != reflect.Struct {
+			continue
+		}
+		switch v := val.(type) {
+		case map[string]interface{}:
+			if f.tip != FTMap {
+				ret = append(ret, indexEntries(name+"."+f.name, f.elem, v)...)
+				break
+			}
+			for _, el := range v {
+				if m, ok := el.(map[string]interface{}); ok {
+					ret = append(ret, indexEntries(name+"."+f.name, f.elem, m)...)
+				}
+			}
+		case []interface{}:
+			for _, el := range v {
+				if m, ok := el.(map[string]interface{}); ok {
+					ret = append(ret, indexEntries(name+"."+f.name, f.elem, m)...)
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// indexKey returns the key under which the record with key recKey is kept in the index
+func indexKey(f *field, value string, recKey string) string {
+	idxKey := value
+	if f.flags&FFCaseInsensitive != 0 && !isNumeric(f) {
+		idxKey = strings.ToLower(value)
+	}
+	if f.flags&FFUnique == 0 {
+		idxKey += cNonUniqueIndexDelimiter + recKey
+	}
+	return idxKey
+}
+
+// indexMask returns the prefix of index keys matching the filter
+func indexMask(f *field, filter Filter) string {
+	mask := filter.Mask
+	if f.flags&FFCaseInsensitive != 0 {
+		mask = strings.ToLower(mask)
+	}
+	if f.flags&FFUnique == 0 && filter.Flags&FFSeek == 0 {
+		mask += cNonUniqueIndexDelimiter
+	}
+	return mask
+}
+
+// indexLookup returns keys of records having keys of the index of field f in [from, to); ok is false if there is no such index
+type indexLookup func(f *field, from string, to string) (keys []string, ok bool)
+
+// planKeys selects with indexes keys of records which may satisfy the filter (including sub filters);
+// ok is false if the filter can't be served with indexes and records should be scanned
+func planKeys(desc *storable, filter Filter, lookup indexLookup) ([]string, bool) {
+	var res map[string]bool
+	intersect := func(keys []string) {
+		set := map[string]bool{}
+		for _, k := range keys {
+			if res == nil || res[k] {
+				set[k] = true
+			}
+		}
+		res = set
+	}
+	if f := desc.topField(filter.Field); f != nil && f.flags&FFIndex != 0 {
+		if from, to, ok := indexRange(f, filter); ok {
+			if keys, ok := lookup(f, from, to); ok {
+				intersect(keys)
+			}
+		}
+	}
+	for _, sub := range filter.And {
+		if keys, ok := planKeys(desc, sub, lookup); ok {
+			intersect(keys)
+		}
+	}
+	if len(filter.Or) > 0 {
+		union := []string{}
+		for _, sub := range filter.Or {
+			keys, ok := planKeys(desc, sub, lookup)
+			if !ok {
+				union = nil
+				break
+			}
+			union = append(union, keys...)
+		}
+		if union != nil {
+			intersect(union)
+		}
+	}
+	if res == nil {
+		return nil, false
+	}
+	keys := make([]string, 0, len(res))
+	for k := range res {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, true
+}
+
+// indexRange returns bounds [from, to) of index keys which may satisfy the filter; empty to means there is no upper bound;
+// ok is false if the index can't be used for the filter
+func indexRange(f *field, filter Filter) (from string, to string, ok bool) {
+	if isNumeric(f) || f.tip == FTDate && filter.Op != FOEq {
+		// both numbers and dates are kept in the index in fixed length form
+		value := orderedKey(f, filter.Value)
+		switch filter.Op {
+		case FOEq:
+			if filter.Value == nil {
+				return "", "", false
+			}
+			from, to = value, upperBound(value)
+		case FOGt:
+			from = upperBound(value)
+		case FOGe:
+			from = value
+		case FOLt:
+			to = value
+		case FOLe:
+			to = upperBound(value)
+		case FOBetween:
+			from, to = value, upperBound(orderedKey(f, filter.To))
+		}
+		return from, to, true
+	}
+	if filter.Op != FOEq {
+		return "", "", false
+	}
+	mask := indexMask(f, filter)
+	if f.flags&FFUnique != 0 && filter.Flags&FFSeek == 0 {
+		return mask, mask + "\x00", true
+	}
+	return mask, upperBound(mask), true
+}
+
+// orderedKey returns the form prepared operand v of numeric or date field is kept in the index
+func orderedKey(f *field, v interface{}) string {
+	if isNumeric(f) {
+		n, _ := v.(float64)
+		return encodeNumber(n)
+	}
+	str, _ := v.(string)
+	return str
+}
+
+// inRange checks if index key k is in [from, to)
+func inRange(k string, from string, to string) bool {
+	return k >= from && (to == "" || k < to)
+}
+
+// upperBound returns the least key greater than all the keys with prefix or empty string if there is no one
+func upperBound(prefix string) string {
+	upper := []byte(prefix)
+	for i := len(upper) - 1; i >= 0; i-- {
+		if upper[i] < 0xff {
+			upper[i]++
+			return string(upper[:i+1])
+		}
+	}
+	return ""
+}
+
+// indexValue converts the stored value of the field to the form it is kept in the index
+func indexValue(f *field, val interface{}) (string, bool) {
+	if v, ok := val.(string); ok {
+		return v, true
+	}
+	if n, ok := numberValue(val); ok && isNumeric(f) {
+		return encodeNumber(n), true
+	}
+	return "", false
+}
+
+// encodeNumber encodes v to 8 bytes with the same byte order as numeric one
+func encodeNumber(v float64) string {
+	bits := math.Float64bits(v)
+	if v >= 0 {
+		bits |= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, bits)
+	return string(buf)
+}
+
+func isNumeric(f *field) bool {
+	return f.tip == FTInt || f.tip == FTFloat
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,244 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	log "github.com/cihub/seelog"
+)
+
+// Inspector works on the bolt file directly (without the store) to diagnose and repair it
+type Inspector struct {
+	bolt *bolt.DB
+	st   *storage
+	// descs are descriptors of known types by name
+	descs map[string]*storable
+}
+
+// BucketInfo describes one bucket of the bolt file
+type BucketInfo struct {
+	Name  string
+	Count int
+}
+
+// Kinds of IndexProblem
+const (
+	// IPMissing means the record has no index entry for its value
+	IPMissing = "missing"
+	// IPStale means the index entry points to absent record or to the record that has no such value
+	IPStale = "stale"
+	// IPConflict means the unique index entry for record's value belongs to another record
+	IPConflict = "conflict"
+	// IPDuplicate means several records have the same value of unique field; it can't be repaired automatically
+	IPDuplicate = "duplicate"
+)
+
+// IndexProblem is the inconsistency between index entry and record found by Verify
+type IndexProblem struct {
+	Kind     string
+	Index    string
+	IndexKey string
+	// Key is the key of the record the entry points (or should point) to
+	Key      string
+	Repaired bool
+}
+
+// OpenInspector opens bolt file; types are values of stored types (as for RebuildIndexes) which indexes can be verified;
+// the file is opened read-only unless it is going to be repaired
+func OpenInspector(file string, readOnly bool, types ...interface{}) (*Inspector, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{ReadOnly: readOnly, Timeout: time.Second})
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, errors.New("store: database is locked; is the server running?")
+		}
+		return nil, err
+	}
+	ins := &Inspector{bolt: db, st: newStorage(), descs: map[string]*storable{}}
+	for _, t := range types {
+		desc, err := ins.st.getDescriptor(t)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		ins.descs[desc.name] = desc
+	}
+	return ins, nil
+}
+
+func (ins *Inspector) Close() {
+	ins.bolt.Close()
+}
+
+// Buckets returns all the buckets of the file with number of entries in them
+func (ins *Inspector) Buckets() ([]BucketInfo, error) {
+	ret := []BucketInfo{}
+	err := ins.bolt.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, buck *bolt.Bucket) error {
+			ret = append(ret, BucketInfo{Name: string(name), Count: buck.Stats().KeyN})
+			return nil
+		})
+	})
+	return ret, err
+}
+
+// Dump calls fn for records of object with key (or for all of them if key is empty)
+func (ins *Inspector) Dump(object string, key string, fn func(key string, d []byte) error) error {
+	return ins.bolt.View(func(tx *bolt.Tx) error {
+		buck := tx.Bucket([]byte(object))
+		if buck == nil {
+			return errors.New("store: bucket not found: " + object)
+		}
+		if key != "" {
+			d := buck.Get([]byte(key))
+			if d == nil {
+				return errors.New("store: record not found: " + object + "." + key)
+			}
+			return fn(key, d)
+		}
+		return buck.ForEach(func(k []byte, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+// Verify checks that every index entry points to existing record having such value and every record has
+// entries for all its indexed values; problems that can be fixed are fixed if repair is set
+func (ins *Inspector) Verify(repair bool) ([]IndexProblem, error) {
+	problems := []IndexProblem{}
+	verify := func(tx *bolt.Tx) error {
+		names := []string{}
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+		// expected are index entries of all the records by index name
+		expected := map[string]map[string]string{}
+		known := map[string]bool{}
+		for _, name := range names {
+			desc, ok := ins.descs[name]
+			if !ok || desc.kind != reflect.Struct {
+				continue
+			}
+			known[name] = true
+			found, err := ins.verifyRecords(tx, desc, expected)
+			if err != nil {
+				return err
+			}
+			problems = append(problems, found...)
+		}
+		for _, name := range names {
+			if !strings.HasPrefix(name, cIndexPrefix) {
+				continue
+			}
+			problems = append(problems, ins.verifyIndex(tx, name, known, expected)...)
+		}
+		if repair {
+			return ins.repair(tx, problems)
+		}
+		return nil
+	}
+	var err error
+	if repair {
+		err = ins.bolt.Update(verify)
+	} else {
+		err = ins.bolt.View(verify)
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Index < problems[j].Index })
+	return problems, err
+}
+
+// verifyRecords checks that every record of desc has its index entries and collects them to expected
+func (ins *Inspector) verifyRecords(tx *bolt.Tx, desc *storable, expected map[string]map[string]string) ([]IndexProblem, error) {
+	problems := []IndexProblem{}
+	err := tx.Bucket([]byte(desc.name)).ForEach(func(k []byte, v []byte) error {
+		key := string(k)
+		obj := map[string]interface{}{}
+		if err := json.Unmarshal(v, &obj); err != nil {
+			log.Warnf("Verify: can't unmarshal record %s.%s: %v", desc.name, key, err)
+			return nil
+		}
+		for _, e := range indexEntries(desc.name, desc, obj) {
+			ik := indexKey(e.field, e.value, key)
+			if expected[e.index] == nil {
+				expected[e.index] = map[string]string{}
+			}
+			if prev, ok := expected[e.index][ik]; ok && prev != key {
+				problems = append(problems, IndexProblem{Kind: IPDuplicate, Index: e.index, IndexKey: ik, Key: key})
+				continue
+			}
+			expected[e.index][ik] = key
+			var existing []byte
+			if idx := tx.Bucket([]byte(e.index)); idx != nil {
+				existing = idx.Get([]byte(ik))
+			}
+			switch {
+			case existing == nil:
+				problems = append(problems, IndexProblem{Kind: IPMissing, Index: e.index, IndexKey: ik, Key: key})
+			case string(existing) != key:
+				problems = append(problems, IndexProblem{Kind: IPConflict, Index: e.index, IndexKey: ik, Key: key})
+			}
+		}
+		return nil
+	})
+	return problems, err
+}
+
+// verifyIndex checks that every entry of the index points to the record having such value;
+// for indexes of unknown types only existence of the record is checked
+func (ins *Inspector) verifyIndex(tx *bolt.Tx, index string, known map[string]bool, expected map[string]map[string]string) []IndexProblem {
+	problems := []IndexProblem{}
+	object := strings.SplitN(strings.TrimPrefix(index, cIndexPrefix), ".", 2)[0]
+	records := tx.Bucket([]byte(object))
+	tx.Bucket([]byte(index)).ForEach(func(k []byte, v []byte) error {
+		stale := false
+		if known[object] {
+			key, ok := expected[index][string(k)]
+			stale = !ok || key != string(v)
+		} else {
+			stale = records == nil || records.Get(v) == nil
+		}
+		if stale {
+			problems = append(problems, IndexProblem{Kind: IPStale, Index: index, IndexKey: string(k), Key: string(v)})
+		}
+		return nil
+	})
+	return problems
+}
+
+// repair removes stale entries and then adds missing ones; conflicts are resolved if the entry was stale
+func (ins *Inspector) repair(tx *bolt.Tx, problems []IndexProblem) error {
+	for i, p := range problems {
+		if p.Kind != IPStale {
+			continue
+		}
+		if err := tx.Bucket([]byte(p.Index)).Delete([]byte(p.IndexKey)); err != nil {
+			return err
+		}
+		problems[i].Repaired = true
+	}
+	for i, p := range problems {
+		if p.Kind != IPMissing && p.Kind != IPConflict {
+			continue
+		}
+		idx, err := tx.CreateBucketIfNotExists([]byte(p.Index))
+		if err != nil {
+			return err
+		}
+		existing := idx.Get([]byte(p.IndexKey))
+		if existing != nil && !bytes.Equal(existing, []byte(p.Key)) {
+			log.Warnf("Verify: can't repair %s: entry %s belongs to %s", p.Index, p.IndexKey, existing)
+			continue
+		}
+		if err = idx.Put([]byte(p.IndexKey), []byte(p.Key)); err != nil {
+			return err
+		}
+		problems[i].Repaired = true
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestInspectAndRepair(t *testing.T) {
+	file := t.TempDir() + "/test.bolt"
+	s, err := Open("bolt", "", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillItems(t, s)
+	score := s.st.objects["testItem"].topField("Score")
+	s.Stop()
+
+	// the entry of i3 is lost and the entry of absent record is left
+	db, err := bolt.Open(file, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := getIndexName("testItem", "Score")
+	db.Update(func(tx *bolt.Tx) error {
+		idx := tx.Bucket([]byte(index))
+		idx.Delete([]byte(indexKey(score, encodeNumber(3), "i3")))
+		return idx.Put([]byte(indexKey(score, encodeNumber(1), "gone")), []byte("gone"))
+	})
+	db.Close()
+
+	ins, err := OpenInspector(file, false, testItem{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ins.Close()
+	buckets, err := ins.Buckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range buckets {
+		if b.Name == "testItem" && b.Count != 10 {
+			t.Errorf("bucket testItem has %d records", b.Count)
+		}
+	}
+	dumped := 0
+	if err = ins.Dump("testItem", "i3", func(key string, d []byte) error {
+		dumped++
+		return nil
+	}); err != nil || dumped != 1 {
+		t.Errorf("dumped %d records: %v", dumped, err)
+	}
+	problems, err := ins.Verify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]string{}
+	for _, p := range problems {
+		kinds[p.Key] = p.Kind
+		if p.Repaired {
+			t.Errorf("problem %+v is repaired without repair", p)
+		}
+	}
+	if len(problems) != 2 || kinds["i3"] != IPMissing || kinds["gone"] != IPStale {
+		t.Fatalf("problems %+v", problems)
+	}
+	if problems, err = ins.Verify(true); err != nil || len(problems) != 2 || !problems[0].Repaired || !problems[1].Repaired {
+		t.Fatalf("repaired %+v: %v", problems, err)
+	}
+	if problems, err = ins.Verify(false); err != nil || len(problems) != 0 {
+		t.Errorf("problems after repair %+v: %v", problems, err)
+	}
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"fmt"
 	"sync"
 
 	"reflect"
@@ -26,6 +27,7 @@ const (
 	FTPointer
 	FTComplex
 	FTHelper
+	FTMap
 )
 
 const (
@@ -45,11 +47,19 @@ const (
 	TagIndex           string = "index"
 	TagUnique          string = "unique"
 	TagCaseInsensitive string = "ci"
+	TagVersion         string = "version"
+	TagEncrypted       string = "encrypted"
+	TagDeleted         string = "deleted"
+	TagFullText        string = "fulltext"
 )
 const (
 	FFIndex           = 0x01
 	FFUnique          = 0x02
 	FFCaseInsensitive = 0x04
+	FFVersion         = 0x08
+	FFEncrypted       = 0x10
+	FFDeleted         = 0x20
+	FFFullText        = 0x40
 )
 const (
 	FLEmbeed int = iota
@@ -69,6 +79,8 @@ type field struct {
 	flags    int
 	size     int
 	elem     *storable
+	// index is the path to the field for reflect.Value.FieldByIndex; it is longer than 1 for fields promoted from embedded structs
+	index []int
 }
 
 type storable struct {
@@ -76,16 +88,25 @@ type storable struct {
 	fields []*field
 	kind   reflect.Kind
 	rtype  *reflect.Type
+	// version is the field with record version maintained by the store (if any)
+	version *field
+	// encrypted is set if the type or nested ones have encrypted fields
+	encrypted bool
+	// deleted is the field with the time the record was soft deleted at (if the type supports soft deletion)
+	deleted *field
+	// fullText are top level fields with tokenized index searched by Search
+	fullText []*field
 }
 
 var DescriptorsAccessGuard sync.RWMutex
 
 type storage struct {
 	objects map[string]*storable
+	keys    *keyring
 }
 
 func newStorage() *storage {
-	return &storage{objects: make(map[string]*storable)}
+	return &storage{objects: make(map[string]*storable), keys: &keyring{}}
 }
 
 func (s *storage) getDescriptor(o interface{}) (*storable, error) {
@@ -108,7 +129,11 @@ func (s *storage) findDescriptor(t reflect.Type) (*storable, error) {
 }
 
 func (s *storage) lookForDescriptor(t reflect.Type) *storable {
-	tn := t.Name()
+	return s.descriptorByName(t.Name())
+}
+
+// descriptorByName returns already created descriptor for type name or nil
+func (s *storage) descriptorByName(tn string) *storable {
 	DescriptorsAccessGuard.RLock()
 	defer DescriptorsAccessGuard.RUnlock()
 	st, ok := s.objects[tn]
@@ -124,6 +149,7 @@ func (s *storage) createDescriptor(t reflect.Type) (*storable, error) {
 	log.Tracef("createDescriptor: starting for %s ", tn)
 	switch t.Kind() {
 	case reflect.Struct:
+		promoted := []*field{}
 		for i := 0; i < t.NumField(); i++ {
 			fld := t.Field(i)
 			log.Tracef("createDescriptor: trying to parse tags for %s ", fld.Name)
@@ -147,12 +173,39 @@ func (s *storage) createDescriptor(t reflect.Type) (*storable, error) {
 					if tag.HasOption(TagCaseInsensitive) {
 						flags |= int(FFCaseInsensitive)
 					}
+					if tag.Name == TagVersion || tag.HasOption(TagVersion) {
+						flags |= int(FFVersion)
+					}
+					if tag.Name == TagEncrypted || tag.HasOption(TagEncrypted) {
+						flags |= int(FFEncrypted)
+					}
+					if tag.Name == TagDeleted || tag.HasOption(TagDeleted) {
+						flags |= int(FFDeleted)
+					}
+					if tag.Name == TagFullText || tag.HasOption(TagFullText) {
+						flags |= int(FFFullText)
+					}
+				}
+				if fld.Anonymous && (tag == nil || tag.Name != TagUseHelper) && isEmbeddable(fld.Type) {
+					log.Tracef("createDescriptor: promoting fields of embedded %s", fld.Name)
+					emb, err := s.findDescriptor(fld.Type)
+					if err != nil {
+						return nil, err
+					}
+					for _, ef := range emb.fields {
+						pf := *ef
+						pf.index = append([]int{i}, ef.index...)
+						promoted = append(promoted, &pf)
+					}
+					continue
 				}
-				field := &field{name: fld.Name, accessor: fld.Name, rtype: &fld.Type, flags: flags}
+				field := &field{name: fld.Name, accessor: fld.Name, rtype: &fld.Type, flags: flags, index: []int{i}}
 				if tag != nil && tag.Name == TagUseHelper {
 					log.Tracef("createDescriptor: processing field %s 'helper' tag was found", fld.Name)
 					field.tip = FTHelper
 					field.rtype = &t
+				} else if isDate(fld.Type) {
+					field.tip = FTDate
 				} else {
 					log.Tracef("createDescriptor: processing field %s of type %+v", fld.Name, fld.Type.Kind().String())
 					switch fld.Type.Kind() {
@@ -199,6 +252,19 @@ func (s *storage) createDescriptor(t reflect.Type) (*storable, error) {
 							return nil, err
 						}
 						field.elem = st
+					case reflect.Map:
+						if fld.Type.Key().Kind() != reflect.String {
+							log.Debugf("createDescriptor; ignoring map with non string keys for field %s.%s", fld.Name, tn)
+							continue
+						}
+						field.tip = FTMap
+						tt := fld.Type.Elem()
+						log.Tracef("createDescriptor: found map; looking for type %s ", tt.Name())
+						st, err := s.findDescriptor(tt)
+						if err != nil {
+							return nil, err
+						}
+						field.elem = st
 					case reflect.Ptr:
 						field.tip = FTPointer
 						tt := fld.Type.Elem()
@@ -223,6 +289,41 @@ func (s *storage) createDescriptor(t reflect.Type) (*storable, error) {
 			}
 
 		}
+		st.fields = append(st.fields, promoteFields(tn, st.fields, promoted)...)
+		for _, f := range st.fields {
+			if f.flags&FFEncrypted != 0 {
+				if f.tip != FTString {
+					log.Warnf("createDescriptor: encrypted field %s.%s should be string; ignoring", tn, f.name)
+					f.flags &^= FFEncrypted
+				} else if f.flags&FFIndex != 0 {
+					// encrypted values can't be looked up and plain ones should not be kept in the index
+					return nil, fmt.Errorf("store: encrypted field %s.%s can't be indexed", tn, f.name)
+				}
+			}
+			if f.flags&FFFullText != 0 {
+				if f.tip != FTString || f.flags&FFEncrypted != 0 {
+					log.Warnf("createDescriptor: full-text field %s.%s should be plain string; ignoring", tn, f.name)
+					f.flags &^= FFFullText
+				} else {
+					st.fullText = append(st.fullText, f)
+				}
+			}
+			st.encrypted = st.encrypted || f.flags&FFEncrypted != 0 || f.elem != nil && f.elem.encrypted
+			if f.flags&FFVersion != 0 {
+				if f.tip == FTInt {
+					st.version = f
+				} else {
+					log.Warnf("createDescriptor: version field %s.%s should be integer; ignoring", tn, f.name)
+				}
+			}
+			if f.flags&FFDeleted != 0 {
+				if f.tip == FTInt {
+					st.deleted = f
+				} else {
+					log.Warnf("createDescriptor: deleted field %s.%s should be integer; ignoring", tn, f.name)
+				}
+			}
+		}
 	}
 	log.Tracef("createDescriptor; returning for type %s: %+v", tn, *st)
 	DescriptorsAccessGuard.Lock()
@@ -231,6 +332,60 @@ func (s *storage) createDescriptor(t reflect.Type) (*storable, error) {
 	return st, nil
 }
 
+// isEmbeddable checks if fields of anonymous field of type t should be promoted to the outer struct
+func isEmbeddable(t reflect.Type) bool {
+	if isDate(t) {
+		return false
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// promoteFields selects fields of embedded structs accessible by their names the same way go does:
+// fields of the outer struct hide promoted ones, less nested fields hide more nested ones
+// and ambiguous fields (with the same name and depth) are omitted
+func promoteFields(tn string, own []*field, promoted []*field) []*field {
+	depth := map[string]int{}
+	count := map[string]int{}
+	for _, f := range own {
+		depth[f.name] = len(f.index)
+		count[f.name] = 1
+	}
+	for _, f := range promoted {
+		d, ok := depth[f.name]
+		if !ok || len(f.index) < d {
+			depth[f.name] = len(f.index)
+			count[f.name] = 1
+		} else if len(f.index) == d {
+			count[f.name]++
+		}
+	}
+	ret := []*field{}
+	for _, f := range promoted {
+		if depth[f.name] != len(f.index) {
+			continue
+		}
+		if count[f.name] > 1 {
+			log.Debugf("createDescriptor; ignoring ambiguous promoted field %s.%s", tn, f.name)
+			continue
+		}
+		ret = append(ret, f)
+	}
+	return ret
+}
+
+// topField returns top level field by its name or nil
+func (st *storable) topField(name string) *field {
+	for _, f := range st.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
 func (st *storable) new() reflect.Value {
 	return reflect.New(*st.rtype)
 }
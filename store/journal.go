@@ -0,0 +1,78 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+// cJournalPrefix starts names of buckets (tables) of journals
+const cJournalPrefix = "journal_"
+
+// journaler is implemented by backends keeping journals: append-only sequences of entries of the owner record
+// split into groups (e.g. history of the room by rounds)
+type journaler interface {
+	// appendEntry adds d to the end of the group of the owner's journal
+	appendEntry(journal string, owner string, group int, d []byte) error
+	// readEntries returns entries of the group of the owner's journal in the order they were appended
+	readEntries(journal string, owner string, group int) ([][]byte, error)
+	// dropJournal removes all the entries of the owner's journal
+	dropJournal(journal string, owner string) error
+}
+
+// journalDumper is implemented by journal keeping backends which can walk all the entries of all the journals
+type journalDumper interface {
+	// dumpEntries calls fn for every entry of every journal within one read transaction;
+	// entries of the group come in the order they were appended
+	dumpEntries(fn func(journal string, owner string, group int, d []byte) error) error
+}
+
+var errNoJournals = errors.New("store: journals are not supported by the backend")
+
+// AppendEntry marshals entry to JSON and appends it to the group of the journal of the owner record;
+// journals are kept apart from records, so they are not rewritten when the record is saved
+// and are not removed with the record (see DropJournal); Export writes them after records
+func (s *access) AppendEntry(journal string, owner string, group int, entry interface{}) error {
+	j, ok := s.db.(journaler)
+	if !ok {
+		return errNoJournals
+	}
+	d, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return j.appendEntry(journal, owner, group, d)
+}
+
+// ReadEntries returns entries of the group of the journal of the owner record in the slice of the same type as buffer
+func (s *access) ReadEntries(journal string, owner string, group int, buffer interface{}) (interface{}, error) {
+	arr := reflect.ValueOf(buffer)
+	if arr.Kind() != reflect.Slice {
+		return nil, errors.New("ReadEntries arg should be a slice")
+	}
+	j, ok := s.db.(journaler)
+	if !ok {
+		return nil, errNoJournals
+	}
+	entries, err := j.readEntries(journal, owner, group)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range entries {
+		val := reflect.New(arr.Type().Elem())
+		if err = json.Unmarshal(d, val.Interface()); err != nil {
+			return nil, err
+		}
+		arr = reflect.Append(arr, val.Elem())
+	}
+	return arr.Interface(), nil
+}
+
+// DropJournal removes the journal of the owner record; it should be called when the record is removed for good
+func (s *access) DropJournal(journal string, owner string) error {
+	j, ok := s.db.(journaler)
+	if !ok {
+		return errNoJournals
+	}
+	return j.dropJournal(journal, owner)
+}
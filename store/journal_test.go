@@ -0,0 +1,64 @@
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestJournals(t *testing.T) {
+	for _, b := range testBackends {
+		s := b.open(t)
+		for i, group := range []int{0, 1, 1} {
+			if err := s.AppendEntry("moves", "a", group, map[string]int{"n": i}); err != nil {
+				t.Fatalf("%s: %v", b.name, err)
+			}
+		}
+		s.AppendEntry("moves", "b", 1, map[string]int{"n": 9})
+		entries, err := s.ReadEntries("moves", "a", 1, []map[string]int{})
+		if err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		if got := entries.([]map[string]int); len(got) != 2 || got[0]["n"] != 1 || got[1]["n"] != 2 {
+			t.Errorf("%s: entries %v", b.name, got)
+		}
+		if err = s.DropJournal("moves", "a"); err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		entries, _ = s.ReadEntries("moves", "a", 0, []map[string]int{})
+		if got := entries.([]map[string]int); len(got) != 0 {
+			t.Errorf("%s: entries after drop %v", b.name, got)
+		}
+		entries, _ = s.ReadEntries("moves", "b", 1, []map[string]int{})
+		if got := entries.([]map[string]int); len(got) != 1 {
+			t.Errorf("%s: entries of another owner %v", b.name, got)
+		}
+	}
+}
+
+func TestJournalInUpdate(t *testing.T) {
+	errFailed := errors.New("failed")
+	for _, b := range testBackends {
+		s := b.open(t)
+		for _, fail := range []bool{true, false} {
+			err := s.Update(func(tx Tx) error {
+				if err := tx.CreateRecord("a", &testLegacy{ID: "a", Title: "t"}); err != nil {
+					return err
+				}
+				if err := tx.AppendEntry("moves", "a", 0, map[string]bool{"failed": fail}); err != nil {
+					return err
+				}
+				if fail {
+					return errFailed
+				}
+				return nil
+			})
+			if fail != (err == errFailed) {
+				t.Fatalf("%s: Update returned %v", b.name, err)
+			}
+		}
+		entries, err := s.ReadEntries("moves", "a", 0, []map[string]bool{})
+		if got := entries.([]map[string]bool); err != nil || len(got) != 1 || got[0]["failed"] {
+			t.Errorf("%s: entries %v: %v", b.name, got, err)
+		}
+	}
+}
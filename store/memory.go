@@ -0,0 +1,616 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+)
+
+// memoryDB keeps records as JSON in maps; it is the same as boltDB but without the file
+type memoryDB struct {
+	*storage
+	mux     sync.RWMutex
+	records map[string]map[string]string
+	indexes map[string]*memoryIndex
+	// journals keep entries of journals by journalKey
+	journals map[string][]string
+	// inTx is set for the db view used within update; it shares buckets and indexes with db until they are changed
+	// and is not locked
+	inTx bool
+	// owned are buckets ("r" prefixed) and indexes ("i" prefixed) the view has copied to change them
+	owned map[string]bool
+}
+
+func init() {
+	registerBackend("memory", SKMemory, func(dbType string, dbName string, st *storage) (backend, error) {
+		return initMemory(st), nil
+	})
+}
+
+func initMemory(st *storage) *memoryDB {
+	log.Tracef("store: creating in-memory db")
+	return &memoryDB{
+		storage:  st,
+		records:  map[string]map[string]string{},
+		indexes:  map[string]*memoryIndex{},
+		journals: map[string][]string{},
+	}
+}
+
+func (db *memoryDB) stop() {
+	defer db.lock()()
+	db.records = map[string]map[string]string{}
+	db.indexes = map[string]*memoryIndex{}
+	db.journals = map[string][]string{}
+}
+
+func (db *memoryDB) update(fn func(db backend) error) error {
+	if db.inTx {
+		return fn(db)
+	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	view := &memoryDB{storage: db.storage, records: make(map[string]map[string]string, len(db.records)),
+		indexes: make(map[string]*memoryIndex, len(db.indexes)), journals: make(map[string][]string, len(db.journals)),
+		inTx: true, owned: map[string]bool{}}
+	for name, bucket := range db.records {
+		view.records[name] = bucket
+	}
+	for name, index := range db.indexes {
+		view.indexes[name] = index
+	}
+	// entries are appended to the copy of the slice (see appendEntry) so sharing them is safe
+	for k, entries := range db.journals {
+		view.journals[k] = entries
+	}
+	if err := fn(view); err != nil {
+		return err
+	}
+	db.records, db.indexes, db.journals = view.records, view.indexes, view.journals
+	return nil
+}
+
+// lock locks db for writing and returns the func to unlock it
+func (db *memoryDB) lock() func() {
+	if db.inTx {
+		return func() {}
+	}
+	db.mux.Lock()
+	return db.mux.Unlock
+}
+
+// rlock locks db for reading and returns the func to unlock it
+func (db *memoryDB) rlock() func() {
+	if db.inTx {
+		return func() {}
+	}
+	db.mux.RLock()
+	return db.mux.RUnlock
+}
+
+// bucket returns the bucket of object to be changed creating it if there is no one;
+// the view copies the shared bucket before the first change
+func (db *memoryDB) bucket(object string) map[string]string {
+	bucket, ok := db.records[object]
+	switch {
+	case !ok:
+		bucket = map[string]string{}
+	case db.inTx && !db.owned["r"+object]:
+		c := make(map[string]string, len(bucket))
+		for k, v := range bucket {
+			c[k] = v
+		}
+		bucket = c
+	default:
+		return bucket
+	}
+	db.records[object] = bucket
+	if db.inTx {
+		db.owned["r"+object] = true
+	}
+	return bucket
+}
+
+// index returns the index with name to be changed creating it if there is no one;
+// the view copies the shared index before the first change
+func (db *memoryDB) index(name string) *memoryIndex {
+	index, ok := db.indexes[name]
+	switch {
+	case !ok:
+		index = newMemoryIndex(map[string]string{})
+	case db.inTx && !db.owned["i"+name]:
+		index = index.copy()
+	default:
+		return index
+	}
+	db.setIndex(name, index)
+	return index
+}
+
+// setIndex puts the new index which is owned by db
+func (db *memoryDB) setIndex(name string, index *memoryIndex) {
+	db.indexes[name] = index
+	if db.inTx {
+		db.owned["i"+name] = true
+	}
+}
+
+// memoryIndex keeps index entries with their keys sorted so lookups don't sort the whole index
+type memoryIndex struct {
+	entries map[string]string
+	keys    []string
+}
+
+// newMemoryIndex makes the index of entries sorting their keys once
+func newMemoryIndex(entries map[string]string) *memoryIndex {
+	return &memoryIndex{entries: entries, keys: sortedKeys(entries)}
+}
+
+func (index *memoryIndex) copy() *memoryIndex {
+	c := &memoryIndex{entries: make(map[string]string, len(index.entries)), keys: append([]string{}, index.keys...)}
+	for k, v := range index.entries {
+		c.entries[k] = v
+	}
+	return c
+}
+
+func (index *memoryIndex) get(ik string) (string, bool) {
+	if index == nil {
+		return "", false
+	}
+	k, ok := index.entries[ik]
+	return k, ok
+}
+
+// set puts the entry inserting its key in its place among sorted ones
+func (index *memoryIndex) set(ik string, key string) {
+	if _, ok := index.entries[ik]; !ok {
+		i := sort.SearchStrings(index.keys, ik)
+		index.keys = append(index.keys, "")
+		copy(index.keys[i+1:], index.keys[i:])
+		index.keys[i] = ik
+	}
+	index.entries[ik] = key
+}
+
+func (index *memoryIndex) remove(ik string) {
+	if _, ok := index.entries[ik]; !ok {
+		return
+	}
+	delete(index.entries, ik)
+	i := sort.SearchStrings(index.keys, ik)
+	index.keys = append(index.keys[:i], index.keys[i+1:]...)
+}
+
+// lookup returns record keys of entries in range [from, to) in the order of index keys
+func (index *memoryIndex) lookup(from string, to string) []string {
+	keys := []string{}
+	if index == nil {
+		return keys
+	}
+	for i := sort.SearchStrings(index.keys, from); i < len(index.keys) && inRange(index.keys[i], from, to); i++ {
+		keys = append(keys, index.entries[index.keys[i]])
+	}
+	return keys
+}
+
+func (db *memoryDB) ListRecords(desc *storable, filter Filter) ([]record, bool, error) {
+	defer db.rlock()()
+	bucket := db.records[desc.name]
+	keys, planned := planKeys(desc, filter, func(f *field, from string, to string) ([]string, bool) {
+		return db.indexes[getIndexName(desc.name, f.name)].lookup(from, to), true
+	})
+	if planned {
+		log.Tracef("ListRecords: looking by indexes")
+	} else {
+		keys = sortedKeys(bucket)
+	}
+	recs := []record{}
+	for _, k := range keys {
+		d, ok := bucket[k]
+		if !ok {
+			continue
+		}
+		rec, err := db.decodeRecord(desc, k, []byte(d))
+		if err != nil {
+			return nil, false, err
+		}
+		if matchRecord(desc, filter, rec) {
+			recs = append(recs, rec)
+		}
+	}
+	recs, hasNext := pageRecords(desc, filter, recs)
+	return recs, hasNext, nil
+}
+
+// searchRecords looks for records in full-text indexes: their keys start with the token
+func (db *memoryDB) searchRecords(desc *storable, terms []string) ([]record, int, bool, error) {
+	defer db.rlock()()
+	bucket := db.records[desc.name]
+	recs := []record{}
+	seen := map[string]bool{}
+	for _, f := range desc.fullText {
+		index, ok := db.indexes[fullTextIndexName(desc.name, f.name)]
+		if !ok {
+			return nil, 0, false, nil
+		}
+		for _, ik := range index.keys {
+			k := index.entries[ik]
+			if seen[k] || !hasAnyPrefix(ik, terms) {
+				continue
+			}
+			seen[k] = true
+			d, ok := bucket[k]
+			if !ok {
+				continue
+			}
+			rec, err := db.decodeRecord(desc, k, []byte(d))
+			if err != nil {
+				return nil, 0, false, err
+			}
+			recs = append(recs, rec)
+		}
+	}
+	return recs, len(bucket), true, nil
+}
+
+// ensureFullText builds absent full-text indexes of desc; they are created even if there are no tokens
+// so an absent index always means it was not built
+func (db *memoryDB) ensureFullText(desc *storable) error {
+	defer db.lock()()
+	for _, f := range desc.fullText {
+		name := fullTextIndexName(desc.name, f.name)
+		if _, ok := db.indexes[name]; ok {
+			continue
+		}
+		log.Debugf("ensureFullText: building index %s", name)
+		if err := db.buildIndex(desc, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildIndex fills the index with entries of stored records of desc; should be called under write lock
+func (db *memoryDB) buildIndex(desc *storable, name string) error {
+	index := map[string]string{}
+	for k, d := range db.records[desc.name] {
+		obj := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(d), &obj); err != nil {
+			return err
+		}
+		for _, e := range indexEntries(desc.name, desc, obj) {
+			if e.index == name {
+				index[indexKey(e.field, e.value, k)] = k
+			}
+		}
+	}
+	db.setIndex(name, newMemoryIndex(index))
+	return nil
+}
+
+func (db *memoryDB) GetRecord(key string, desc *storable, rec interface{}) (bool, error) {
+	defer db.rlock()()
+	d, ok := db.records[desc.name][key]
+	if !ok {
+		return false, nil
+	}
+	return true, db.decode(desc, d, reflect.ValueOf(rec))
+}
+
+func (db *memoryDB) PutRecord(key string, desc *storable, rec interface{}) error {
+	log.Tracef("PutRecord: for key %s and descriptor %+v", key, *desc)
+	var buf []byte
+	var obj map[string]interface{}
+	var entries []indexEntry
+	switch desc.kind {
+	case reflect.Struct:
+		val := reflect.ValueOf(rec)
+		o, err := db.toObject(desc, &val)
+		if err != nil {
+			return err
+		}
+		obj = o.(map[string]interface{})
+		entries = indexEntries(desc.name, desc, obj)
+	case reflect.String:
+		buf = []byte(reflect.Indirect(reflect.ValueOf(rec)).String())
+	}
+	defer db.lock()()
+	if obj != nil {
+		var old []byte
+		if d, ok := db.records[desc.name][key]; ok {
+			old = []byte(d)
+		}
+		err := nextVersion(desc, old, rec, obj)
+		if err != nil {
+			return err
+		}
+		if err = db.sealFields(desc, obj); err != nil {
+			return err
+		}
+		buf, err = json.Marshal(obj)
+		if err != nil {
+			log.Warnf("PutRecord: problem found while marshalling the record: %+v", err)
+			return err
+		}
+	}
+	for _, e := range entries {
+		if e.field.flags&FFUnique == 0 {
+			continue
+		}
+		existing, ok := db.indexes[e.index].get(indexKey(e.field, e.value, key))
+		if ok && existing != key {
+			log.Debugf("Unique key violation: %s: %s", e.index, e.value)
+			return errors.New("Unique key is violated")
+		}
+	}
+	bucket := db.bucket(desc.name)
+	if old, ok := bucket[key]; ok {
+		db.dropRecordIndexes(desc, key, old)
+	}
+	for _, e := range entries {
+		db.index(e.index).set(indexKey(e.field, e.value, key), key)
+	}
+	bucket[key] = string(buf)
+	return nil
+}
+
+func (db *memoryDB) DeleteRecord(object string, key string) error {
+	log.Tracef("DeleteRecord: for key %s and object type %s", key, object)
+	defer db.lock()()
+	bucket, ok := db.records[object]
+	if !ok {
+		return errors.New("invalif object kind: " + object)
+	}
+	if old, ok := bucket[key]; ok {
+		if desc := db.descriptorByName(object); desc != nil {
+			db.dropRecordIndexes(desc, key, old)
+		}
+		delete(db.bucket(object), key)
+	}
+	return nil
+}
+
+func (db *memoryDB) RebuildIndexes(desc *storable) error {
+	log.Tracef("RebuildIndexes: for descriptor %s ", desc.name)
+	defer db.lock()()
+	prefix := getIndexName(desc.name, "")
+	for name := range db.indexes {
+		if strings.HasPrefix(name, prefix) {
+			delete(db.indexes, name)
+		}
+	}
+	keys := make([]string, 0, len(db.records[desc.name]))
+	for k := range db.records[desc.name] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	// entries are collected first and sorted once per index
+	built := map[string]map[string]string{}
+	for _, k := range keys {
+		obj := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(db.records[desc.name][k]), &obj); err != nil {
+			return err
+		}
+		for _, e := range indexEntries(desc.name, desc, obj) {
+			index, ok := built[e.index]
+			if !ok {
+				index = map[string]string{}
+				built[e.index] = index
+			}
+			ik := indexKey(e.field, e.value, k)
+			if existing, ok := index[ik]; ok && existing != k {
+				log.Debugf("Unique key violation: %s: %s", e.index, e.value)
+				return errors.New("Unique key is violated")
+			}
+			index[ik] = k
+		}
+	}
+	// full-text indexes are created even if there are no tokens so they are not built again on search
+	for _, f := range desc.fullText {
+		if _, ok := built[fullTextIndexName(desc.name, f.name)]; !ok {
+			built[fullTextIndexName(desc.name, f.name)] = map[string]string{}
+		}
+	}
+	for name, entries := range built {
+		db.setIndex(name, newMemoryIndex(entries))
+	}
+	return nil
+}
+
+// dropRecordIndexes removes index entries of stored record d; should be called under write lock
+func (db *memoryDB) dropRecordIndexes(desc *storable, key string, d string) {
+	if desc.kind != reflect.Struct {
+		return
+	}
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(d), &obj); err != nil {
+		log.Warnf("dropRecordIndexes: can't unmarshal record %s.%s: %v", desc.name, key, err)
+		return
+	}
+	for _, e := range indexEntries(desc.name, desc, obj) {
+		ik := indexKey(e.field, e.value, key)
+		if existing, ok := db.indexes[e.index].get(ik); ok && existing == key {
+			db.index(e.index).remove(ik)
+		}
+	}
+}
+
+func (db *memoryDB) decode(desc *storable, d string, val reflect.Value) error {
+	switch desc.kind {
+	case reflect.Struct:
+		obj := map[string]interface{}{}
+		err := json.Unmarshal([]byte(d), &obj)
+		if err == nil {
+			err = db.openFields(desc, obj)
+		}
+		if err != nil {
+			return err
+		}
+		return db.fromObject(desc, &val, obj)
+	case reflect.String:
+		return db.fromObject(desc, &val, d)
+	}
+	return nil
+}
+
+func (db *memoryDB) dump(fn func(object string, key string, obj interface{}) error) error {
+	defer db.rlock()()
+	objects := make([]string, 0, len(db.records))
+	for object := range db.records {
+		if object != cSchemaBucket {
+			objects = append(objects, object)
+		}
+	}
+	sort.Strings(objects)
+	for _, object := range objects {
+		bucket := db.records[object]
+		for _, k := range sortedKeys(bucket) {
+			obj, err := db.dumpedValue(object, []byte(bucket[k]))
+			if err != nil {
+				return err
+			}
+			if err = fn(object, k, obj); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *memoryDB) restore(desc *storable, key string, obj interface{}) error {
+	buf, err := db.storedValue(desc, obj)
+	if err != nil {
+		return err
+	}
+	defer db.lock()()
+	db.bucket(desc.name)[key] = string(buf)
+	return nil
+}
+
+func (db *memoryDB) migrateObject(object string, to int, convert func(from int, key string, obj map[string]interface{}) error) (migrated bool, err error) {
+	err = db.update(func(b backend) error {
+		view := b.(*memoryDB)
+		schema := view.records[cSchemaBucket]
+		stored := 0
+		if v, ok := schema[object]; ok {
+			var err error
+			if stored, err = strconv.Atoi(v); err != nil {
+				return err
+			}
+		}
+		if err := checkSchemaVersion(object, stored, to); err != nil || stored == to {
+			return err
+		}
+		log.Debugf("migrateObject: migrating %s from version %d to %d", object, stored, to)
+		bucket := view.bucket(object)
+		for _, k := range sortedKeys(bucket) {
+			d, err := view.convertStored(object, []byte(bucket[k]), func(obj map[string]interface{}) error {
+				return convert(stored, k, obj)
+			})
+			if err != nil {
+				return err
+			}
+			bucket[k] = string(d)
+			migrated = true
+		}
+		view.bucket(cSchemaBucket)[object] = strconv.Itoa(to)
+		return nil
+	})
+	return
+}
+
+func (db *memoryDB) schemaValue(key string) (string, error) {
+	defer db.rlock()()
+	return db.records[cSchemaBucket][key], nil
+}
+
+func (db *memoryDB) setSchemaValue(key string, value string) error {
+	defer db.lock()()
+	db.bucket(cSchemaBucket)[key] = value
+	return nil
+}
+
+// journalKey returns the key of entries of the group of the owner's journal; the prefix of keys of all its groups
+// is returned if group is negative
+func journalKey(journal string, owner string, group int) string {
+	key := journal + "\x00" + owner + "\x00"
+	if group >= 0 {
+		key += strconv.Itoa(group)
+	}
+	return key
+}
+
+func (db *memoryDB) appendEntry(journal string, owner string, group int, d []byte) error {
+	defer db.lock()()
+	key := journalKey(journal, owner, group)
+	// entries may be shared with the transaction view so they are never appended in place
+	entries := db.journals[key]
+	db.journals[key] = append(entries[:len(entries):len(entries)], string(d))
+	return nil
+}
+
+func (db *memoryDB) readEntries(journal string, owner string, group int) ([][]byte, error) {
+	defer db.rlock()()
+	ret := [][]byte{}
+	for _, d := range db.journals[journalKey(journal, owner, group)] {
+		ret = append(ret, []byte(d))
+	}
+	return ret, nil
+}
+
+func (db *memoryDB) dropJournal(journal string, owner string) error {
+	defer db.lock()()
+	prefix := journalKey(journal, owner, -1)
+	for k := range db.journals {
+		if strings.HasPrefix(k, prefix) {
+			delete(db.journals, k)
+		}
+	}
+	return nil
+}
+
+func (db *memoryDB) dumpEntries(fn func(journal string, owner string, group int, d []byte) error) error {
+	defer db.rlock()()
+	type groupKey struct {
+		journal string
+		owner   string
+		group   int
+	}
+	groups := make([]groupKey, 0, len(db.journals))
+	for k := range db.journals {
+		parts := strings.SplitN(k, "\x00", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		group, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return err
+		}
+		groups = append(groups, groupKey{parts[0], parts[1], group})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		if a.journal != b.journal {
+			return a.journal < b.journal
+		}
+		if a.owner != b.owner {
+			return a.owner < b.owner
+		}
+		return a.group < b.group
+	})
+	for _, g := range groups {
+		for _, d := range db.journals[journalKey(g.journal, g.owner, g.group)] {
+			if err := fn(g.journal, g.owner, g.group, []byte(d)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/cihub/seelog"
+)
+
+// Migration converts stored record obj of some schema version to the next one in place
+type Migration func(key string, obj map[string]interface{}) error
+
+// migrator is implemented by backends that keep schema versions of stored types
+type migrator interface {
+	// migrateObject converts all the records of object from stored schema version to version to within one transaction
+	// calling convert for every record; returns false if there was nothing to convert
+	migrateObject(object string, to int, convert func(from int, key string, obj map[string]interface{}) error) (bool, error)
+}
+
+// schemaKeeper is implemented by backends that keep schema information of stored types
+// (schema versions and index signatures) in the schema bucket
+type schemaKeeper interface {
+	// schemaValue returns the value kept with key or "" if there is no such one
+	schemaValue(key string) (string, error)
+	setSchemaValue(key string, value string) error
+}
+
+const cSchemaBucket = "_schema"
+
+var (
+	migrations    = map[string]map[int]Migration{}
+	migrationsMux sync.Mutex
+)
+
+// RegisterMigration registers migration of records of type object (the name of go type) from version from to from+1;
+// the latest schema version of the type is the one after its last migration
+func RegisterMigration(object string, from int, m Migration) {
+	migrationsMux.Lock()
+	defer migrationsMux.Unlock()
+	if migrations[object] == nil {
+		migrations[object] = map[int]Migration{}
+	}
+	migrations[object][from] = m
+}
+
+// SchemaVersion returns the latest schema version of type object
+func SchemaVersion(object string) int {
+	migrationsMux.Lock()
+	defer migrationsMux.Unlock()
+	return latestVersion(object)
+}
+
+func latestVersion(object string) int {
+	version := 0
+	for from := range migrations[object] {
+		if from+1 > version {
+			version = from + 1
+		}
+	}
+	return version
+}
+
+// Migrate converts stored records of all the types with registered migrations to their latest schema version;
+// types are values of all the stored types (the same as for RebuildIndexes): their descriptors are needed
+// to decrypt encrypted fields for migrations, so every migrated type should be among them;
+// returns true if some records were converted (and so indexes should be rebuilt)
+func (s *Store) Migrate(types ...interface{}) (bool, error) {
+	for _, t := range types {
+		if _, err := s.st.getDescriptor(t); err != nil {
+			return false, err
+		}
+	}
+	migrationsMux.Lock()
+	defer migrationsMux.Unlock()
+	if len(migrations) == 0 {
+		return false, nil
+	}
+	m, ok := s.db.(migrator)
+	if !ok {
+		return false, errors.New("store: migrations are not supported by the backend")
+	}
+	objects := make([]string, 0, len(migrations))
+	for object := range migrations {
+		if s.st.descriptorByName(object) == nil {
+			return false, fmt.Errorf("store: type %s with registered migrations is not passed to Migrate", object)
+		}
+		objects = append(objects, object)
+	}
+	sort.Strings(objects)
+	migrated := false
+	for _, object := range objects {
+		steps := migrations[object]
+		to := latestVersion(object)
+		done, err := m.migrateObject(object, to, func(from int, key string, obj map[string]interface{}) error {
+			for v := from; v < to; v++ {
+				step, ok := steps[v]
+				if !ok {
+					return fmt.Errorf("store: no migration for %s from version %d", object, v)
+				}
+				if err := step(key, obj); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Warnf("Migrate: problem while migrating %s: %v", object, err)
+			return migrated, err
+		}
+		if done {
+			log.Infof("Migrate: %s records were migrated to version %d", object, to)
+		}
+		migrated = migrated || done
+	}
+	return migrated, nil
+}
+
+// checkSchemaVersion validates stored version of object against the latest one
+func checkSchemaVersion(object string, stored int, to int) error {
+	if stored > to {
+		return fmt.Errorf("store: stored schema version %d of %s is newer than %d", stored, object, to)
+	}
+	return nil
+}
+
+// convertStored converts stored record d of object with convert; values of encrypted fields are passed to convert decrypted
+func (s *storage) convertStored(object string, d []byte, convert func(obj map[string]interface{}) error) ([]byte, error) {
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(d, &obj); err != nil {
+		return nil, err
+	}
+	desc := s.descriptorByName(object)
+	if desc == nil {
+		return nil, fmt.Errorf("store: there is no descriptor of %s to convert its records", object)
+	}
+	if err := s.openFields(desc, obj); err != nil {
+		return nil, err
+	}
+	if err := convert(obj); err != nil {
+		return nil, err
+	}
+	if err := s.sealFields(desc, obj); err != nil {
+		return nil, err
+	}
+	return json.Marshal(obj)
+}
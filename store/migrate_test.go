@@ -0,0 +1,50 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	// migrations are registered globally; they are removed even if the test fails, so other tests don't see them
+	t.Cleanup(func() {
+		migrationsMux.Lock()
+		delete(migrations, "testLegacy")
+		migrationsMux.Unlock()
+	})
+	for _, b := range testBackends {
+		s := b.open(t)
+		for _, id := range []string{"a", "b"} {
+			if err := s.CreateRecord(id, &testLegacy{ID: id, Title: "t" + id}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		RegisterMigration("testLegacy", 0, func(key string, obj map[string]interface{}) error {
+			obj["Title"] = obj["Title"].(string) + "-1"
+			return nil
+		})
+		RegisterMigration("testLegacy", 1, func(key string, obj map[string]interface{}) error {
+			obj["Title"] = obj["Title"].(string) + "-2"
+			return nil
+		})
+		migrated, err := s.Migrate(testLegacy{})
+		if b.migrations {
+			if err != nil || !migrated {
+				t.Errorf("%s: migrated %v: %v", b.name, migrated, err)
+			}
+			got := &testLegacy{}
+			s.GetRecord("b", got)
+			if got.Title != "tb-1-2" {
+				t.Errorf("%s: migrated record %+v", b.name, got)
+			}
+			if migrated, err = s.Migrate(testLegacy{}); err != nil || migrated {
+				t.Errorf("%s: second migration migrated %v: %v", b.name, migrated, err)
+			}
+		} else if err == nil {
+			t.Errorf("%s: Migrate should fail on the backend without migrations", b.name)
+		}
+		// migrations are registered again for the next backend
+		migrationsMux.Lock()
+		delete(migrations, "testLegacy")
+		migrationsMux.Unlock()
+	}
+}
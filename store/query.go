@@ -0,0 +1,399 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// record is the stored record in the form it is marshalled to JSON
+type record struct {
+	key string
+	obj interface{}
+}
+
+// Page is the part of ListRecords result selected with Filter's After, Offset and Limit
+type Page struct {
+	// Items is a slice of the same type as the buffer passed to ListPage
+	Items interface{}
+	// Cursors contains cursor for every item; it may be used as Filter.After
+	Cursors []string
+	HasNext bool
+	HasPrev bool
+}
+
+type cursor struct {
+	value interface{}
+	key   string
+}
+
+// ErrInvalidCursor is returned when Filter.After can't be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+func encodeCursor(filter Filter, rec record) string {
+	buf, _ := json.Marshal([]interface{}{sortValue(filter.SortBy, rec), rec.key})
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodeCursor(c string) (*cursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	arr := []interface{}{}
+	if err = json.Unmarshal(buf, &arr); err != nil || len(arr) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	key, ok := arr[1].(string)
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor{value: arr[0], key: key}, nil
+}
+
+func sortValue(field string, rec record) interface{} {
+	if field == "" {
+		return nil
+	}
+	if obj, ok := rec.obj.(map[string]interface{}); ok {
+		return obj[field]
+	}
+	return nil
+}
+
+// compareValues orders nil before bools before numbers before strings
+func compareValues(a interface{}, b interface{}, ci bool) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case bool:
+			return 1
+		case float64:
+			return 2
+		case string:
+			return 3
+		}
+		return 4
+	}
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch av := a.(type) {
+	case bool:
+		bv := b.(bool)
+		if av == bv {
+			return 0
+		} else if !av {
+			return -1
+		}
+		return 1
+	case float64:
+		bv := b.(float64)
+		if av < bv {
+			return -1
+		} else if av > bv {
+			return 1
+		}
+		return 0
+	case string:
+		bv := b.(string)
+		if ci {
+			av, bv = strings.ToLower(av), strings.ToLower(bv)
+		}
+		return strings.Compare(av, bv)
+	case nil:
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// compareRecords orders records by filter's sort field and then by key
+func compareRecords(desc *storable, filter Filter, aVal interface{}, aKey string, bVal interface{}, bKey string) int {
+	res := 0
+	if filter.SortBy != "" {
+		ci := false
+		if f := desc.topField(filter.SortBy); f != nil {
+			ci = f.flags&FFCaseInsensitive != 0
+		}
+		res = compareValues(aVal, bVal, ci)
+	}
+	if res == 0 {
+		res = strings.Compare(aKey, bKey)
+	}
+	if filter.Desc {
+		res = -res
+	}
+	return res
+}
+
+// decodeRecord unmarshals the record stored as JSON
+func (s *storage) decodeRecord(desc *storable, key string, d []byte) (record, error) {
+	if desc.kind != reflect.Struct {
+		return record{key: key, obj: string(d)}, nil
+	}
+	obj := map[string]interface{}{}
+	err := json.Unmarshal(d, &obj)
+	if err == nil {
+		err = s.openFields(desc, obj)
+	}
+	return record{key: key, obj: obj}, err
+}
+
+// matchField checks if the value v of the field f satisfies filter's Mask or Op
+func matchField(f *field, filter Filter, v interface{}) bool {
+	switch val := v.(type) {
+	case []interface{}:
+		for _, el := range val {
+			if matchField(f, filter, el) {
+				return true
+			}
+		}
+		return false
+	case map[string]interface{}:
+		if f.tip != FTMap {
+			break
+		}
+		for _, el := range val {
+			if matchField(f, filter, el) {
+				return true
+			}
+		}
+		return false
+	case nil:
+		if !isNumeric(f) {
+			return false
+		}
+		// numeric field absent in the stored record is read as 0
+		return matchField(f, filter, float64(0))
+	case string:
+		if filter.Op == FOEq && filter.Value == nil {
+			mask := filter.Mask
+			if f.flags&FFCaseInsensitive != 0 {
+				val = strings.ToLower(val)
+				mask = strings.ToLower(mask)
+			}
+			if filter.Flags&FFSeek != 0 {
+				return strings.HasPrefix(val, mask)
+			}
+			return val == mask
+		}
+	default:
+		if filter.Op == FOEq && filter.Value == nil {
+			return fmt.Sprint(v) == filter.Mask
+		}
+	}
+	ci := f.flags&FFCaseInsensitive != 0
+	res := compareValues(v, filter.Value, ci)
+	switch filter.Op {
+	case FOEq:
+		return res == 0
+	case FOGt:
+		return res > 0
+	case FOGe:
+		return res >= 0
+	case FOLt:
+		return res < 0
+	case FOLe:
+		return res <= 0
+	case FOBetween:
+		return res >= 0 && compareValues(v, filter.To, ci) <= 0
+	}
+	return false
+}
+
+// matchRecord checks if rec satisfies the filter and all its sub filters
+func matchRecord(desc *storable, filter Filter, rec record) bool {
+	if filter.Field != "" {
+		f := desc.topField(filter.Field)
+		obj, ok := rec.obj.(map[string]interface{})
+		if f == nil || !ok || !matchField(f, filter, obj[f.accessor]) {
+			return false
+		}
+	}
+	for _, sub := range filter.And {
+		if !matchRecord(desc, sub, rec) {
+			return false
+		}
+	}
+	for _, sub := range filter.Or {
+		if matchRecord(desc, sub, rec) {
+			return true
+		}
+	}
+	return len(filter.Or) == 0
+}
+
+// prepareFilter validates the filter against the descriptor and converts its operands to the stored form
+func prepareFilter(desc *storable, filter Filter) (Filter, error) {
+	filter, err := prepareCondition(desc, filter)
+	if err != nil {
+		return filter, err
+	}
+	if filter.SortBy != "" && desc.topField(filter.SortBy) == nil {
+		return filter, errors.New("unknown field for sorting: " + filter.SortBy)
+	}
+	if filter.After != "" {
+		if _, err := decodeCursor(filter.After); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// prepareCondition prepares field conditions of the filter and its sub filters
+func prepareCondition(desc *storable, filter Filter) (Filter, error) {
+	if filter.Field != "" {
+		f := desc.topField(filter.Field)
+		if f == nil {
+			return filter, errors.New("unknown field for filter: " + filter.Field)
+		}
+		if filter.Op < FOEq || filter.Op > FOBetween {
+			return filter, fmt.Errorf("invalid filter operation: %d", filter.Op)
+		}
+		if filter.Op != FOEq && filter.Value == nil {
+			return filter, errors.New("filter operation requires value")
+		}
+		if filter.Op == FOBetween && filter.To == nil {
+			return filter, errors.New("between operation requires upper bound")
+		}
+		if (isNumeric(f) || f.tip == FTDate) && filter.Op == FOEq && filter.Value == nil && filter.Flags&FFSeek == 0 {
+			filter.Value = filter.Mask
+		}
+		var err error
+		if filter.Value, err = operandValue(f, filter.Value); err != nil {
+			return filter, err
+		}
+		if filter.To, err = operandValue(f, filter.To); err != nil {
+			return filter, err
+		}
+		if !isNumeric(f) && filter.Op == FOEq && filter.Value != nil {
+			filter.Mask = filter.Value.(string)
+			filter.Value = nil
+		}
+	}
+	var err error
+	if filter.And, err = prepareConditions(desc, filter.And); err != nil {
+		return filter, err
+	}
+	filter.Or, err = prepareConditions(desc, filter.Or)
+	return filter, err
+}
+
+func prepareConditions(desc *storable, filters []Filter) ([]Filter, error) {
+	if len(filters) == 0 {
+		return filters, nil
+	}
+	ret := make([]Filter, len(filters))
+	for i, sub := range filters {
+		var err error
+		if ret[i], err = prepareCondition(desc, sub); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// operandValue converts filter operand to float64 for numeric fields, to the stored form for dates and to string for others
+func operandValue(f *field, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if f.tip == FTDate {
+		return dateOperand(f, v)
+	}
+	if !isNumeric(f) {
+		if str, ok := v.(string); ok {
+			return str, nil
+		}
+		return fmt.Sprint(v), nil
+	}
+	if str, ok := v.(string); ok {
+		n, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return nil, errors.New("invalid numeric value for field " + f.name + ": " + str)
+		}
+		return n, nil
+	}
+	if n, ok := numberValue(v); ok {
+		return n, nil
+	}
+	return nil, fmt.Errorf("invalid numeric value for field %s: %v", f.name, v)
+}
+
+// numberValue converts any go number to float64
+func numberValue(v interface{}) (float64, bool) {
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(val.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(val.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return val.Float(), true
+	}
+	return 0, false
+}
+
+// pager selects the page from the ordered records, records before the cursor should be skipped by the caller
+type pager struct {
+	filter  Filter
+	skipped int
+	items   []record
+	hasNext bool
+}
+
+func newPager(filter Filter) *pager {
+	return &pager{filter: filter, items: []record{}}
+}
+
+// add appends the record to the page; returns false when the page is full
+func (p *pager) add(rec record) bool {
+	if p.skipped < p.filter.Offset {
+		p.skipped++
+		return true
+	}
+	if p.filter.Limit > 0 && len(p.items) == p.filter.Limit {
+		p.hasNext = true
+		return false
+	}
+	p.items = append(p.items, rec)
+	return true
+}
+
+// afterCursor checks if the record is after filter's cursor
+func afterCursor(desc *storable, filter Filter, c *cursor, rec record) bool {
+	if c == nil {
+		return true
+	}
+	return compareRecords(desc, filter, sortValue(filter.SortBy, rec), rec.key, c.value, c.key) > 0
+}
+
+// pageRecords sorts matched records and selects the page of them
+func pageRecords(desc *storable, filter Filter, recs []record) ([]record, bool) {
+	sort.SliceStable(recs, func(i, j int) bool {
+		return compareRecords(desc, filter,
+			sortValue(filter.SortBy, recs[i]), recs[i].key,
+			sortValue(filter.SortBy, recs[j]), recs[j].key) < 0
+	})
+	var c *cursor
+	if filter.After != "" {
+		c, _ = decodeCursor(filter.After)
+	}
+	p := newPager(filter)
+	for _, rec := range recs {
+		if !afterCursor(desc, filter, c, rec) {
+			continue
+		}
+		if !p.add(rec) {
+			break
+		}
+	}
+	return p.items, p.hasNext
+}
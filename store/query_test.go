@@ -0,0 +1,142 @@
+package store
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testTagged struct {
+	ID  string
+	Tag string `store:"index"`
+}
+
+// listPages returns keys of all the pages listed with the filter
+func listPages(t *testing.T, s *Store, f Filter, list interface{}) []string {
+	t.Helper()
+	got := []string{}
+	for pages := 0; pages < 20; pages++ {
+		page, err := s.ListPage(f, list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := reflect.ValueOf(page.Items)
+		for i := 0; i < v.Len(); i++ {
+			got = append(got, v.Index(i).FieldByName("ID").String())
+		}
+		if pages > 0 && !page.HasPrev {
+			t.Errorf("HasPrev is not set on page %d", pages)
+		}
+		if !page.HasNext {
+			break
+		}
+		f.After = page.Cursors[len(page.Cursors)-1]
+	}
+	return got
+}
+
+func TestRangeFilters(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{"all", Filter{}, []string{"i0", "i1", "i2", "i3", "i4", "i5", "i6", "i7", "i8", "i9"}},
+		{"eq", Filter{Field: "Score", Value: 2}, []string{"i2", "i6"}},
+		{"gt", Filter{Field: "Score", Op: FOGt, Value: 2}, []string{"i3", "i7"}},
+		{"ge", Filter{Field: "Score", Op: FOGe, Value: 2}, []string{"i2", "i3", "i6", "i7"}},
+		{"lt", Filter{Field: "Score", Op: FOLt, Value: 1}, []string{"i0", "i4", "i8"}},
+		{"le sorted desc", Filter{Field: "Score", Op: FOLe, Value: 1, SortBy: "Score", Desc: true}, []string{"i9", "i5", "i1", "i8", "i4", "i0"}},
+		{"between", Filter{Field: "Score", Op: FOBetween, Value: 1, To: 2}, []string{"i1", "i2", "i5", "i6", "i9"}},
+		{"case insensitive", Filter{Field: "Name", Value: "n3"}, []string{"i3"}},
+		{"limit and offset", Filter{SortBy: "Name", Limit: 3, Offset: 2}, []string{"i2", "i3", "i4"}},
+	}
+	for _, b := range testBackends {
+		s := b.open(t)
+		fillItems(t, s)
+		for _, tt := range tests {
+			items, err := s.ListRecords(tt.filter, []testItem{})
+			if err != nil {
+				t.Errorf("%s: %s: %v", b.name, tt.name, err)
+				continue
+			}
+			if got := itemIDs(items.([]testItem)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: %s: got %v, want %v", b.name, tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestCursors(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{"by key", Filter{Limit: 3}, []string{"i0", "i1", "i2", "i3", "i4", "i5", "i6", "i7", "i8", "i9"}},
+		{"by score", Filter{Limit: 3, SortBy: "Score"}, []string{"i0", "i4", "i8", "i1", "i5", "i9", "i2", "i6", "i3", "i7"}},
+		{"by score desc", Filter{Limit: 4, SortBy: "Score", Desc: true}, []string{"i7", "i3", "i6", "i2", "i9", "i5", "i1", "i8", "i4", "i0"}},
+		{"filtered", Filter{Limit: 1, Field: "Score", Op: FOGe, Value: 2, SortBy: "Name"}, []string{"i2", "i3", "i6", "i7"}},
+	}
+	for _, b := range testBackends {
+		s := b.open(t)
+		fillItems(t, s)
+		for _, tt := range tests {
+			got := listPages(t, s, tt.filter, []testItem{})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: %s: got %v, want %v", b.name, tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestIndexOrder(t *testing.T) {
+	// records n1 and n2 were stored before Tag was added, so they have no value in the index
+	dump := `{"type":"testTagged","key":"n1","record":{"ID":"n1"}}
+{"type":"testTagged","key":"n2","record":{"ID":"n2"}}
+{"type":"testTagged","key":"e","record":{"ID":"e","Tag":""}}
+{"type":"testTagged","key":"x","record":{"ID":"x","Tag":"a"}}
+{"type":"testTagged","key":"b","record":{"ID":"b","Tag":"a!"}}
+{"type":"testTagged","key":"a","record":{"ID":"a","Tag":"a-b"}}
+`
+	for _, b := range testBackends {
+		s := b.open(t)
+		if _, err := s.Import(strings.NewReader(dump), testTagged{}); err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		// nil values are less than any other
+		if got, want := listPages(t, s, Filter{SortBy: "Tag", Limit: 2}, []testTagged{}), []string{"n1", "n2", "e", "x", "b", "a"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", b.name, got, want)
+		}
+		if got, want := listPages(t, s, Filter{SortBy: "Tag", Limit: 4, Desc: true}, []testTagged{}), []string{"a", "b", "x", "e", "n2", "n1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: desc: got %v, want %v", b.name, got, want)
+		}
+	}
+}
+
+func TestCompoundFilters(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{"and", Filter{Field: "Score", Op: FOGe, Value: 1, And: []Filter{{Field: "Name", Op: FOLt, Value: "n5"}}}, []string{"i1", "i2", "i3"}},
+		{"or", Filter{Or: []Filter{{Field: "Score", Value: 3}, {Field: "Name", Value: "n0"}}}, []string{"i0", "i3", "i7"}},
+		{"and of or", Filter{Field: "Score", Value: 1, Or: []Filter{{Field: "Name", Value: "n1"}, {Field: "Name", Value: "n9"}}}, []string{"i1", "i9"}},
+		{"sorted", Filter{Or: []Filter{{Field: "Score", Value: 0}, {Field: "Score", Value: 3}}, SortBy: "Score", Desc: true, Limit: 3}, []string{"i7", "i3", "i8"}},
+	}
+	for _, b := range testBackends {
+		s := b.open(t)
+		fillItems(t, s)
+		for _, tt := range tests {
+			items, err := s.ListRecords(tt.filter, []testItem{})
+			if err != nil {
+				t.Errorf("%s: %s: %v", b.name, tt.name, err)
+				continue
+			}
+			if got := itemIDs(items.([]testItem)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: %s: got %v, want %v", b.name, tt.name, got, tt.want)
+			}
+		}
+	}
+}
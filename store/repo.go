@@ -0,0 +1,165 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrNotFound is matched (with errors.Is) by NotFoundError
+var ErrNotFound = errors.New("record not found")
+
+// NotFoundError is returned by Repo when there is no record with the key
+type NotFoundError struct {
+	Type string
+	Key  string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %s not found", e.Type, e.Key)
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// TypeError is returned by Repo when T can't be stored
+type TypeError struct {
+	Type reflect.Type
+	Err  error
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("type %v can't be stored: %v", e.Type, e.Err)
+}
+
+func (e *TypeError) Unwrap() error {
+	return e.Err
+}
+
+// Repo is the typed access to records of T; T is the stored type or the pointer to it
+// (the latter lets Put update the version field of the record)
+type Repo[T any] struct {
+	a *access
+}
+
+// NewRepo returns the repository of T working on s
+func NewRepo[T any](s *Store) *Repo[T] {
+	return &Repo[T]{a: &s.access}
+}
+
+// WithTx returns the repository working within tx passed by Store.Update
+func (r *Repo[T]) WithTx(tx Tx) *Repo[T] {
+	return &Repo[T]{a: tx.(*access)}
+}
+
+func (r *Repo[T]) descriptor() (*storable, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	desc, err := r.a.st.findDescriptor(t)
+	if err != nil {
+		return nil, &TypeError{Type: t, Err: err}
+	}
+	return desc, nil
+}
+
+// Get returns the record with key or NotFoundError
+func (r *Repo[T]) Get(key string) (T, error) {
+	var rec T
+	desc, err := r.descriptor()
+	if err != nil {
+		return rec, err
+	}
+	// buf is the pointer to the stored value
+	var buf interface{} = &rec
+	if val := reflect.ValueOf(&rec).Elem(); val.Kind() == reflect.Ptr {
+		val.Set(reflect.New(val.Type().Elem()))
+		buf = rec
+	}
+	ok, err := r.a.GetRecord(key, buf)
+	if err == nil && !ok {
+		err = &NotFoundError{Type: desc.name, Key: key}
+	}
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return rec, nil
+}
+
+// Put stores rec with key; returns ErrConflict if rec has version field and the stored record was changed since rec was read
+func (r *Repo[T]) Put(key string, rec T) error {
+	desc, err := r.descriptor()
+	if err != nil {
+		return err
+	}
+	defer catch(desc)
+	return r.a.putRecord(key, desc, rec)
+}
+
+// Delete removes the record with key; returns NotFoundError if there is no such record
+func (r *Repo[T]) Delete(key string) error {
+	desc, err := r.descriptor()
+	if err != nil {
+		return err
+	}
+	if _, err = r.Get(key); err != nil {
+		return err
+	}
+	return r.a.DeleteRecord(desc.name, key)
+}
+
+// SoftDelete marks the record with key as deleted (see Tx.SoftDeleteRecord); returns NotFoundError if there is no such record
+func (r *Repo[T]) SoftDelete(key string) error {
+	desc, err := r.descriptor()
+	if err != nil {
+		return err
+	}
+	return r.a.SoftDeleteRecord(desc.name, key)
+}
+
+// Restore removes the deletion mark from the record with key; returns NotFoundError if there is no such deleted record
+func (r *Repo[T]) Restore(key string) error {
+	desc, err := r.descriptor()
+	if err != nil {
+		return err
+	}
+	return r.a.RestoreRecord(desc.name, key)
+}
+
+// FindDeleted returns soft deleted records selected with filter along with the page they belong to
+func (r *Repo[T]) FindDeleted(filter Filter) ([]T, *Page, error) {
+	page, err := r.a.ListDeleted(filter, []T{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return page.Items.([]T), page, nil
+}
+
+// Find returns records selected with filter
+func (r *Repo[T]) Find(filter Filter) ([]T, error) {
+	items, _, err := r.FindPage(filter)
+	return items, err
+}
+
+// FindPage returns records selected with filter along with the page they belong to; page.Items is the same slice
+func (r *Repo[T]) FindPage(filter Filter) ([]T, *Page, error) {
+	desc, err := r.descriptor()
+	if err != nil {
+		return nil, nil, err
+	}
+	page, err := r.a.listPage(desc, filter, []T{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return page.Items.([]T), page, nil
+}
+
+// Search returns up to limit records (all of them if limit is 0) matching the full-text query ordered by relevance
+// along with their scores (see Tx.Search)
+func (r *Repo[T]) Search(query string, limit int) ([]T, []float64, error) {
+	res, err := r.a.Search(query, limit, []T{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return res.Items.([]T), res.Scores, nil
+}
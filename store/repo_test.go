@@ -0,0 +1,70 @@
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRepo(t *testing.T) {
+	for _, b := range testBackends {
+		s := b.open(t)
+		items := NewRepo[*testItem](s)
+		if _, err := items.Get("a"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: absent record is read with %v", b.name, err)
+		}
+		it := &testItem{ID: "a", Name: "first", Score: 1}
+		if err := items.Put("a", it); err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		// the pointer gets the version of the stored record
+		if it.Ver != 1 {
+			t.Errorf("%s: version after Put is %d", b.name, it.Ver)
+		}
+		stale, err := items.Get("a")
+		if err != nil || stale.Name != "first" {
+			t.Fatalf("%s: read %+v: %v", b.name, stale, err)
+		}
+		it.Name = "second"
+		items.Put("a", it)
+		if err = items.Put("a", stale); err != ErrConflict {
+			t.Errorf("%s: stale record is saved with %v", b.name, err)
+		}
+		items.Put("b", &testItem{ID: "b", Score: 2})
+		found, err := items.Find(Filter{Field: "Score", Op: FOGe, Value: 2})
+		if err != nil || len(found) != 1 || found[0].ID != "b" {
+			t.Errorf("%s: found %v: %v", b.name, found, err)
+		}
+		// the repository of values works the same way
+		values := NewRepo[testItem](s)
+		if v, err := values.Get("a"); err != nil || v.Name != "second" {
+			t.Errorf("%s: read value %+v: %v", b.name, v, err)
+		}
+		if err = items.Delete("a"); err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		if err = items.Delete("a"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: absent record is deleted with %v", b.name, err)
+		}
+		var typeErr *TypeError
+		if _, err = NewRepo[testIndexedSecret](s).Get("a"); !errors.As(err, &typeErr) {
+			t.Errorf("%s: repository of the type which can't be stored returned %v", b.name, err)
+		}
+	}
+}
+
+func TestRepoWithTx(t *testing.T) {
+	s := openTestStore(t, "memory", "", "")
+	errFailed := errors.New("failed")
+	err := s.Update(func(tx Tx) error {
+		if err := NewRepo[*testItem](s).WithTx(tx).Put("a", &testItem{ID: "a"}); err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("Update returned %v", err)
+	}
+	if _, err = NewRepo[*testItem](s).Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("record of the discarded transaction is read with %v", err)
+	}
+}
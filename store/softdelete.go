@@ -0,0 +1,104 @@
+package store
+
+import (
+	"errors"
+	"reflect"
+	"time"
+)
+
+// isDeleted checks if the record rec (pointer to the value of desc) is soft deleted
+func isDeleted(desc *storable, rec interface{}) bool {
+	if desc.deleted == nil {
+		return false
+	}
+	val := reflect.Indirect(reflect.ValueOf(rec))
+	if val.Kind() != reflect.Struct {
+		return false
+	}
+	f := fieldValue(val, desc.deleted, false)
+	return f.IsValid() && f.Int() != 0
+}
+
+// isDeletedObject checks if the record in the stored form is soft deleted
+func isDeletedObject(desc *storable, obj interface{}) bool {
+	if desc.deleted == nil {
+		return false
+	}
+	m, ok := obj.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	n, _ := numberValue(m[desc.deleted.accessor])
+	return n != 0
+}
+
+// clearRecord resets the value rec points to
+func clearRecord(rec interface{}) {
+	if val := reflect.ValueOf(rec); val.Kind() == reflect.Ptr && !val.IsNil() {
+		val.Elem().Set(reflect.Zero(val.Elem().Type()))
+	}
+}
+
+// SoftDeleteRecord marks the record of object with key as deleted: it is kept in the store but is not returned by
+// GetRecord and ListRecords; the type should have integer field with 'deleted' tag that gets the time of deletion;
+// values of unique fields of the record stay taken until it is purged, so RestoreRecord can't fail with the conflict
+func (s *access) SoftDeleteRecord(object string, key string) error {
+	return s.setDeleted(object, key, time.Now().Unix())
+}
+
+// RestoreRecord removes the deletion mark from soft deleted record of object with key
+func (s *access) RestoreRecord(object string, key string) error {
+	return s.setDeleted(object, key, 0)
+}
+
+func (s *access) setDeleted(object string, key string, deleted int64) error {
+	desc := s.st.descriptorByName(object)
+	if desc == nil {
+		return errors.New("store: unknown object: " + object)
+	}
+	if desc.deleted == nil {
+		return errors.New("store: soft deletion is not supported by " + object)
+	}
+	defer catch(desc)
+	rec := desc.new()
+	ok, err := s.db.GetRecord(key, desc, rec.Interface())
+	if err != nil {
+		return err
+	}
+	if !ok || isDeleted(desc, rec.Interface()) == (deleted != 0) {
+		return &NotFoundError{Type: object, Key: key}
+	}
+	fieldValue(rec.Elem(), desc.deleted, true).SetInt(deleted)
+	return s.putRecord(key, desc, rec.Interface())
+}
+
+// ListDeleted returns soft deleted records of the type of buffer selected with filter the same way as ListPage does
+func (s *access) ListDeleted(filter Filter, buffer interface{}) (*Page, error) {
+	desc, err := s.st.getDescriptor(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if desc.deleted == nil {
+		return nil, errors.New("store: soft deletion is not supported by " + desc.name)
+	}
+	filter.Flags |= FFWithDeleted
+	filter.And = append(append([]Filter{}, filter.And...), Filter{Field: desc.deleted.name, Op: FOGt, Value: 0})
+	return s.listPage(desc, filter, buffer)
+}
+
+// PurgeDeleted removes records of the type of buffer which were soft deleted more than retention ago;
+// returns removed records in the slice of the same type as buffer
+func (s *Store) PurgeDeleted(buffer interface{}, retention time.Duration) (interface{}, error) {
+	desc, err := s.st.getDescriptor(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if desc.deleted == nil {
+		return nil, errors.New("store: soft deletion is not supported by " + desc.name)
+	}
+	return s.Expire(buffer, Expiry{
+		Field:  desc.deleted.name,
+		TTL:    retention,
+		Filter: Filter{Field: desc.deleted.name, Op: FOGt, Value: 0, Flags: FFWithDeleted},
+	})
+}
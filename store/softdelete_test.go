@@ -0,0 +1,60 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+type testMember struct {
+	ID      string
+	Login   string `store:"index,unique"`
+	Deleted int64  `store:"deleted"`
+}
+
+func TestSoftDelete(t *testing.T) {
+	for _, b := range testBackends {
+		s := b.open(t)
+		for _, id := range []string{"a", "b"} {
+			if err := s.CreateRecord(id, &testMember{ID: id, Login: "l" + id}); err != nil {
+				t.Fatalf("%s: %v", b.name, err)
+			}
+		}
+		if err := s.SoftDeleteRecord("testMember", "a"); err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		if ok, err := s.GetRecord("a", &testMember{}); ok || err != nil {
+			t.Errorf("%s: deleted record is read: %v", b.name, err)
+		}
+		items, _ := s.ListRecords(Filter{}, []testMember{})
+		if got := items.([]testMember); len(got) != 1 || got[0].ID != "b" {
+			t.Errorf("%s: listed %v", b.name, got)
+		}
+		deleted, err := s.ListDeleted(Filter{}, []testMember{})
+		if got := deleted.Items.([]testMember); err != nil || len(got) != 1 || got[0].ID != "a" || got[0].Deleted == 0 {
+			t.Errorf("%s: listed deleted %v: %v", b.name, got, err)
+		}
+		// the login of the deleted record is still taken
+		if err = s.CreateRecord("c", &testMember{ID: "c", Login: "la"}); err == nil {
+			t.Errorf("%s: unique value of the deleted record is reused", b.name)
+		}
+		if err = s.SoftDeleteRecord("testMember", "a"); err == nil {
+			t.Errorf("%s: deleted record is deleted again", b.name)
+		}
+		if err = s.RestoreRecord("testMember", "a"); err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		got := &testMember{}
+		if ok, _ := s.GetRecord("a", got); !ok || got.Login != "la" || got.Deleted != 0 {
+			t.Errorf("%s: restored %+v", b.name, got)
+		}
+
+		s.SoftDeleteRecord("testMember", "b")
+		purged, err := s.PurgeDeleted([]testMember{}, -time.Minute)
+		if got := purged.([]testMember); err != nil || len(got) != 1 || got[0].ID != "b" {
+			t.Errorf("%s: purged %v: %v", b.name, got, err)
+		}
+		if err = s.CreateRecord("c", &testMember{ID: "c", Login: "lb"}); err != nil {
+			t.Errorf("%s: unique value of the purged record is taken: %v", b.name, err)
+		}
+	}
+}
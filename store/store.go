@@ -2,6 +2,7 @@ package store
 
 import (
 	"errors"
+	"reflect"
 
 	log "github.com/cihub/seelog"
 	"github.com/vc2402/utils"
@@ -12,13 +13,83 @@ type StoreKind int
 const (
 	SKBolt StoreKind = iota
 	SKGorm
+	SKMemory
 )
 
 type Store struct {
-	kind StoreKind
-	st   *storage
-	bolt *boltDB
-	// gorm *gormDB
+	access
+	kind    StoreKind
+	backups *backups
+}
+
+// access implements record operations on top of the backend; Store uses the backend itself
+// while Update passes to its func the one bound to the transaction
+type access struct {
+	st       *storage
+	db       backend
+	watchers *watchers
+	// pending collects what should be done when the transaction bound to access is over; nil outside transactions
+	pending *txPending
+}
+
+// txPending keeps effects of the transaction applied to the outside world when it is committed or discarded
+type txPending struct {
+	// changes are delivered to watchers after the commit
+	changes []pendingChange
+	// rollbacks restore version fields of saved records if the transaction is discarded
+	rollbacks []func()
+}
+
+// rollback undoes the effects on saved records in the reverse order
+func (p *txPending) rollback() {
+	for i := len(p.rollbacks) - 1; i >= 0; i-- {
+		p.rollbacks[i]()
+	}
+	p.changes, p.rollbacks = nil, nil
+}
+
+// Tx is the set of record operations performed within one transaction of Store.Update
+type Tx interface {
+	GetRecord(key string, buf interface{}) (bool, error)
+	CreateRecord(key string, buf interface{}) error
+	UpdateRecord(key string, buf interface{}) error
+	DeleteRecord(object string, key string) error
+	SoftDeleteRecord(object string, key string) error
+	RestoreRecord(object string, key string) error
+	ListRecords(filter Filter, buffer interface{}) (interface{}, error)
+	ListPage(filter Filter, buffer interface{}) (*Page, error)
+	Search(query string, limit int, buffer interface{}) (*SearchResult, error)
+	// AppendEntry appends the entry to the journal together with records saved within the transaction
+	AppendEntry(journal string, owner string, group int, entry interface{}) error
+}
+
+// backend is implemented by every storage engine the Store can work on top of
+type backend interface {
+	GetRecord(key string, desc *storable, rec interface{}) (bool, error)
+	PutRecord(key string, desc *storable, rec interface{}) error
+	DeleteRecord(object string, key string) error
+	// ListRecords returns the page of records selected with the filter and if there are more of them
+	ListRecords(desc *storable, filter Filter) ([]record, bool, error)
+	RebuildIndexes(desc *storable) error
+	// update calls fn with the backend bound to a single transaction that is committed if fn returns nil;
+	// being called for such a backend it just calls fn
+	update(fn func(db backend) error) error
+	stop()
+}
+
+// backendFactory opens the backend; dbType is meaningful only for sql-like backends
+type backendFactory func(dbType string, dbName string, st *storage) (backend, error)
+
+type backendInfo struct {
+	kind    StoreKind
+	factory backendFactory
+}
+
+var backends = map[string]backendInfo{}
+
+// registerBackend makes the backend available for 'store.kind' config property
+func registerBackend(name string, kind StoreKind, factory backendFactory) {
+	backends[name] = backendInfo{kind: kind, factory: factory}
 }
 
 type Helper interface {
@@ -29,6 +100,22 @@ type Helper interface {
 const (
 	// FFSeek flag means that Mask is begining of the fields value
 	FFSeek = 0x01
+	// FFWithDeleted flag makes the list include soft deleted records (it is used only in the top level filter)
+	FFWithDeleted = 0x02
+)
+
+// FilterOp is the comparison Filter applies to the Field
+type FilterOp int
+
+const (
+	// FOEq selects records with Field equal to Value (or to Mask if Value is nil)
+	FOEq FilterOp = iota
+	FOGt
+	FOGe
+	FOLt
+	FOLe
+	// FOBetween selects records with Field between Value and To (both inclusive)
+	FOBetween
 )
 
 type Filter struct {
@@ -36,72 +123,133 @@ type Filter struct {
 	Mask  string
 	Limit int
 	Flags int
+	// Op is the comparison for Field; Value and To are its operands (numbers for numeric fields)
+	Op    FilterOp
+	Value interface{}
+	To    interface{}
+	// And contains conditions all of which records should satisfy as well
+	And []Filter
+	// Or contains conditions any of which records should satisfy as well; only their field conditions are used
+	Or []Filter
+	// Offset is the number of records to skip (after the cursor if it is set)
+	Offset int
+	// After is the cursor of the record (from Page.Cursors) the result should start after
+	After string
+	// SortBy is the name of the field to order by; records are ordered by key by default
+	SortBy string
+	Desc   bool
 }
 
 func Init() (*Store, error) {
 	storeKind := utils.GetProperty("store.kind", "bolt")
 	dbType := utils.GetProperty("store.dbType", "sqlite3")
 	dbName := utils.GetProperty("store.dbName", "gomesdb")
-	log.Tracef("gorm: going to open db %s: %s/%s", storeKind, dbType, dbName)
-	var err error
-	storage := newStorage()
-	switch storeKind {
-	case "bolt":
-		db, err := initBolt(dbName, storage)
-		if err == nil {
-			return &Store{kind: SKBolt, bolt: db, st: storage}, nil
-		}
-		// case "gorm":
-		// 	db, err := initGorm(dbType, dbName)
-		// 	if err == nil {
-		// 		return &Store{kind: SKGorm, gorm: db, st: newStorage()}, nil
-		// 	}
+	s, err := Open(storeKind, dbType, dbName)
+	if err != nil {
+		return nil, err
+	}
+	keys := utils.GetProperty("store.encryption.keys", "")
+	if keys == "" {
+		log.Warnf("store: encryption keys are not configured; encrypted fields are stored as plain text")
+	} else if err = s.SetEncryptionKeys(keys); err != nil {
+		s.Stop()
+		return nil, err
 	}
+	return s, nil
+}
 
-	log.Warnf("gorm: problem while opening db: %v", err)
-	return nil, err
+// Open opens the store with backend registered as storeKind
+func Open(storeKind string, dbType string, dbName string) (*Store, error) {
+	log.Tracef("store: going to open db %s: %s/%s", storeKind, dbType, dbName)
+	bi, ok := backends[storeKind]
+	if !ok {
+		log.Warnf("store: unknown store kind: %s", storeKind)
+		return nil, errors.New("unknown store kind: " + storeKind)
+	}
+	storage := newStorage()
+	db, err := bi.factory(dbType, dbName, storage)
+	if err != nil {
+		log.Warnf("store: problem while opening db: %v", err)
+		return nil, err
+	}
+	return &Store{kind: bi.kind, access: access{db: db, st: storage, watchers: newWatchers()}}, nil
 }
 
 func (s *Store) Stop() {
-	switch s.kind {
-	case SKBolt:
-		s.bolt.stopBolt()
-		// case SKGorm:
-		// 	s.gorm.stopGorm()
-	}
+	s.stopBackups()
+	s.watchers.closeAll()
+	s.db.stop()
 }
 
 func (s *Store) GetKind() StoreKind { return s.kind }
 
-func (s *Store) ListRecords(filter Filter, buffer interface{}) (interface{}, error) {
+func (s *access) ListRecords(filter Filter, buffer interface{}) (interface{}, error) {
+	page, err := s.ListPage(filter, buffer)
+	if err != nil {
+		return nil, err
+	}
+	return page.Items, nil
+}
+
+// ListPage returns records selected with the filter in the slice of the same type as buffer along with their cursors
+func (s *access) ListPage(filter Filter, buffer interface{}) (*Page, error) {
 	desc, err := s.st.getDescriptor(buffer)
 	if err != nil {
 		return nil, err
 	}
+	return s.listPage(desc, filter, buffer)
+}
+
+func (s *access) listPage(desc *storable, filter Filter, buffer interface{}) (*Page, error) {
+	arr := reflect.ValueOf(buffer)
+	if arr.Kind() != reflect.Slice {
+		return nil, errors.New("ListRecords arg should be a slice")
+	}
 	defer catch(desc)
-	return s.bolt.ListRecords(desc, filter, buffer)
+	var err error
+	if desc.deleted != nil && filter.Flags&FFWithDeleted == 0 {
+		filter.And = append(append([]Filter{}, filter.And...), Filter{Field: desc.deleted.name, Op: FOEq, Value: 0})
+	}
+	if filter, err = prepareFilter(desc, filter); err != nil {
+		return nil, err
+	}
+	recs, hasNext, err := s.db.ListRecords(desc, filter)
+	if err != nil {
+		return nil, err
+	}
+	page := &Page{
+		Cursors: make([]string, 0, len(recs)),
+		HasNext: hasNext,
+		HasPrev: filter.After != "" || filter.Offset > 0,
+	}
+	for _, rec := range recs {
+		val := reflect.New(arr.Type().Elem())
+		if err = s.st.fromObject(desc, &val, rec.obj); err != nil {
+			return nil, err
+		}
+		arr = reflect.Append(arr, val.Elem())
+		page.Cursors = append(page.Cursors, encodeCursor(filter, rec))
+	}
+	page.Items = arr.Interface()
+	return page, nil
 }
 
-func (s *Store) GetRecord(key string, buf interface{}) (bool, error) {
+// GetRecord reads the record with key to buf; soft deleted records are treated as absent
+func (s *access) GetRecord(key string, buf interface{}) (bool, error) {
 	desc, err := s.st.getDescriptor(buf)
 	if err != nil {
 		return false, err
 	}
 	defer catch(desc)
-	switch s.kind {
-	case SKBolt:
-		ok, err := s.bolt.GetRecord(key, desc, buf)
-		if err != nil {
-			return false, err
-		}
-		return ok, nil
-	default:
-		return false, errors.New("not iplemented")
+	ok, err := s.db.GetRecord(key, desc, buf)
+	if ok && err == nil && isDeleted(desc, buf) {
+		clearRecord(buf)
+		return false, nil
 	}
-
+	return ok, err
 }
 
-func (s *Store) CreateRecord(key string, buf interface{}) error {
+func (s *access) CreateRecord(key string, buf interface{}) error {
 	log.Tracef("CreateRecord: for key %s", key)
 	desc, err := s.st.getDescriptor(buf)
 	if err != nil {
@@ -109,16 +257,11 @@ func (s *Store) CreateRecord(key string, buf interface{}) error {
 		return err
 	}
 	defer catch(desc)
-	switch s.kind {
-	case SKBolt:
-		log.Tracef("CreateRecord: going to call bolt.PutRecord with descriptor %+v", desc)
-		return s.bolt.PutRecord(key, desc, buf)
-	default:
-		return errors.New("not iplemented")
-	}
+	log.Tracef("CreateRecord: going to call PutRecord with descriptor %+v", desc)
+	return s.putRecord(key, desc, buf)
 }
 
-func (s *Store) UpdateRecord(key string, buf interface{}) error {
+func (s *access) UpdateRecord(key string, buf interface{}) error {
 	log.Tracef("UpdateRecord: for key %s", key)
 	desc, err := s.st.getDescriptor(buf)
 	if err != nil {
@@ -126,30 +269,151 @@ func (s *Store) UpdateRecord(key string, buf interface{}) error {
 		return err
 	}
 	defer catch(desc)
-	switch s.kind {
-	case SKBolt:
-		log.Tracef("UpdateRecord: going to call bolt.PutRecord with descriptor %+v", desc)
-		return s.bolt.PutRecord(key, desc, buf)
-	default:
-		return errors.New("not iplemented")
+	log.Tracef("UpdateRecord: going to call PutRecord with descriptor %+v", desc)
+	return s.putRecord(key, desc, buf)
+}
+
+// putRecord saves the record and updates its version field if it has one;
+// the record of the watched type is saved within the transaction so its old state is read consistently
+func (s *access) putRecord(key string, desc *storable, buf interface{}) error {
+	version, versioned := recordVersion(desc, buf)
+	if !s.watchers.watched(desc.name) && s.pending == nil {
+		err := s.db.PutRecord(key, desc, buf)
+		if err == nil && versioned {
+			setRecordVersion(desc, buf, version+1)
+		}
+		return err
 	}
+	return s.inTx(func(tx *access) error {
+		var old *record
+		var oldValue interface{}
+		watched := tx.watchers.watched(desc.name)
+		if watched {
+			var err error
+			if old, oldValue, err = tx.storedRecord(desc, key); err != nil {
+				return err
+			}
+		}
+		if err := tx.db.PutRecord(key, desc, buf); err != nil {
+			return err
+		}
+		if versioned {
+			// the version is set at once so the record can be saved again within the transaction
+			setRecordVersion(desc, buf, version+1)
+			tx.pending.rollbacks = append(tx.pending.rollbacks, func() { setRecordVersion(desc, buf, version) })
+		}
+		if !watched {
+			return nil
+		}
+		return tx.changed(desc, key, old, oldValue)
+	})
 }
 
-func (s *Store) DeleteRecord(object string, key string) error {
-	switch s.kind {
-	case SKBolt:
-		log.Tracef("DeleteRecord: going to call bolt.DeleteRecord fro object kind %s", object)
-		return s.bolt.DeleteRecord(object, key)
-	default:
-		return errors.New("not iplemented")
+func (s *access) DeleteRecord(object string, key string) error {
+	log.Tracef("DeleteRecord: going to call DeleteRecord for object kind %s", object)
+	desc := s.st.descriptorByName(object)
+	if desc == nil || !s.watchers.watched(object) {
+		return s.db.DeleteRecord(object, key)
 	}
+	return s.inTx(func(tx *access) error {
+		old, oldValue, err := tx.storedRecord(desc, key)
+		if err != nil {
+			return err
+		}
+		if err = tx.db.DeleteRecord(object, key); err != nil {
+			return err
+		}
+		return tx.changed(desc, key, old, oldValue)
+	})
+}
+
+// inTx calls fn with s if it is bound to the transaction and within the new one otherwise
+// so reading the old state, the change and registering it for watchers are atomic;
+// changes are delivered after the new transaction is committed and versions are restored if it is discarded
+func (s *access) inTx(fn func(tx *access) error) error {
+	if s.pending != nil {
+		return fn(s)
+	}
+	pending := &txPending{}
+	err := s.db.update(func(db backend) error {
+		pending.rollback()
+		return fn(&access{st: s.st, db: db, watchers: s.watchers, pending: pending})
+	})
+	if err != nil {
+		pending.rollback()
+	} else if len(pending.changes) > 0 {
+		s.watchers.deliver(pending.changes)
+	}
+	return err
+}
+
+// Update calls fn within one transaction; all the changes made with tx are committed if fn returns nil
+// and discarded otherwise
+func (s *Store) Update(fn func(tx Tx) error) error {
+	return s.inTx(func(tx *access) error {
+		return fn(tx)
+	})
 }
 
 func (s *Store) RebuildIndexes(forTypeOf interface{}) error {
 	desc, err := s.st.getDescriptor(forTypeOf)
 	if err == nil {
-		return s.bolt.RebuildIndexes(desc)
+		return s.rebuildIndexes(desc)
 	} else {
 		return err
 	}
 }
+
+// SyncIndexes rebuilds indexes of the types whose indexed fields differ from the ones the indexes were built for
+// (or were never recorded); returns the names of the types indexes were rebuilt for
+func (s *Store) SyncIndexes(types ...interface{}) ([]string, error) {
+	keeper, ok := s.db.(schemaKeeper)
+	if !ok {
+		return nil, errors.New("store: index signatures are not supported by the backend")
+	}
+	rebuilt := []string{}
+	for _, t := range types {
+		desc, err := s.st.getDescriptor(t)
+		if err != nil {
+			return rebuilt, err
+		}
+		done, err := s.syncIndexes(keeper, desc)
+		if err != nil {
+			return rebuilt, err
+		}
+		if done {
+			rebuilt = append(rebuilt, desc.name)
+		}
+	}
+	return rebuilt, nil
+}
+
+// syncIndexes rebuilds indexes of desc if its index signature differs from the stored one
+// and builds its absent full-text indexes otherwise; returns true if indexes were rebuilt
+func (s *access) syncIndexes(keeper schemaKeeper, desc *storable) (bool, error) {
+	stored, err := keeper.schemaValue(desc.name + cIndexSignatureSuffix)
+	if err != nil {
+		return false, err
+	}
+	if stored == indexSignature(desc) {
+		if ts, ok := s.db.(textSearcher); ok && len(desc.fullText) != 0 {
+			return false, ts.ensureFullText(desc)
+		}
+		return false, nil
+	}
+	log.Infof("syncIndexes: indexed fields of %s were changed; rebuilding indexes", desc.name)
+	return true, s.rebuildIndexes(desc)
+}
+
+// rebuildIndexes rebuilds indexes of desc and records the signature they are built for within one transaction
+func (s *access) rebuildIndexes(desc *storable) error {
+	return s.db.update(func(db backend) error {
+		if err := db.RebuildIndexes(desc); err != nil {
+			return err
+		}
+		if keeper, ok := db.(schemaKeeper); ok {
+			return keeper.setSchemaValue(desc.name+cIndexSignatureSuffix, indexSignature(desc))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+type testItem struct {
+	ID    string
+	Name  string `store:"index,ci"`
+	Score int    `store:"index"`
+	Ver   int64  `store:"version"`
+}
+
+type testLegacy struct {
+	ID    string
+	Title string
+}
+
+// testBackend opens the store of some kind in the temporary directory of the test
+type testBackend struct {
+	name string
+	open func(t *testing.T) *Store
+	// migrations is set for backends supporting Migrate
+	migrations bool
+}
+
+var testBackends = []testBackend{
+	{name: "memory", migrations: true, open: func(t *testing.T) *Store { return openTestStore(t, "memory", "", "") }},
+	{name: "bolt", migrations: true, open: func(t *testing.T) *Store {
+		return openTestStore(t, "bolt", "", t.TempDir()+"/test.bolt")
+	}},
+	{name: "gorm", open: func(t *testing.T) *Store { return openTestStore(t, "gorm", "sqlite3", t.TempDir()+"/test.db") }},
+}
+
+func openTestStore(t *testing.T, kind string, dbType string, dbName string) *Store {
+	s, err := Open(kind, dbType, dbName)
+	if err != nil {
+		t.Fatalf("can't open %s store: %v", kind, err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// fillItems stores items with ids i0..i9, names n0..n9 (every third capitalized) and scores i%4
+func fillItems(t *testing.T, s *Store) {
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("n%d", i)
+		if i%3 == 0 {
+			name = fmt.Sprintf("N%d", i)
+		}
+		if err := s.CreateRecord(fmt.Sprintf("i%d", i), &testItem{ID: fmt.Sprintf("i%d", i), Name: name, Score: i % 4}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func itemIDs(items []testItem) []string {
+	ids := []string{}
+	for _, it := range items {
+		ids = append(ids, it.ID)
+	}
+	return ids
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	log "github.com/cihub/seelog"
+)
+
+// ErrConflict is returned when the record has been changed since it was read, i.e. stored version differs from saved one
+var ErrConflict = errors.New("record was changed concurrently")
+
+// recordVersion returns the value of the version field of rec; ok is false if the record has no version field
+func recordVersion(desc *storable, rec interface{}) (version int64, ok bool) {
+	if desc.version == nil {
+		return 0, false
+	}
+	val := reflect.Indirect(reflect.ValueOf(rec))
+	if val.Kind() != reflect.Struct {
+		return 0, false
+	}
+	f := fieldValue(val, desc.version, false)
+	if !f.IsValid() {
+		return 0, true
+	}
+	return f.Int(), true
+}
+
+// setRecordVersion sets the version field of rec if rec is a pointer
+func setRecordVersion(desc *storable, rec interface{}, version int64) {
+	val := reflect.ValueOf(rec)
+	if val.Kind() != reflect.Ptr {
+		return
+	}
+	if f := fieldValue(val.Elem(), desc.version, true); f.IsValid() && f.CanSet() {
+		f.SetInt(version)
+	}
+}
+
+// nextVersion checks that stored record old (nil if there is no one) has the same version as rec
+// and puts incremented version to obj that is going to be stored instead
+func nextVersion(desc *storable, old []byte, rec interface{}, obj map[string]interface{}) error {
+	version, ok := recordVersion(desc, rec)
+	if !ok {
+		return nil
+	}
+	var stored int64
+	if old != nil {
+		o := map[string]interface{}{}
+		if err := json.Unmarshal(old, &o); err != nil {
+			return err
+		}
+		n, _ := numberValue(o[desc.version.accessor])
+		stored = int64(n)
+	}
+	if stored != version {
+		log.Debugf("nextVersion: %s: stored version %d differs from %d", desc.name, stored, version)
+		return ErrConflict
+	}
+	obj[desc.version.accessor] = version + 1
+	return nil
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVersioning(t *testing.T) {
+	for _, b := range testBackends {
+		s := b.open(t)
+		it := &testItem{ID: "a", Name: "first"}
+		if err := s.CreateRecord("a", it); err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		if it.Ver != 1 {
+			t.Errorf("%s: version after create is %d", b.name, it.Ver)
+		}
+		stale := &testItem{}
+		if ok, err := s.GetRecord("a", stale); !ok || err != nil {
+			t.Fatalf("%s: record is not read: %v", b.name, err)
+		}
+		it.Name = "second"
+		if err := s.UpdateRecord("a", it); err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		stale.Name = "third"
+		if err := s.UpdateRecord("a", stale); err != ErrConflict {
+			t.Errorf("%s: stale update returned %v", b.name, err)
+		}
+		got := &testItem{}
+		s.GetRecord("a", got)
+		if got.Name != "second" || got.Ver != 2 {
+			t.Errorf("%s: stored %+v", b.name, got)
+		}
+	}
+}
+
+func TestVersionRollback(t *testing.T) {
+	errFailed := errors.New("failed")
+	for _, b := range testBackends {
+		s := b.open(t)
+		it := &testItem{ID: "a"}
+		if err := s.CreateRecord("a", it); err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		err := s.Update(func(tx Tx) error {
+			it.Name = "first"
+			if err := tx.UpdateRecord("a", it); err != nil {
+				return err
+			}
+			// the record is saved again with the version set by the previous save
+			it.Name = "second"
+			if err := tx.UpdateRecord("a", it); err != nil {
+				return err
+			}
+			return errFailed
+		})
+		if err != errFailed {
+			t.Fatalf("%s: Update returned %v", b.name, err)
+		}
+		if it.Ver != 1 {
+			t.Errorf("%s: version of the discarded save is %d", b.name, it.Ver)
+		}
+		if err = s.UpdateRecord("a", it); err != nil {
+			t.Errorf("%s: save after the discarded transaction: %v", b.name, err)
+		}
+		if it.Ver != 2 {
+			t.Errorf("%s: version after save is %d", b.name, it.Ver)
+		}
+	}
+}
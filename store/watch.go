@@ -0,0 +1,212 @@
+package store
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+
+	log "github.com/cihub/seelog"
+)
+
+// ChangeKind is the kind of record change delivered to watchers
+type ChangeKind int
+
+const (
+	CKCreate ChangeKind = iota
+	CKUpdate
+	CKDelete
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case CKCreate:
+		return "create"
+	case CKUpdate:
+		return "update"
+	case CKDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// Change describes committed change of one record
+type Change struct {
+	Kind ChangeKind
+	// Type is the name of the stored type
+	Type string
+	Key  string
+	// Record is the pointer to the copy of the record as it was stored (the last stored state for CKDelete)
+	Record interface{}
+}
+
+// cWatchBuffer is the number of changes that may wait for the watcher before they start to be dropped
+const cWatchBuffer = 64
+
+// Watcher delivers changes of records of one type matching its filter to C
+type Watcher struct {
+	C <-chan Change
+	c chan Change
+	// object is the name of the watched type
+	object string
+	filter Filter
+	desc   *storable
+	reg    *watchers
+	once   sync.Once
+}
+
+// watchers is the registry of watchers of the store
+type watchers struct {
+	mux    sync.RWMutex
+	byType map[string][]*Watcher
+}
+
+// Watch returns Watcher receiving creations, updates and deletions of records of the type of forTypeOf
+// matching filter (all of them if filter is empty) after they are committed; updates are delivered
+// if either old or new state of the record matches; changes are dropped if the watcher doesn't keep up;
+// records loaded with Import are not reported
+func (s *Store) Watch(forTypeOf interface{}, filter Filter) (*Watcher, error) {
+	desc, err := s.st.getDescriptor(forTypeOf)
+	if err != nil {
+		return nil, err
+	}
+	if filter, err = prepareCondition(desc, filter); err != nil {
+		return nil, err
+	}
+	c := make(chan Change, cWatchBuffer)
+	w := &Watcher{C: c, c: c, object: desc.name, filter: filter, desc: desc, reg: s.watchers}
+	s.watchers.mux.Lock()
+	defer s.watchers.mux.Unlock()
+	s.watchers.byType[desc.name] = append(s.watchers.byType[desc.name], w)
+	return w, nil
+}
+
+// Close unsubscribes the watcher and closes its channel
+func (w *Watcher) Close() {
+	w.once.Do(func() {
+		w.reg.mux.Lock()
+		defer w.reg.mux.Unlock()
+		list := w.reg.byType[w.object]
+		for i, o := range list {
+			if o == w {
+				w.reg.byType[w.object] = append(list[:i:i], list[i+1:]...)
+				break
+			}
+		}
+		close(w.c)
+	})
+}
+
+func newWatchers() *watchers {
+	return &watchers{byType: map[string][]*Watcher{}}
+}
+
+// closeAll closes all the watchers when the store is stopped
+func (ws *watchers) closeAll() {
+	ws.mux.Lock()
+	defer ws.mux.Unlock()
+	for _, list := range ws.byType {
+		for _, w := range list {
+			w.once.Do(func() { close(w.c) })
+		}
+	}
+	ws.byType = map[string][]*Watcher{}
+}
+
+// watched returns true if there are watchers of the object
+func (ws *watchers) watched(object string) bool {
+	if ws == nil {
+		return false
+	}
+	ws.mux.RLock()
+	defer ws.mux.RUnlock()
+	return len(ws.byType[object]) > 0
+}
+
+// pendingChange is the change with stored states of the record needed to match watchers' filters
+type pendingChange struct {
+	Change
+	old *record
+	new *record
+}
+
+// deliver sends changes to the watchers which filters match them
+func (ws *watchers) deliver(changes []pendingChange) {
+	ws.mux.RLock()
+	defer ws.mux.RUnlock()
+	for _, ch := range changes {
+		for _, w := range ws.byType[ch.Type] {
+			if !w.matches(ch) {
+				continue
+			}
+			select {
+			case w.c <- ch.Change:
+			default:
+				log.Warnf("store: watcher of %s doesn't keep up; %s of %s is dropped", ch.Type, ch.Kind, ch.Key)
+			}
+		}
+	}
+}
+
+func (w *Watcher) matches(ch pendingChange) bool {
+	return ch.old != nil && matchRecord(w.desc, w.filter, *ch.old) ||
+		ch.new != nil && matchRecord(w.desc, w.filter, *ch.new)
+}
+
+// storedRecord reads the record with key as it is stored; returns nil if there is no such record
+func (s *access) storedRecord(desc *storable, key string) (*record, interface{}, error) {
+	val := desc.new()
+	ok, err := s.db.GetRecord(key, desc, val.Interface())
+	if err != nil || !ok {
+		return nil, nil, err
+	}
+	obj, err := s.st.toObject(desc, &val)
+	if err != nil {
+		return nil, nil, err
+	}
+	if desc.kind == reflect.Struct {
+		// matching works on the form records are unmarshalled to
+		buf, err := json.Marshal(obj)
+		if err != nil {
+			return nil, nil, err
+		}
+		o := map[string]interface{}{}
+		if err = json.Unmarshal(buf, &o); err != nil {
+			return nil, nil, err
+		}
+		obj = o
+	}
+	return &record{key: key, obj: obj}, val.Interface(), nil
+}
+
+// changed registers the change of the record of desc with key; old is its state before the change (nil if it was absent);
+// the change is delivered at once if s is not bound to the transaction and after it is committed otherwise
+func (s *access) changed(desc *storable, key string, old *record, oldValue interface{}) error {
+	rec, value, err := s.storedRecord(desc, key)
+	if err != nil {
+		return err
+	}
+	// for watchers soft deletion is deletion and restoring is creation
+	if old != nil && isDeletedObject(desc, old.obj) {
+		old = nil
+	}
+	if rec != nil && isDeletedObject(desc, rec.obj) {
+		rec = nil
+	}
+	ch := pendingChange{Change: Change{Type: desc.name, Key: key, Record: oldValue}, old: old}
+	switch {
+	case rec == nil && old == nil:
+		return nil
+	case rec == nil:
+		ch.Kind = CKDelete
+	case old == nil:
+		ch.Kind, ch.Record, ch.new = CKCreate, value, rec
+	default:
+		ch.Kind, ch.Record, ch.new = CKUpdate, value, rec
+	}
+	if s.pending != nil {
+		s.pending.changes = append(s.pending.changes, ch)
+	} else {
+		s.watchers.deliver([]pendingChange{ch})
+	}
+	return nil
+}
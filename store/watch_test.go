@@ -0,0 +1,142 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// nextChange returns the change delivered to w or fails if there is no one
+func nextChange(t *testing.T, w *Watcher) Change {
+	t.Helper()
+	select {
+	case ch := <-w.C:
+		return ch
+	case <-time.After(time.Second):
+		t.Fatal("change is not delivered")
+	}
+	return Change{}
+}
+
+// noChange fails if some change was delivered to w
+func noChange(t *testing.T, w *Watcher) {
+	t.Helper()
+	select {
+	case ch := <-w.C:
+		t.Fatalf("unexpected change %s of %s", ch.Kind, ch.Key)
+	default:
+	}
+}
+
+func TestWatch(t *testing.T) {
+	for _, b := range testBackends {
+		s := b.open(t)
+		all, err := s.Watch(testItem{}, Filter{})
+		if err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		high, err := s.Watch(testItem{}, Filter{Field: "Score", Op: FOGe, Value: 2})
+		if err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		it := &testItem{ID: "a", Name: "a", Score: 1}
+		if err = s.CreateRecord("a", it); err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		if ch := nextChange(t, all); ch.Kind != CKCreate || ch.Key != "a" || ch.Record.(*testItem).Score != 1 {
+			t.Errorf("%s: create delivered as %+v", b.name, ch)
+		}
+		noChange(t, high)
+		it.Score = 3
+		s.UpdateRecord("a", it)
+		if ch := nextChange(t, all); ch.Kind != CKUpdate || ch.Record.(*testItem).Score != 3 {
+			t.Errorf("%s: update delivered as %+v", b.name, ch)
+		}
+		// the new state matches the filter
+		if ch := nextChange(t, high); ch.Kind != CKUpdate {
+			t.Errorf("%s: update delivered to the filtered watcher as %+v", b.name, ch)
+		}
+		s.DeleteRecord("testItem", "a")
+		if ch := nextChange(t, all); ch.Kind != CKDelete || ch.Record.(*testItem).Score != 3 {
+			t.Errorf("%s: delete delivered as %+v", b.name, ch)
+		}
+		nextChange(t, high)
+		all.Close()
+		high.Close()
+		if _, ok := <-all.C; ok {
+			t.Errorf("%s: channel of the closed watcher is open", b.name)
+		}
+	}
+}
+
+func TestWatchUpdate(t *testing.T) {
+	errFailed := errors.New("failed")
+	for _, b := range testBackends {
+		s := b.open(t)
+		w, err := s.Watch(testItem{}, Filter{})
+		if err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		err = s.Update(func(tx Tx) error {
+			if err := tx.CreateRecord("a", &testItem{ID: "a"}); err != nil {
+				return err
+			}
+			// the type nobody watches is changed within the same transaction
+			if err := tx.CreateRecord("l", &testLegacy{ID: "l"}); err != nil {
+				return err
+			}
+			return errFailed
+		})
+		if err != errFailed {
+			t.Fatalf("%s: Update returned %v", b.name, err)
+		}
+		noChange(t, w)
+		if ok, _ := s.GetRecord("l", &testLegacy{}); ok {
+			t.Errorf("%s: record of the discarded transaction is stored", b.name)
+		}
+		err = s.Update(func(tx Tx) error {
+			if err := tx.CreateRecord("a", &testItem{ID: "a"}); err != nil {
+				return err
+			}
+			return tx.CreateRecord("b", &testItem{ID: "b"})
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		if first, second := nextChange(t, w), nextChange(t, w); first.Key != "a" || second.Key != "b" {
+			t.Errorf("%s: committed changes delivered as %s, %s", b.name, first.Key, second.Key)
+		}
+		// changes of unwatched types are stored without transactions
+		if err = s.CreateRecord("l", &testLegacy{ID: "l", Title: "x"}); err != nil {
+			t.Fatalf("%s: %v", b.name, err)
+		}
+		noChange(t, w)
+		w.Close()
+	}
+}
+
+func TestMemoryUpdateIsolation(t *testing.T) {
+	s := openTestStore(t, "memory", "", "")
+	fillItems(t, s)
+	errFailed := errors.New("failed")
+	err := s.Update(func(tx Tx) error {
+		it := &testItem{}
+		tx.GetRecord("i1", it)
+		it.Score = 10
+		if err := tx.UpdateRecord("i1", it); err != nil {
+			return err
+		}
+		tx.DeleteRecord("testItem", "i2")
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("Update returned %v", err)
+	}
+	items, _ := s.ListRecords(Filter{Field: "Score", Value: 10}, []testItem{})
+	if got := items.([]testItem); len(got) != 0 {
+		t.Errorf("index of the discarded transaction is kept: %v", got)
+	}
+	if ok, _ := s.GetRecord("i2", &testItem{}); !ok {
+		t.Error("record deleted in the discarded transaction is absent")
+	}
+}